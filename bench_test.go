@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"math/rand"
+	"runtime"
 	"sync"
 	"testing"
 )
@@ -314,3 +315,83 @@ func BenchmarkCallAcquireLock(b *testing.B) {
 		}
 	}
 }
+
+func benchmarkFindLeadingZeros(b *testing.B, withSummary bool) {
+	bitmap := make([]byte, bitmapSize)
+	bitmap[bitmapSize-1] = 0x80
+	var summary *bitmapSummary
+	if withSummary {
+		summary = newBitmapSummary(bitmap)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if summary.findLeadingBitsCnt(bitmap, 0, false) != unitTotalCnt-1 {
+			panic("unexpected")
+		}
+	}
+}
+
+func BenchmarkFindLeadingZerosWithoutSummary(b *testing.B) {
+	benchmarkFindLeadingZeros(b, false)
+}
+
+func BenchmarkFindLeadingZerosWithSummary(b *testing.B) {
+	benchmarkFindLeadingZeros(b, true)
+}
+
+// loadAlternatingFreeSpaces loads the worst case of oneLengthBucket, where the
+// allocated and free units are alternating, so there are 128Mi continuous free
+// units of length 1.
+func loadAlternatingFreeSpaces() *freeSpaces {
+	bitmap := make([]byte, bitmapSize)
+	for i := range bitmap {
+		bitmap[i] = 0b1010_1010
+	}
+	s := newFreeSpaces(bitmap, newBitmapSummary(bitmap))
+	s.loadFromBitmap()
+	if s.count() != unitTotalCnt/2 {
+		panic("unexpected")
+	}
+	return s
+}
+
+func BenchmarkAlternatingLoad(b *testing.B) {
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		s := loadAlternatingFreeSpaces()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(s)
+	}
+	// the bitmap and its summary are included
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(1<<20), "MiB")
+}
+
+func BenchmarkAlternatingDelete(b *testing.B) {
+	s := loadAlternatingFreeSpaces()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// the last one is the worst case of a slice based bucket
+		s.delete(unitTotalCnt-2, 1)
+		s.put(unitTotalCnt-2, 1)
+	}
+}
+
+func BenchmarkAlternatingTake(b *testing.B) {
+	s := loadAlternatingFreeSpaces()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		offset, ok := s.take(1)
+		if !ok {
+			panic("unexpected")
+		}
+		allocInBitmap(s.bitmap, offset, 1)
+		s.summary.update(s.bitmap, offset, 1)
+	}
+}
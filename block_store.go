@@ -0,0 +1,214 @@
+package disk_management_demo
+
+import (
+	"cmp"
+	"io"
+	"os"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// directIOAlignment is the alignment of the buffers, offsets and sizes of the
+// I/O on the data file. It's the unit size, which satisfies the logical block
+// size of the common devices.
+const directIOAlignment = unitSize
+
+// BlockStore stores the data in the space allocated by a Manager, in a backing
+// data file or block device whose offsets are the ones managed by the Manager.
+// The data is read and written with O_DIRECT when the file system supports it,
+// so the space of a Put is aligned to units. It's thread-safe if the Manager is.
+type BlockStore struct {
+	m Manager
+	f *os.File
+}
+
+// OpenBlockStore opens the backing data file or block device at dataPath for
+// m. A data file is created if it does not exist, and it grows as the data is
+// written.
+func OpenBlockStore(m Manager, dataPath string) (*BlockStore, error) {
+	f, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE|directIOFlag, 0o644)
+	if errors.Is(err, syscall.EINVAL) && directIOFlag != 0 {
+		// the file system, like tmpfs, does not support O_DIRECT
+		f, err = os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0o644)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &BlockStore{m: m, f: f}, nil
+}
+
+// Put allocates the space for data, writes data to it and returns the start
+// offset. The space is rounded up to units, and it's freed if the write fails.
+func (s *BlockStore) Put(data []byte) (int64, error) {
+	if len(data) == 0 {
+		return 0, errors.New("data should not be empty")
+	}
+	size := roundUpToUnit(int64(len(data)))
+	offset, err := s.m.AllocAligned(size, unitSize)
+	if err != nil {
+		return 0, err
+	}
+	buf := alignedBuffer(size)
+	copy(buf, data)
+	if _, err = s.f.WriteAt(buf, offset); err != nil {
+		err = errors.Wrapf(err, "failed to write %d bytes at %d", size, offset)
+		if err2 := s.m.Free(offset, size); err2 != nil {
+			return 0, withCleanupError(err, err2)
+		}
+		return 0, err
+	}
+	return offset, nil
+}
+
+// Get reads size bytes at offset, which should be returned by Put. The space
+// should be allocated.
+func (s *BlockStore) Get(offset, size int64) ([]byte, error) {
+	if err := checkBlockRange(offset, size); err != nil {
+		return nil, err
+	}
+	allocated, err := s.m.IsAllocated(offset, size)
+	if err != nil {
+		return nil, err
+	}
+	if !allocated {
+		return nil, errors.Errorf("range [%d, %d) is not allocated", offset, offset+size)
+	}
+	buf := alignedBuffer(roundUpToUnit(size))
+	// the space that is allocated but never written may be beyond the end of
+	// the data file, which reads as zeros
+	if _, err = s.f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to read %d bytes at %d", len(buf), offset)
+	}
+	return buf[:size], nil
+}
+
+// Delete frees the space of size bytes at offset, which should be returned by
+// Put. The data is not erased.
+func (s *BlockStore) Delete(offset, size int64) error {
+	if err := checkBlockRange(offset, size); err != nil {
+		return err
+	}
+	return s.m.Free(offset, roundUpToUnit(size))
+}
+
+// Reconcile makes the allocated space of the Manager the same as used, which
+// is the space returned by Put and still referenced by the caller, like the
+// values in an index. The caller should call it when it's opened, because the
+// Manager is only persisted when it's closed, and a crash may lose the
+// allocations of the referenced space or keep the allocations that are never
+// referenced. The BlockStore should own all the space allocated by Alloc of the
+// Manager, see reconcileAllocations for the space that is not touched.
+func (s *BlockStore) Reconcile(used []Range) error {
+	rounded := make([]Range, 0, len(used))
+	for _, r := range used {
+		if err := checkBlockRange(r.Offset, r.Size); err != nil {
+			return err
+		}
+		rounded = append(rounded, Range{Offset: r.Offset, Size: roundUpToUnit(r.Size)})
+	}
+	return reconcileAllocations(s.m, rounded)
+}
+
+// reconcileAllocations allocates the space of used that is free in m, and frees
+// the space allocated by Alloc of m out of used. The space that can't be
+// allocated by Alloc is never freed, which is the reserved and bad space, the
+// units packed with sub-unit allocations, the space shared by IncRef and the
+// allocations of namespaces other than DefaultNamespace, so the owner of used
+// can share m with their users. The ranges of used should be aligned to units,
+// and they're validated by m. Allocating needs m to implement RangeAllocator.
+func reconcileAllocations(m Manager, used []Range) error {
+	for _, r := range used {
+		if _, err := m.IsAllocated(r.Offset, r.Size); err != nil {
+			return err
+		}
+	}
+	used = slices.Clone(used)
+	slices.SortFunc(used, func(a, b Range) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	var lost, leaked []Range
+	i := 0
+	m.Extents(func(e Extent) bool {
+		if e.Reserved || e.Bad || e.Packed || e.Shared || e.Namespace != DefaultNamespace {
+			return true
+		}
+		for start, end := e.Offset, e.Offset+e.Size; start < end; {
+			for i < len(used) && used[i].Offset+used[i].Size <= start {
+				i++
+			}
+			next, inUsed := end, false
+			if i < len(used) {
+				if used[i].Offset <= start {
+					next, inUsed = min(end, used[i].Offset+used[i].Size), true
+				} else {
+					next = min(end, used[i].Offset)
+				}
+			}
+			switch r := (Range{Offset: start, Size: next - start}); {
+			case inUsed && !e.Allocated:
+				lost = append(lost, r)
+			case !inUsed && e.Allocated:
+				leaked = append(leaked, r)
+			}
+			start = next
+		}
+		return true
+	})
+
+	if len(lost) > 0 {
+		ra, ok := m.(RangeAllocator)
+		if !ok {
+			return errors.Errorf("range at %d with size %d is not allocated in the manager", lost[0].Offset, lost[0].Size)
+		}
+		for _, r := range lost {
+			if err := ra.AllocRange(r.Offset, r.Size); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range leaked {
+		if err := m.Free(r.Offset, r.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync flushes the written data to the device.
+func (s *BlockStore) Sync() error {
+	return errors.WithStack(s.f.Sync())
+}
+
+// Close closes the data file. The Manager should be closed separately to
+// persist the allocations.
+func (s *BlockStore) Close() error {
+	return errors.WithStack(s.f.Close())
+}
+
+func checkBlockRange(offset, size int64) error {
+	if offset < 0 || offset%unitSize != 0 {
+		return errors.Errorf("offset should be aligned to 4KiB, got: %d", offset)
+	}
+	if size <= 0 {
+		return errors.Errorf("size should be positive, got: %d", size)
+	}
+	return nil
+}
+
+func roundUpToUnit(size int64) int64 {
+	return unitOffsetToByteOffset(byteSizeToUnitCnt(size))
+}
+
+// alignedBuffer returns a zeroed buffer of size bytes whose address is aligned
+// to directIOAlignment, as O_DIRECT requires.
+func alignedBuffer(size int64) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	skip := int64(0)
+	if rem := int64(uintptr(unsafe.Pointer(&buf[0])) % directIOAlignment); rem != 0 {
+		skip = directIOAlignment - rem
+	}
+	return buf[skip : skip+size : skip+size]
+}
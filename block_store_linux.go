@@ -0,0 +1,5 @@
+package disk_management_demo
+
+import "syscall"
+
+const directIOFlag = syscall.O_DIRECT
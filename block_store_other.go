@@ -0,0 +1,6 @@
+//go:build !linux
+
+package disk_management_demo
+
+// directIOFlag is not used on the platforms without O_DIRECT.
+const directIOFlag = 0
@@ -0,0 +1,154 @@
+package disk_management_demo
+
+import (
+	"bytes"
+	"path"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, size := range []int64{unitSize, 3 * unitSize} {
+		buf := alignedBuffer(size)
+		require.Len(t, buf, int(size))
+		require.Zero(t, uintptr(unsafe.Pointer(&buf[0]))%directIOAlignment)
+	}
+}
+
+func TestBlockStore(t *testing.T) {
+	imageFile := createFileWithContent(t, nil)
+	dataFile := path.Join(t.TempDir(), "data")
+	m, err := NewDiskManager(imageFile)
+	require.NoError(t, err)
+	s, err := OpenBlockStore(m, dataFile)
+	require.NoError(t, err)
+
+	_, err = s.Put(nil)
+	require.ErrorContains(t, err, "data should not be empty")
+	small := []byte("hello")
+	large := bytes.Repeat([]byte{0xAB}, 2*unitSize+1)
+	offset1, err := s.Put(small)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, offset1)
+	offset2, err := s.Put(large)
+	require.NoError(t, err)
+	// the space of a Put is rounded up to units
+	require.EqualValues(t, unitSize, offset2)
+	require.EqualValues(t, 4*unitSize, m.Stats().UsedSize)
+
+	got, err := s.Get(offset1, int64(len(small)))
+	require.NoError(t, err)
+	require.Equal(t, small, got)
+	got, err = s.Get(offset2, int64(len(large)))
+	require.NoError(t, err)
+	require.Equal(t, large, got)
+	_, err = s.Get(100, unitSize)
+	require.ErrorContains(t, err, "offset should be aligned to 4KiB, got: 100")
+
+	require.NoError(t, s.Delete(offset1, int64(len(small))))
+	_, err = s.Get(offset1, int64(len(small)))
+	require.ErrorContains(t, err, "range [0, 5) is not allocated")
+	require.EqualValues(t, 3*unitSize, m.Stats().UsedSize)
+	require.NoError(t, s.Sync())
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+
+	// the data and the allocations are kept after reopening
+	m, err = NewDiskManager(imageFile)
+	require.NoError(t, err)
+	s, err = OpenBlockStore(m, dataFile)
+	require.NoError(t, err)
+	got, err = s.Get(offset2, int64(len(large)))
+	require.NoError(t, err)
+	require.Equal(t, large, got)
+	offset3, err := s.Put(small)
+	require.NoError(t, err)
+	require.Equal(t, offset1, offset3)
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+}
+
+func TestBlockStoreReconcile(t *testing.T) {
+	imageFile := path.Join(t.TempDir(), "image")
+	require.NoError(t, FormatImage(imageFile, Range{Offset: 10 * unitSize, Size: unitSize}))
+	m, err := NewDiskManager(imageFile)
+	require.NoError(t, err)
+	s, err := OpenBlockStore(m, path.Join(t.TempDir(), "data"))
+	require.NoError(t, err)
+
+	// [0, 3) is referenced but lost, [3, 5) is leaked, [5, 6) is kept, and the
+	// reserved unit 10 and the bad unit 12 are not touched
+	require.NoError(t, m.(RangeAllocator).AllocRange(3*unitSize, 3*unitSize))
+	require.ErrorContains(t, m.(RangeAllocator).AllocRange(5*unitSize, unitSize), "range at 20480 with size 4096 is not free")
+	require.ErrorContains(t, m.(RangeAllocator).AllocRange(0, 1), "range should be aligned to 4KiB, got: 0, 1")
+	require.NoError(t, m.MarkBad(12*unitSize, unitSize))
+
+	require.ErrorContains(t, s.Reconcile([]Range{{Offset: 1, Size: 1}}), "offset should be aligned to 4KiB, got: 1")
+	require.NoError(t, s.Reconcile([]Range{
+		{Offset: 5 * unitSize, Size: 1},
+		{Offset: 0, Size: 2*unitSize + 1},
+	}))
+	var got []Extent
+	m.Extents(func(e Extent) bool {
+		got = append(got, e)
+		return e.Offset < 12*unitSize
+	})
+	require.Equal(t, []Extent{
+		{Offset: 0, Size: 3 * unitSize, Allocated: true},
+		{Offset: 3 * unitSize, Size: 2 * unitSize},
+		{Offset: 5 * unitSize, Size: unitSize, Allocated: true},
+		{Offset: 6 * unitSize, Size: 4 * unitSize},
+		{Offset: 10 * unitSize, Size: unitSize, Allocated: true, Reserved: true},
+		{Offset: 11 * unitSize, Size: unitSize},
+		{Offset: 12 * unitSize, Size: unitSize, Allocated: true, Bad: true},
+	}, got)
+
+	// the lost space can't be allocated again without RangeAllocator
+	b, err := NewBuddyManager(createFileWithContent(t, nil))
+	require.NoError(t, err)
+	s, err = OpenBlockStore(b, path.Join(t.TempDir(), "data"))
+	require.NoError(t, err)
+	require.ErrorContains(t, s.Reconcile([]Range{{Offset: 0, Size: unitSize}}), "range at 0 with size 4096 is not allocated in the manager")
+}
+
+func TestBlockStoreReconcileSharedManager(t *testing.T) {
+	m, err := NewDiskManager(createFileWithContent(t, nil))
+	require.NoError(t, err)
+	s, err := OpenBlockStore(m, path.Join(t.TempDir(), "data"))
+	require.NoError(t, err)
+
+	// the space allocated by other users in other ways is not freed
+	packed, err := m.Alloc(512)
+	require.NoError(t, err)
+	require.NoError(t, m.SetNamespace(3, 0, 0))
+	owned, err := m.AllocIn(3, unitSize)
+	require.NoError(t, err)
+	shared, err := m.Alloc(2 * unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.IncRef(shared+unitSize, unitSize))
+	leaked, err := m.Alloc(unitSize)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Reconcile(nil))
+	var got []Extent
+	m.Extents(func(e Extent) bool {
+		if e.Allocated {
+			got = append(got, e)
+		}
+		return true
+	})
+	require.Equal(t, []Extent{
+		{Offset: packed, Size: unitSize, Allocated: true, Packed: true},
+		{Offset: owned, Size: unitSize, Allocated: true, Namespace: 3},
+		{Offset: shared + unitSize, Size: unitSize, Allocated: true, Shared: true},
+	}, got)
+	allocated, err := m.IsAllocated(leaked, unitSize)
+	require.NoError(t, err)
+	require.False(t, allocated)
+
+	// the used ranges are validated by the manager
+	require.ErrorContains(t, s.Reconcile([]Range{{Offset: spaceTotalSize, Size: unitSize}}), "start offset + size should be less than 1TiB")
+	require.NoError(t, m.Close())
+}
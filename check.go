@@ -0,0 +1,377 @@
+package disk_management_demo
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CheckReport is the result of Check and CheckAndRepair.
+type CheckReport struct {
+	ImageFilePath string    `json:"image_file_path"`
+	Findings      []Finding `json:"findings"`
+}
+
+// Finding is an inconsistency found in the image.
+type Finding struct {
+	// Kind is a short identifier of the checked item, like "size".
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// Repaired is true when the inconsistency has been fixed in the image.
+	Repaired bool `json:"repaired"`
+}
+
+// OK returns true if the image has no unrepaired inconsistency.
+func (r *CheckReport) OK() bool {
+	for _, f := range r.Findings {
+		if !f.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the human-readable form of the report.
+func (r *CheckReport) String() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "%s: ", r.ImageFilePath)
+	if len(r.Findings) == 0 {
+		sb.WriteString("clean\n")
+		return sb.String()
+	}
+	fmt.Fprintf(sb, "%d problem(s) found\n", len(r.Findings))
+	for _, f := range r.Findings {
+		status := "unrepaired"
+		if f.Repaired {
+			status = "repaired"
+		}
+		fmt.Fprintf(sb, "  [%s] %s (%s)\n", f.Kind, f.Message, status)
+	}
+	return sb.String()
+}
+
+// Check verifies the image file offline without modifying it. It returns an
+// error only when the check itself cannot be done, the inconsistencies are
+// reported in CheckReport.
+func Check(imageFilePath string) (*CheckReport, error) {
+	return check(imageFilePath, false)
+}
+
+// CheckAndRepair is like Check, but it also repairs the image when possible.
+func CheckAndRepair(imageFilePath string) (*CheckReport, error) {
+	return check(imageFilePath, true)
+}
+
+func check(imageFilePath string, repair bool) (*CheckReport, error) {
+	r := &CheckReport{ImageFilePath: imageFilePath, Findings: []Finding{}}
+	content, err := os.ReadFile(imageFilePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var (
+		trailer   *imageTrailer
+		needWrite bool
+	)
+	switch s := len(content); {
+	case s < bitmapSize:
+		// the missing units are treated as allocated to not lose any data
+		content = append(content, ones[:bitmapSize-s]...)
+		r.Findings = append(r.Findings, Finding{
+			Kind:     "size",
+			Message:  fmt.Sprintf("image is truncated to %d bytes, missing units are marked allocated", s),
+			Repaired: repair,
+		})
+		needWrite = true
+	case s > bitmapSize:
+		trailer, err = decodeTrailer(content[bitmapSize:])
+		content = content[:bitmapSize]
+		switch {
+		case errors.Is(err, errNoTrailer):
+			r.Findings = append(r.Findings, Finding{
+				Kind:     "size",
+				Message:  fmt.Sprintf("image has %d unexpected bytes after the bitmap", s-bitmapSize),
+				Repaired: repair,
+			})
+			needWrite = true
+		case err != nil:
+			r.Findings = append(r.Findings, Finding{
+				Kind:     "trailer",
+				Message:  fmt.Sprintf("trailer is broken and dropped: %v", err),
+				Repaired: repair,
+			})
+			needWrite = true
+		}
+	}
+
+	// the bitmap is only trusted when it matches the checksum in the trailer.
+	// Otherwise it's corrupt and can't be repaired here, the checksum is kept so
+	// the image is still rejected until it's restored from a mirror or snapshot.
+	bitmapOK := trailer == nil || trailer.bitmapCRC == bitmapCRC(content)
+	if !bitmapOK {
+		r.Findings = append(r.Findings, Finding{
+			Kind:    "bitmap_checksum",
+			Message: "bitmap mismatches the checksum in the trailer, it may be corrupt",
+		})
+	}
+
+	summary := newBitmapSummary(content)
+	if trailer != nil {
+		for _, rs := range []*unitRanges{newReservedRanges(), newBadRanges()} {
+			if checkUnitRanges(r, rs, trailer, content, summary, repair) {
+				needWrite = true
+			}
+		}
+		if checkNamespaces(r, trailer, content, summary, repair) {
+			needWrite = true
+		}
+		if checkRefCounts(r, trailer, content, repair) {
+			needWrite = true
+		}
+	}
+	if trailer != nil {
+		// the slabs inconsistent with the bitmap are dropped, the bitmap is
+		// trusted
+		ss, problems := decodeSlabs(trailer.sections[sectionSlabs], content)
+		for _, p := range problems {
+			r.Findings = append(r.Findings, Finding{Kind: "slabs", Message: p + ", it's dropped", Repaired: repair})
+		}
+		if len(problems) > 0 {
+			trailer.sections[sectionSlabs] = ss.encode()
+			needWrite = true
+		}
+
+		// the snapshot is only a cache of the bitmap, so it's safe to drop it. It
+		// can't be checked against a corrupt bitmap, which is already reported.
+		var msg string
+		if bitmapOK {
+			msg = checkSnapshot(trailer, content, summary)
+		}
+		if msg != "" {
+			delete(trailer.sections, sectionFreeSpaces)
+			r.Findings = append(r.Findings, Finding{
+				Kind:     "free_space_snapshot",
+				Message:  msg + ", it's dropped",
+				Repaired: repair,
+			})
+			needWrite = true
+		}
+	}
+
+	if repair && needWrite {
+		var trailerData []byte
+		if trailer != nil {
+			if bitmapOK {
+				trailer.bitmapCRC = bitmapCRC(content)
+			}
+			trailerData = trailer.encode()
+		}
+		if err = writeFileAtomically(imageFilePath, content, trailerData); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// checkUnitRanges checks the ranges of rs in trailer, like the reserved or bad
+// ones, and adds the findings to r. The malformed ranges are dropped, and the
+// units of the valid ones are marked allocated in bitmap if they are free,
+// because the space should never be handed out by the allocator. It returns
+// true if the image is changed.
+func checkUnitRanges(r *CheckReport, rs *unitRanges, trailer *imageTrailer, bitmap []byte, summary *bitmapSummary, repair bool) bool {
+	changed := false
+	problems := rs.decode(trailer.sections[rs.kind])
+	for _, p := range problems {
+		r.Findings = append(r.Findings, Finding{Kind: rs.name, Message: p + ", it's dropped", Repaired: repair})
+	}
+	if len(problems) > 0 {
+		delete(trailer.sections, rs.kind)
+		if len(rs.ranges) > 0 {
+			trailer.sections[rs.kind] = rs.encode()
+		}
+		changed = true
+	}
+	for _, l := range rs.unallocated(bitmap, summary) {
+		r.Findings = append(r.Findings, Finding{
+			Kind:     rs.name,
+			Message:  fmt.Sprintf("%s range at unit %d with length %d is free in bitmap, it's marked allocated", rs.name, l.offset, l.length),
+			Repaired: repair,
+		})
+		allocInBitmap(bitmap, l.offset, l.length)
+		summary.update(bitmap, l.offset, l.length)
+		changed = true
+	}
+	return changed
+}
+
+// checkNamespaces checks the namespaces in trailer and adds the findings to r.
+// The malformed records and the allocations that are free in bitmap are
+// dropped, so the usage of the namespaces is rebuilt from the rest. It returns
+// true if the image is changed.
+func checkNamespaces(r *CheckReport, trailer *imageTrailer, bitmap []byte, summary *bitmapSummary, repair bool) bool {
+	payload, ok := trailer.sections[sectionNamespaces]
+	if !ok {
+		return false
+	}
+	nss := newNamespaces()
+	problems := nss.decode(payload)
+	problems = append(problems, nss.dropUnallocated(bitmap, summary)...)
+	for _, p := range problems {
+		r.Findings = append(r.Findings, Finding{Kind: "namespaces", Message: p + ", it's dropped", Repaired: repair})
+	}
+	if len(problems) == 0 {
+		return false
+	}
+	delete(trailer.sections, sectionNamespaces)
+	if len(nss.defs) > 0 {
+		trailer.sections[sectionNamespaces] = nss.encode()
+	}
+	return true
+}
+
+// checkRefCounts checks the reference counts in trailer and adds the findings to
+// r. The malformed runs and the counts of the free units are dropped. It
+// returns true if the image is changed.
+func checkRefCounts(r *CheckReport, trailer *imageTrailer, bitmap []byte, repair bool) bool {
+	payload, ok := trailer.sections[sectionRefCounts]
+	if !ok {
+		return false
+	}
+	rc := newRefCounts()
+	problems := rc.decode(payload)
+	problems = append(problems, rc.dropUnallocated(bitmap)...)
+	for _, p := range problems {
+		r.Findings = append(r.Findings, Finding{Kind: "ref_counts", Message: p + ", it's dropped", Repaired: repair})
+	}
+	if len(problems) == 0 {
+		return false
+	}
+	delete(trailer.sections, sectionRefCounts)
+	if !rc.empty() {
+		trailer.sections[sectionRefCounts] = rc.encode()
+	}
+	return true
+}
+
+// checkSnapshot returns the problem of the snapshot of freeSpaces in trailer, or
+// an empty string if there's no problem. The bitmap should match the checksum
+// in trailer.
+func checkSnapshot(trailer *imageTrailer, bitmap []byte, summary *bitmapSummary) string {
+	payload, ok := trailer.sections[sectionFreeSpaces]
+	if !ok {
+		return ""
+	}
+	s := newFreeSpaces(bitmap, summary)
+	if err := s.loadFromSnapshot(payload, trailer.generation); err != nil {
+		return err.Error()
+	}
+	if err := verifyFreeSpaces(s, bitmap, summary); err != nil {
+		return fmt.Sprintf("snapshot of free spaces is inconsistent: %v", err)
+	}
+	return ""
+}
+
+// verifyFreeSpaces checks that the continuous free units in s are exactly the
+// continuous zero bits in bitmap. summary can be nil.
+func verifyFreeSpaces(s *freeSpaces, bitmap []byte, summary *bitmapSummary) error {
+	var (
+		got []location
+		// smallCnt is the number of continuous free units in oneLengthBuckets for
+		// every length and region.
+		smallCnt [oneLengthBucketThreshold][]uint16
+	)
+	for i, b := range s.buckets {
+		switch v := b.(type) {
+		case *oneLengthBucket:
+			if err := verifyOneLengthBucket(v); err != nil {
+				return err
+			}
+			smallCnt[v.length] = make([]uint16, smallRunRegionCnt)
+			if v.total > 0 {
+				copy(smallCnt[v.length], v.cnt)
+			}
+		case *varLengthBucket:
+			for pos, l := range v.locations {
+				if getBucketIdx(l.length) != i {
+					return errors.Errorf("free space at unit %d with length %d is in wrong bucket %d", l.offset, l.length, i)
+				}
+				got = append(got, *l)
+				if err := verifyIndexed(s.index, l.offset, l.length, pos); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if s.index.length != len(got) {
+		return errors.Errorf("index has %d free spaces, but buckets have %d", s.index.length, len(got))
+	}
+	slices.SortFunc(got, func(a, b location) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+
+	idx := 0
+	for offset := unit(0); offset < unitTotalCnt; {
+		if bitmap[offset/8]&(1<<(offset%8)) != 0 {
+			offset += summary.findLeadingBitsCnt(bitmap, offset, true)
+			continue
+		}
+		length := summary.findLeadingBitsCnt(bitmap, offset, false)
+		if length < oneLengthBucketThreshold {
+			cnt := smallCnt[length]
+			region := offset >> smallRunRegionBits
+			if cnt[region] == 0 {
+				return errors.Errorf("free space at unit %d with length %d is not recorded", offset, length)
+			}
+			cnt[region]--
+		} else {
+			if idx >= len(got) || got[idx] != (location{offset: offset, length: length}) {
+				return errors.Errorf("free space at unit %d with length %d is not recorded", offset, length)
+			}
+			idx++
+		}
+		offset += length
+	}
+	if idx < len(got) {
+		return errors.Errorf("free space at unit %d with length %d does not exist in bitmap", got[idx].offset, got[idx].length)
+	}
+	for length, cnt := range smallCnt[1:] {
+		if region := slices.IndexFunc(cnt, func(c uint16) bool { return c > 0 }); region >= 0 {
+			return errors.Errorf("%d free spaces with length %d in region %d do not exist in bitmap", cnt[region], length+1, region)
+		}
+	}
+	return nil
+}
+
+// verifyOneLengthBucket checks the counters of the bucket are consistent.
+func verifyOneLengthBucket(b *oneLengthBucket) error {
+	total := 0
+	for region, c := range b.cnt {
+		total += int(c)
+		empty := b.empty1[region/64]&(1<<(region%64)) != 0
+		if empty != (c == 0) {
+			return errors.Errorf("bucket of length %d has wrong empty bit for region %d", b.length, region)
+		}
+	}
+	if total != b.total {
+		return errors.Errorf("bucket of length %d has %d free spaces, but its regions have %d", b.length, b.total, total)
+	}
+	for i, w := range b.empty1 {
+		full := b.empty2[i/64]&(1<<(i%64)) != 0
+		if full != (w == ^uint64(0)) {
+			return errors.Errorf("bucket of length %d has wrong summary for regions %d-%d", b.length, i*64, i*64+63)
+		}
+	}
+	return nil
+}
+
+func verifyIndexed(index *extentIndex, offset, length unit, pos int) error {
+	item, ok := index.get(offset)
+	if !ok || item.length != length || item.pos != pos {
+		return errors.Errorf("free space at unit %d with length %d is not indexed correctly", offset, length)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package disk_management_demo
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	r, err := Check(tempFile)
+	require.NoError(t, err)
+	require.True(t, r.OK())
+	require.Empty(t, r.Findings)
+	require.Equal(t, tempFile+": clean\n", r.String())
+
+	_, err = Check("not_exist")
+	require.ErrorContains(t, err, "no such file or directory")
+
+	tempFile = createFileWithContent(t, make([]byte, bitmapSize+3))
+	r, err = Check(tempFile)
+	require.NoError(t, err)
+	require.False(t, r.OK())
+	require.Equal(t, []Finding{{
+		Kind:    "size",
+		Message: "image has 3 unexpected bytes after the bitmap",
+	}}, r.Findings)
+	r, err = CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.True(t, r.OK())
+	r, err = Check(tempFile)
+	require.NoError(t, err)
+	require.Empty(t, r.Findings)
+
+	tempFile = createFileWithContent(t, []byte{0b0000_0001})
+	r, err = CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, []Finding{{
+		Kind:     "size",
+		Message:  "image is truncated to 1 bytes, missing units are marked allocated",
+		Repaired: true,
+	}}, r.Findings)
+	require.Equal(t, tempFile+": 1 problem(s) found\n"+
+		"  [size] image is truncated to 1 bytes, missing units are marked allocated (repaired)\n", r.String())
+	content, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	require.Len(t, content, bitmapSize)
+	require.Equal(t, byte(0b0000_0001), content[0])
+	require.Equal(t, ones[1:], content[1:])
+}
+
+func TestCheckTrailer(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := NewDiskManager(tempFile)
+	require.NoError(t, err)
+	_, err = m.Alloc(unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	r, err := Check(tempFile)
+	require.NoError(t, err)
+	require.Empty(t, r.Findings)
+
+	// the bitmap changed without updating the trailer is corrupt, and it's not
+	// accepted by repair
+	content, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	content[1] = 0xFF
+	require.NoError(t, os.WriteFile(tempFile, content, 0600))
+	for i := 0; i < 2; i++ {
+		r, err = CheckAndRepair(tempFile)
+		require.NoError(t, err)
+		require.Equal(t, []Finding{{
+			Kind:    "bitmap_checksum",
+			Message: "bitmap mismatches the checksum in the trailer, it may be corrupt",
+		}}, r.Findings)
+	}
+	_, err = NewDiskManager(tempFile)
+	require.ErrorContains(t, err, "checksum of bitmap mismatches, the image may be corrupt")
+
+	// the mismatch is found without the snapshot of free spaces
+	trailer, err := decodeTrailer(content[bitmapSize:])
+	require.NoError(t, err)
+	delete(trailer.sections, sectionFreeSpaces)
+	require.NoError(t, writeFileAtomically(tempFile, content[:bitmapSize], trailer.encode()))
+	r, err = Check(tempFile)
+	require.NoError(t, err)
+	require.False(t, r.OK())
+	require.Equal(t, "bitmap_checksum", r.Findings[0].Kind)
+	_, err = NewDiskManager(tempFile)
+	require.ErrorContains(t, err, "checksum of bitmap mismatches, the image may be corrupt")
+
+	// the snapshot of free spaces that mismatches the bitmap is dropped
+	content[1] = 0
+	writeBitmap(t, tempFile, content[:bitmapSize])
+	r, err = CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Empty(t, r.Findings)
+	trailer.sections[sectionFreeSpaces] = []byte{}
+	require.NoError(t, writeFileAtomically(tempFile, content[:bitmapSize], trailer.encode()))
+	content[1] = 0xFF
+	writeBitmap(t, tempFile, content[:bitmapSize])
+	r, err = CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, []Finding{{
+		Kind:     "free_space_snapshot",
+		Message:  "snapshot of free spaces is truncated, it's dropped",
+		Repaired: true,
+	}}, r.Findings)
+	r, err = Check(tempFile)
+	require.NoError(t, err)
+	require.Empty(t, r.Findings)
+	repaired, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	trailer, err = decodeTrailer(repaired[bitmapSize:])
+	require.NoError(t, err)
+	require.EqualValues(t, 1, trailer.generation)
+	require.Empty(t, trailer.sections)
+
+	// corrupt the trailer
+	content[len(content)-1]++
+	require.NoError(t, os.WriteFile(tempFile, content, 0600))
+	r, err = CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, []Finding{{
+		Kind:     "trailer",
+		Message:  "trailer is broken and dropped: checksum of section 0 mismatches",
+		Repaired: true,
+	}}, r.Findings)
+	repaired, err = os.ReadFile(tempFile)
+	require.NoError(t, err)
+	require.Len(t, repaired, bitmapSize)
+}
+
+// writeBitmap replaces the bitmap of the image file and updates the checksum in
+// its trailer, so the bitmap is trusted but may be inconsistent with the other
+// metadata.
+func writeBitmap(t *testing.T, imageFilePath string, bitmap []byte) {
+	content, err := os.ReadFile(imageFilePath)
+	require.NoError(t, err)
+	trailer, err := decodeTrailer(content[bitmapSize:])
+	require.NoError(t, err)
+	trailer.bitmapCRC = bitmapCRC(bitmap)
+	require.NoError(t, writeFileAtomically(imageFilePath, bitmap, trailer.encode()))
+}
+
+func TestCheckSlabs(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := NewDiskManager(tempFile)
+	require.NoError(t, err)
+	_, err = m.Alloc(512)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	r, err := Check(tempFile)
+	require.NoError(t, err)
+	require.Empty(t, r.Findings)
+
+	content, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	content[0] = 0
+	writeBitmap(t, tempFile, content[:bitmapSize])
+	_, err = NewDiskManager(tempFile)
+	require.ErrorContains(t, err, "invalid slabs in image trailer: slab at unit 0 is free in bitmap")
+
+	r, err = CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, []Finding{{
+		Kind:     "slabs",
+		Message:  "slab at unit 0 is free in bitmap, it's dropped",
+		Repaired: true,
+	}, {
+		Kind:     "free_space_snapshot",
+		Message:  "snapshot of free spaces is inconsistent: free space at unit 0 with length 268435456 is not recorded, it's dropped",
+		Repaired: true,
+	}}, r.Findings)
+	m, err = NewDiskManager(tempFile)
+	require.NoError(t, err)
+	require.Zero(t, m.Stats().UsedSize)
+}
+
+func TestCheckReserved(t *testing.T) {
+	tempFile := path.Join(t.TempDir(), "image")
+	require.NoError(t, FormatImage(tempFile, Range{Offset: 0, Size: 2 * unitSize}))
+	r, err := Check(tempFile)
+	require.NoError(t, err)
+	require.Empty(t, r.Findings)
+
+	content, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	content[0] = 0b0000_0001
+	writeBitmap(t, tempFile, content[:bitmapSize])
+	_, err = NewDiskManager(tempFile)
+	require.ErrorContains(t, err, "invalid reserved ranges in image trailer: reserved range at unit 0 with length 2 is free in bitmap")
+
+	r, err = CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, []Finding{{
+		Kind:     "reserved",
+		Message:  "reserved range at unit 0 with length 2 is free in bitmap, it's marked allocated",
+		Repaired: true,
+	}}, r.Findings)
+	m, err := NewDiskManager(tempFile)
+	require.NoError(t, err)
+	require.EqualValues(t, 2*unitSize, m.Stats().ReservedSize)
+
+	// the bad units stay allocated after repair
+	require.NoError(t, m.MarkBad(2*unitSize, unitSize))
+	require.NoError(t, m.Close())
+	content, err = os.ReadFile(tempFile)
+	require.NoError(t, err)
+	content[0] = 0b0000_0011
+	writeBitmap(t, tempFile, content[:bitmapSize])
+	r, err = CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, []Finding{{
+		Kind:     "bad",
+		Message:  "bad range at unit 2 with length 1 is free in bitmap, it's marked allocated",
+		Repaired: true,
+	}}, r.Findings)
+	m, err = NewDiskManager(tempFile)
+	require.NoError(t, err)
+	require.EqualValues(t, unitSize, m.Stats().BadSize)
+}
+
+func TestCheckNamespaces(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := NewDiskManager(tempFile)
+	require.NoError(t, err)
+	require.NoError(t, m.SetNamespace(1, 0, 0))
+	_, err = m.AllocIn(1, unitSize)
+	require.NoError(t, err)
+	_, err = m.AllocIn(1, unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	content, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	content[0] = 0b0000_0010
+	writeBitmap(t, tempFile, content[:bitmapSize])
+	_, err = NewDiskManager(tempFile)
+	require.ErrorContains(t, err, "invalid namespaces in image trailer: allocation at 0 with size 4096 of namespace 1 is free in bitmap")
+
+	r, err := CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, []Finding{{
+		Kind:     "namespaces",
+		Message:  "allocation at 0 with size 4096 of namespace 1 is free in bitmap, it's dropped",
+		Repaired: true,
+	}, {
+		Kind:     "free_space_snapshot",
+		Message:  "snapshot of free spaces is inconsistent: free space at unit 0 with length 1 is not recorded, it's dropped",
+		Repaired: true,
+	}}, r.Findings)
+	m, err = NewDiskManager(tempFile)
+	require.NoError(t, err)
+	stats, err := m.NamespaceStats(1)
+	require.NoError(t, err)
+	require.EqualValues(t, unitSize, stats.UsedSize)
+}
+
+func TestCheckRefCounts(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := NewDiskManager(tempFile)
+	require.NoError(t, err)
+	_, err = m.Alloc(2 * unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.IncRef(0, 2*unitSize))
+	require.NoError(t, m.Close())
+
+	content, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	content[0] = 0b0000_0001
+	writeBitmap(t, tempFile, content[:bitmapSize])
+	_, err = NewDiskManager(tempFile)
+	require.ErrorContains(t, err, "invalid ref counts in image trailer: ref count of unit 1 is 2, but it's free in bitmap")
+
+	r, err := CheckAndRepair(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, []Finding{{
+		Kind:     "ref_counts",
+		Message:  "ref count of unit 1 is 2, but it's free in bitmap, it's dropped",
+		Repaired: true,
+	}, {
+		Kind:     "free_space_snapshot",
+		Message:  "snapshot of free spaces is inconsistent: free space at unit 1 with length 268435455 is not recorded, it's dropped",
+		Repaired: true,
+	}}, r.Findings)
+	m, err = NewDiskManager(tempFile)
+	require.NoError(t, err)
+	require.NoError(t, m.Free(0, unitSize))
+	allocated, err := m.IsAllocated(0, unitSize)
+	require.NoError(t, err)
+	require.True(t, allocated)
+}
+
+func TestVerifyFreeSpaces(t *testing.T) {
+	bitmap := make([]byte, bitmapSize)
+	bitmap[0] = 0b0001_0010
+	s := newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	require.NoError(t, verifyFreeSpaces(s, bitmap, nil))
+
+	s.put(unitTotalCnt-1, 1)
+	require.ErrorContains(t, verifyFreeSpaces(s, bitmap, nil), "1 free spaces with length 1 in region 32767 do not exist in bitmap")
+
+	s = newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	bitmap[len(bitmap)-1] = 0xFF
+	require.ErrorContains(t, verifyFreeSpaces(s, bitmap, nil), "free space at unit 5 with length 268435443 is not recorded")
+
+	s = newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	s.getBucket(1).delete(0)
+	require.ErrorContains(t, verifyFreeSpaces(s, bitmap, nil), "free space at unit 0 with length 1 is not recorded")
+
+	s = newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	s.getBucket(1).(*oneLengthBucket).total++
+	require.ErrorContains(t, verifyFreeSpaces(s, bitmap, nil), "bucket of length 1 has 2 free spaces, but its regions have 1")
+
+	s = newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	s.index.delete(5)
+	require.ErrorContains(t, verifyFreeSpaces(s, bitmap, nil), "free space at unit 5 with length 268435443 is not indexed correctly")
+
+	s = newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	s.buckets[totalBucketCnt-1].put(unitTotalCnt-1, 1)
+	require.ErrorContains(t, verifyFreeSpaces(s, bitmap, nil), "free space at unit 268435455 with length 1 is in wrong bucket 148")
+}
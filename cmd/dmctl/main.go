@@ -0,0 +1,372 @@
+// dmctl inspects and edits the image files of disk-management-demo.
+//
+// Usage:
+//
+//	dmctl <command> [flags] <image> [args]
+//
+// Run dmctl without arguments to see the available commands.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	dm "github.com/lance6716/disk-management-demo"
+	"github.com/pkg/errors"
+)
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(fs *flag.FlagSet, args []string, out io.Writer) error
+}
+
+var commands = []*command{
+	{name: "format", args: "<image>", usage: "create an image where all the space is free", run: runFormat},
+	{name: "info", args: "<image>", usage: "show the geometry and usage of an image", run: runInfo},
+	{name: "alloc", args: "<image> <size>", usage: "allocate a space and print its offset", run: runAlloc},
+	{name: "free", args: "<image> <offset> <size>", usage: "free a space", run: runFree},
+	{name: "reserve", args: "<image> <offset> <size>", usage: "exclude a free space from allocation", run: runReserve},
+	{name: "unreserve", args: "<image> <offset> <size>", usage: "make a reserved space free again", run: runUnreserve},
+	{name: "markbad", args: "<image> <offset> <size>", usage: "retire a space that can't be used any more", run: runMarkBad},
+	{name: "bad", args: "<image>", usage: "list the bad extents of an image", run: runBad},
+	{name: "dump", args: "<image>", usage: "list the extents of an image", run: runDump},
+	{name: "histogram", args: "<image>", usage: "show the size distribution of free extents", run: runHistogram},
+	{name: "fsck", args: "<image>", usage: "check the consistency of an image and optionally repair it", run: runFsck},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "dmctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		printUsage(out)
+		return errors.New("no command given")
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		fs.SetOutput(out)
+		fs.Usage = func() {
+			fmt.Fprintf(out, "usage: dmctl %s [flags] %s\n", c.name, c.args)
+			fs.PrintDefaults()
+		}
+		return c.run(fs, args[1:], out)
+	}
+	printUsage(out)
+	return errors.Errorf("unknown command: %s", args[0])
+}
+
+func printUsage(out io.Writer) {
+	fmt.Fprintln(out, "usage: dmctl <command> [flags] <image> [args]")
+	fmt.Fprintln(out, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", c.name, c.usage)
+	}
+}
+
+// parseArgs parses the flags and checks the number of positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return nil, errors.Errorf("expect %d arguments, got %d", n, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// rangesFlag collects the ranges of a repeatable flag in the form of
+// <offset>:<size>.
+type rangesFlag []dm.Range
+
+func (f *rangesFlag) String() string {
+	parts := make([]string, 0, len(*f))
+	for _, r := range *f {
+		parts = append(parts, fmt.Sprintf("%d:%d", r.Offset, r.Size))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *rangesFlag) Set(s string) error {
+	offsetStr, sizeStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return errors.Errorf("invalid range: %s, expect <offset>:<size>", s)
+	}
+	offset, err := parseSize(offsetStr)
+	if err != nil {
+		return err
+	}
+	size, err := parseSize(sizeStr)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, dm.Range{Offset: offset, Size: size})
+	return nil
+}
+
+func runFormat(fs *flag.FlagSet, args []string, out io.Writer) error {
+	var reserved rangesFlag
+	fs.Var(&reserved, "reserve", "reserve the range <offset>:<size>, such as 0:1MiB, can be repeated")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if err = dm.FormatImage(args[0], reserved...); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "formatted %s\n", args[0])
+	return nil
+}
+
+func runInfo(fs *flag.FlagSet, args []string, out io.Writer) error {
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	m, err := dm.NewDiskManager(args[0])
+	if err != nil {
+		return err
+	}
+	s := m.Stats()
+	fmt.Fprintf(out, "total size:        %s\n", formatSize(s.TotalSize))
+	fmt.Fprintf(out, "unit size:         %s\n", formatSize(s.UnitSize))
+	fmt.Fprintf(out, "unit count:        %d\n", s.TotalSize/s.UnitSize)
+	fmt.Fprintf(out, "used size:         %s (%.6f%%)\n", formatSize(s.UsedSize), percent(s.UsedSize, s.TotalSize))
+	fmt.Fprintf(out, "free size:         %s (%.6f%%)\n", formatSize(s.FreeSize), percent(s.FreeSize, s.TotalSize))
+	fmt.Fprintf(out, "reserved size:     %s (%.6f%%)\n", formatSize(s.ReservedSize), percent(s.ReservedSize, s.TotalSize))
+	fmt.Fprintf(out, "bad size:          %s (%.6f%%)\n", formatSize(s.BadSize), percent(s.BadSize, s.TotalSize))
+	fmt.Fprintf(out, "free extents:      %d\n", s.FreeExtentCnt)
+	fmt.Fprintf(out, "largest free size: %s\n", formatSize(s.LargestFreeSize))
+	return nil
+}
+
+func runAlloc(fs *flag.FlagSet, args []string, out io.Writer) error {
+	align := fs.String("align", "", "align the offset to the given size, such as 1MiB")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	size, err := parseSize(args[1])
+	if err != nil {
+		return err
+	}
+	m, err := dm.NewDiskManager(args[0])
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if *align == "" {
+		offset, err = m.Alloc(size)
+	} else {
+		var alignment int64
+		if alignment, err = parseSize(*align); err != nil {
+			return err
+		}
+		offset, err = m.AllocAligned(size, alignment)
+	}
+	if err != nil {
+		return err
+	}
+	if err = m.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, offset)
+	return nil
+}
+
+func runFree(fs *flag.FlagSet, args []string, _ io.Writer) error {
+	return runOnRange(fs, args, dm.Manager.Free)
+}
+
+func runReserve(fs *flag.FlagSet, args []string, _ io.Writer) error {
+	return runOnRange(fs, args, dm.Manager.ReserveRange)
+}
+
+func runUnreserve(fs *flag.FlagSet, args []string, _ io.Writer) error {
+	return runOnRange(fs, args, dm.Manager.UnreserveRange)
+}
+
+func runMarkBad(fs *flag.FlagSet, args []string, _ io.Writer) error {
+	return runOnRange(fs, args, dm.Manager.MarkBad)
+}
+
+// runOnRange calls fn with the range given by the <offset> <size> arguments,
+// and saves the image.
+func runOnRange(fs *flag.FlagSet, args []string, fn func(m dm.Manager, offset, size int64) error) error {
+	args, err := parseArgs(fs, args, 3)
+	if err != nil {
+		return err
+	}
+	offset, err := parseSize(args[1])
+	if err != nil {
+		return err
+	}
+	size, err := parseSize(args[2])
+	if err != nil {
+		return err
+	}
+	m, err := dm.NewDiskManager(args[0])
+	if err != nil {
+		return err
+	}
+	if err = fn(m, offset, size); err != nil {
+		return err
+	}
+	return m.Close()
+}
+
+func runDump(fs *flag.FlagSet, args []string, out io.Writer) error {
+	onlyFree := fs.Bool("free", false, "only list the free extents")
+	onlyAllocated := fs.Bool("allocated", false, "only list the allocated extents")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	m, err := dm.NewDiskManager(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%-16s %-16s %s\n", "OFFSET", "SIZE", "STATUS")
+	m.Extents(func(e dm.Extent) bool {
+		if (e.Allocated && *onlyFree) || (!e.Allocated && *onlyAllocated) {
+			return true
+		}
+		status := "free"
+		switch {
+		case e.Reserved:
+			status = "reserved"
+		case e.Bad:
+			status = "bad"
+		case e.Allocated:
+			status = "allocated"
+		}
+		fmt.Fprintf(out, "%-16d %-16d %s\n", e.Offset, e.Size, status)
+		return true
+	})
+	return nil
+}
+
+func runBad(fs *flag.FlagSet, args []string, out io.Writer) error {
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	m, err := dm.NewDiskManager(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%-16s %s\n", "OFFSET", "SIZE")
+	m.Extents(func(e dm.Extent) bool {
+		if e.Bad {
+			fmt.Fprintf(out, "%-16d %d\n", e.Offset, e.Size)
+		}
+		return true
+	})
+	return nil
+}
+
+func runHistogram(fs *flag.FlagSet, args []string, out io.Writer) error {
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	m, err := dm.NewDiskManager(args[0])
+	if err != nil {
+		return err
+	}
+	s := m.Stats()
+	fmt.Fprintf(out, "%-12s %-12s %-12s %s\n", "MIN", "MAX", "COUNT", "RATIO")
+	for _, h := range s.FreeHistogram {
+		fmt.Fprintf(out, "%-12s %-12s %-12d %.6f%%\n",
+			formatSize(h.MinSize), formatSize(h.MaxSize), h.Count, percent(h.Count, s.FreeExtentCnt))
+	}
+	return nil
+}
+
+func runFsck(fs *flag.FlagSet, args []string, out io.Writer) error {
+	repair := fs.Bool("repair", false, "repair the image when possible")
+	asJSON := fs.Bool("json", false, "print the report in JSON")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	check := dm.Check
+	if *repair {
+		check = dm.CheckAndRepair
+	}
+	r, err := check(args[0])
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(r); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprint(out, r.String())
+	}
+	if !r.OK() {
+		return errors.New("image is inconsistent")
+	}
+	return nil
+}
+
+var sizeSuffixes = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a size in bytes, such as "4096", "4KiB" or "4K".
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	num := s
+	for _, suf := range sizeSuffixes {
+		if strings.HasSuffix(s, suf.suffix) {
+			multiplier = suf.size
+			num = strings.TrimSuffix(s, suf.suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid size: %s", s)
+	}
+	return n * multiplier, nil
+}
+
+// formatSize formats a size in bytes with the largest exact binary unit.
+func formatSize(size int64) string {
+	for _, suf := range sizeSuffixes[:4] {
+		if size >= suf.size && size%suf.size == 0 {
+			return fmt.Sprintf("%d%s", size/suf.size, suf.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total) * 100
+}
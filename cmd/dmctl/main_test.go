@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func runOK(t *testing.T, args ...string) string {
+	out := &bytes.Buffer{}
+	require.NoError(t, run(args, out))
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	image := path.Join(t.TempDir(), "image")
+
+	err := run(nil, &bytes.Buffer{})
+	require.ErrorContains(t, err, "no command given")
+	err = run([]string{"unknown"}, &bytes.Buffer{})
+	require.ErrorContains(t, err, "unknown command: unknown")
+	err = run([]string{"info"}, &bytes.Buffer{})
+	require.ErrorContains(t, err, "expect 1 arguments, got 0")
+
+	require.Equal(t, "formatted "+image+"\n", runOK(t, "format", image))
+	require.Equal(t, "0\n", runOK(t, "alloc", image, "4MiB"))
+	require.Equal(t, "4194304\n", runOK(t, "alloc", image, "4K"))
+	require.Equal(t, "5242880\n", runOK(t, "alloc", "-align", "1MiB", image, "4K"))
+	runOK(t, "free", image, "5242880", "4K")
+	runOK(t, "free", image, "0", "4MiB")
+
+	info := runOK(t, "info", image)
+	require.Contains(t, info, "total size:        1TiB\n")
+	require.Contains(t, info, "used size:         4KiB")
+	require.Contains(t, info, "free extents:      2\n")
+
+	dump := runOK(t, "dump", image)
+	require.Equal(t, []string{
+		"OFFSET           SIZE             STATUS",
+		"0                4194304          free",
+		"4194304          4096             allocated",
+		"4198400          1099507429376    free",
+	}, strings.Split(strings.TrimSpace(dump), "\n"))
+	dump = runOK(t, "dump", "-allocated", image)
+	require.Equal(t, []string{
+		"OFFSET           SIZE             STATUS",
+		"4194304          4096             allocated",
+	}, strings.Split(strings.TrimSpace(dump), "\n"))
+
+	runOK(t, "reserve", image, "0", "4K")
+	err = run([]string{"free", image, "0", "4K"}, &bytes.Buffer{})
+	require.ErrorContains(t, err, "range at 0 with size 4096 overlaps reserved ranges")
+	require.Contains(t, runOK(t, "info", image), "reserved size:     4KiB (")
+	dump = runOK(t, "dump", "-allocated", image)
+	require.Equal(t, []string{
+		"OFFSET           SIZE             STATUS",
+		"0                4096             reserved",
+		"4194304          4096             allocated",
+	}, strings.Split(strings.TrimSpace(dump), "\n"))
+	runOK(t, "unreserve", image, "0", "4K")
+
+	histogram := runOK(t, "histogram", image)
+	require.Equal(t, []string{
+		"MIN          MAX          COUNT        RATIO",
+		"4MiB         8188KiB      1            50.000000%",
+		"512GiB       1073741820KiB 1            50.000000%",
+	}, strings.Split(strings.TrimSpace(histogram), "\n"))
+
+	runOK(t, "markbad", image, "4194304", "512")
+	runOK(t, "markbad", image, "8K", "8K")
+	runOK(t, "free", image, "4194304", "4K")
+	require.Contains(t, runOK(t, "info", image), "bad size:          12KiB (")
+	bad := runOK(t, "bad", image)
+	require.Equal(t, []string{
+		"OFFSET           SIZE",
+		"8192             8192",
+		"4194304          4096",
+	}, strings.Split(strings.TrimSpace(bad), "\n"))
+	dump = runOK(t, "dump", "-allocated", image)
+	require.Equal(t, []string{
+		"OFFSET           SIZE             STATUS",
+		"8192             8192             bad",
+		"4194304          4096             bad",
+	}, strings.Split(strings.TrimSpace(dump), "\n"))
+}
+
+func TestFormatReserve(t *testing.T) {
+	image := path.Join(t.TempDir(), "image")
+	runOK(t, "format", "-reserve", "0:1MiB", "-reserve", "4MiB:8K", image)
+	require.Contains(t, runOK(t, "info", image), "reserved size:     1032KiB (")
+	dump := runOK(t, "dump", "-allocated", image)
+	require.Equal(t, []string{
+		"OFFSET           SIZE             STATUS",
+		"0                1048576          reserved",
+		"4194304          8192             reserved",
+	}, strings.Split(strings.TrimSpace(dump), "\n"))
+
+	err := run([]string{"format", "-reserve", "4096", image}, &bytes.Buffer{})
+	require.ErrorContains(t, err, "invalid range: 4096, expect <offset>:<size>")
+	err = run([]string{"format", "-reserve", "0:4X", image}, &bytes.Buffer{})
+	require.ErrorContains(t, err, "invalid size: 4X")
+}
+
+func TestFsck(t *testing.T) {
+	image := path.Join(t.TempDir(), "image")
+	runOK(t, "format", image)
+	require.Equal(t, image+": clean\n", runOK(t, "fsck", image))
+
+	f, err := os.OpenFile(image, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	out := &bytes.Buffer{}
+	err = run([]string{"fsck", "-json", image}, out)
+	require.ErrorContains(t, err, "image is inconsistent")
+	require.JSONEq(t, `{
+  "image_file_path": "`+image+`",
+  "findings": [{"kind": "size", "message": "image has 1 unexpected bytes after the bitmap", "repaired": false}]
+}`, out.String())
+
+	require.Contains(t, runOK(t, "fsck", "-repair", image), "(repaired)")
+	require.Equal(t, image+": clean\n", runOK(t, "fsck", image))
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"512":  512,
+		"512B": 512,
+		"4K":   4096,
+		"4KiB": 4096,
+		"1TiB": 1 << 40,
+	} {
+		got, err := parseSize(s)
+		require.NoError(t, err)
+		require.Equal(t, expected, got, s)
+	}
+	_, err := parseSize("4X")
+	require.ErrorContains(t, err, "invalid size: 4X")
+}
@@ -0,0 +1,46 @@
+package disk_management_demo
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// the mode flags of fallocate(2)
+const (
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
+)
+
+// PunchHoleDiscarder is a Discarder that punches holes in the backing data file
+// at the discarded ranges, so the file system releases their blocks and the
+// ranges read as zeros. The size of the file is not changed.
+type PunchHoleDiscarder struct {
+	f *os.File
+}
+
+// NewPunchHoleDiscarder opens the backing data file at dataFilePath.
+func NewPunchHoleDiscarder(dataFilePath string) (*PunchHoleDiscarder, error) {
+	f, err := os.OpenFile(dataFilePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &PunchHoleDiscarder{f: f}, nil
+}
+
+// Discard implements Discarder.Discard.
+func (p *PunchHoleDiscarder) Discard(ranges []Range) error {
+	for _, r := range ranges {
+		err := syscall.Fallocate(int(p.f.Fd()), fallocFlPunchHole|fallocFlKeepSize, r.Offset, r.Size)
+		if err != nil {
+			return errors.Wrapf(err, "failed to punch hole at %d with size %d", r.Offset, r.Size)
+		}
+	}
+	return nil
+}
+
+// Close closes the backing data file.
+func (p *PunchHoleDiscarder) Close() error {
+	return errors.WithStack(p.f.Close())
+}
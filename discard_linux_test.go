@@ -0,0 +1,29 @@
+package disk_management_demo
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPunchHoleDiscarder(t *testing.T) {
+	dataFile := path.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(dataFile, bytes.Repeat([]byte{1}, 4*unitSize), 0600))
+	p, err := NewPunchHoleDiscarder(dataFile)
+	require.NoError(t, err)
+	require.NoError(t, p.Discard([]Range{{Offset: unitSize, Size: unitSize}, {Offset: 3 * unitSize, Size: unitSize}}))
+	require.NoError(t, p.Close())
+
+	got, err := os.ReadFile(dataFile)
+	require.NoError(t, err)
+	expected := bytes.Repeat([]byte{1}, 4*unitSize)
+	copy(expected[unitSize:], make([]byte, unitSize))
+	copy(expected[3*unitSize:], make([]byte, unitSize))
+	require.Equal(t, expected, got)
+
+	_, err = NewPunchHoleDiscarder(path.Join(t.TempDir(), "not_exist"))
+	require.ErrorContains(t, err, "no such file or directory")
+}
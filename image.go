@@ -0,0 +1,264 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+// FormatImage creates an image file at imageFilePath where all the space is
+// free except the reserved ranges, see Manager.ReserveRange. It fails if the
+// file already exists.
+func FormatImage(imageFilePath string, reserved ...Range) error {
+	rs := newReservedRanges()
+	bitmap := make([]byte, bitmapSize)
+	for _, r := range reserved {
+		if err := checkReservedRange(r.Offset, r.Size); err != nil {
+			return err
+		}
+		offset, length := byteOffsetToUnitOffset(r.Offset), byteSizeToUnitCnt(r.Size)
+		if rs.overlaps(offset, length) {
+			return errors.Errorf("reserved range at %d with size %d overlaps other ranges", r.Offset, r.Size)
+		}
+		rs.add(offset, length)
+		allocInBitmap(bitmap, offset, length)
+	}
+
+	f, err := os.OpenFile(imageFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(rs.ranges) == 0 {
+		err = f.Truncate(bitmapSize)
+	} else {
+		t := &imageTrailer{
+			bitmapCRC: bitmapCRC(bitmap),
+			sections:  map[sectionKind][]byte{rs.kind: rs.encode()},
+		}
+		if _, err = f.Write(bitmap); err == nil {
+			_, err = f.Write(t.encode())
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+// readImage reads the bitmap of the image file into bitmap, and returns the
+// trailer after it, which is nil if not exists. Every writer updates the bitmap
+// and the trailer together, so a bitmap that mismatches the checksum in the
+// trailer is corrupt and rejected.
+func readImage(imageFilePath string, bitmap []byte) (*imageTrailer, error) {
+	f, err := os.OpenFile(imageFilePath, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if s := stat.Size(); s < bitmapSize {
+		return nil, errors.Errorf("file size is not expected: %d", s)
+	}
+
+	if _, err = io.ReadAtLeast(f, bitmap, bitmapSize); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	trailerData, err := io.ReadAll(f)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	trailer, err := decodeTrailer(trailerData)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid image trailer")
+	}
+	if trailer != nil && trailer.bitmapCRC != bitmapCRC(bitmap) {
+		return nil, errors.New("checksum of bitmap mismatches, the image may be corrupt")
+	}
+	return trailer, nil
+}
+
+// writeFileAtomically writes the concatenation of contents to a temporary file
+// in the same directory and renames it to path. The file is synced before the
+// rename and the directory after it, so path has either the old or the new
+// content after a crash. The temporary file is removed if it fails.
+func writeFileAtomically(path string, contents ...[]byte) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "bitmap")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	for _, content := range contents {
+		if _, err = f.Write(content); err != nil {
+			_ = f.Close()
+			return errors.WithStack(err)
+		}
+	}
+	// the content should be durable before it replaces the old file
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.WithStack(err)
+	}
+	if err = f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return errors.WithStack(err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory to persist the entries renamed into it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = d.Sync()
+	if err2 := d.Close(); err == nil {
+		err = err2
+	}
+	return errors.WithStack(err)
+}
+
+// An image file is the bitmap followed by an optional trailer, which holds the
+// metadata other than the allocation status of units. The image created by
+// FormatImage has no trailer. The layout of the trailer is, all integers are
+// little-endian:
+//
+//	magic      [4]byte, "DMTR"
+//	version    uint32
+//	generation uint64, increased by every checkpoint
+//	bitmapCRC  uint32, CRC-32C of the bitmap
+//	sectionCnt uint32
+//	sections   sectionCnt * {kind uint32, length uint32, crc uint32, payload [length]byte}
+const (
+	trailerMagic      = "DMTR"
+	trailerVersion    = 1
+	trailerHeaderSize = 4 + 4 + 8 + 4 + 4
+	sectionHeaderSize = 4 + 4 + 4
+)
+
+type sectionKind uint32
+
+const (
+	// sectionFreeSpaces is the snapshot of freeSpaces, see freeSpaces.snapshot.
+	sectionFreeSpaces sectionKind = 1
+	// sectionSlabs is the allocated sectors of slabs, see slabs.encode.
+	sectionSlabs sectionKind = 2
+	// sectionReserved is the reserved ranges, see unitRanges.encode.
+	sectionReserved sectionKind = 3
+	// sectionBad is the ranges of bad units, see unitRanges.encode.
+	sectionBad sectionKind = 4
+	// sectionNamespaces is the namespaces and their allocations, see
+	// namespaces.encode.
+	sectionNamespaces sectionKind = 5
+	// sectionRefCounts is the reference counts of the shared units, see
+	// refCounts.encode.
+	sectionRefCounts sectionKind = 6
+	// sectionSnapshotInfo is the ID and the creation time of a snapshot file,
+	// see encodeSnapshotInfo.
+	sectionSnapshotInfo sectionKind = 7
+	// sectionSnapshotSeq is the largest snapshot ID ever assigned, see
+	// encodeSnapshotSeq.
+	sectionSnapshotSeq sectionKind = 8
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func bitmapCRC(bitmap []byte) uint32 {
+	return crc32.Checksum(bitmap, castagnoli)
+}
+
+// errNoTrailer means the bytes after the bitmap are not a trailer.
+var errNoTrailer = errors.New("no trailer after the bitmap")
+
+type imageTrailer struct {
+	generation uint64
+	bitmapCRC  uint32
+	sections   map[sectionKind][]byte
+}
+
+// decodeTrailer decodes the bytes after the bitmap. It returns nil if there's
+// no byte after the bitmap, and errNoTrailer if the bytes are not started with
+// a trailer header.
+func decodeTrailer(data []byte) (*imageTrailer, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) < trailerHeaderSize || string(data[:4]) != trailerMagic {
+		return nil, errNoTrailer
+	}
+	if v := binary.LittleEndian.Uint32(data[4:]); v != trailerVersion {
+		return nil, errors.Errorf("unsupported trailer version: %d", v)
+	}
+	t := &imageTrailer{
+		generation: binary.LittleEndian.Uint64(data[8:]),
+		bitmapCRC:  binary.LittleEndian.Uint32(data[16:]),
+		sections:   map[sectionKind][]byte{},
+	}
+	sectionCnt := binary.LittleEndian.Uint32(data[20:])
+	data = data[trailerHeaderSize:]
+	for i := uint32(0); i < sectionCnt; i++ {
+		if len(data) < sectionHeaderSize {
+			return nil, errors.Errorf("section %d is truncated", i)
+		}
+		kind := sectionKind(binary.LittleEndian.Uint32(data))
+		length := binary.LittleEndian.Uint32(data[4:])
+		crc := binary.LittleEndian.Uint32(data[8:])
+		data = data[sectionHeaderSize:]
+		if uint64(len(data)) < uint64(length) {
+			return nil, errors.Errorf("section %d is truncated", i)
+		}
+		payload := data[:length]
+		if crc32.Checksum(payload, castagnoli) != crc {
+			return nil, errors.Errorf("checksum of section %d mismatches", i)
+		}
+		if _, ok := t.sections[kind]; ok {
+			return nil, errors.Errorf("section kind %d is duplicated", kind)
+		}
+		t.sections[kind] = payload
+		data = data[length:]
+	}
+	if len(data) > 0 {
+		return nil, errors.Errorf("trailer has %d unexpected bytes at the end", len(data))
+	}
+	return t, nil
+}
+
+func (t *imageTrailer) encode() []byte {
+	kinds := make([]sectionKind, 0, len(t.sections))
+	size := trailerHeaderSize
+	for kind, payload := range t.sections {
+		kinds = append(kinds, kind)
+		size += sectionHeaderSize + len(payload)
+	}
+	slices.Sort(kinds)
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, trailerMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, trailerVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, t.generation)
+	buf = binary.LittleEndian.AppendUint32(buf, t.bitmapCRC)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(kinds)))
+	for _, kind := range kinds {
+		payload := t.sections[kind]
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(kind))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+		buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(payload, castagnoli))
+		buf = append(buf, payload...)
+	}
+	return buf
+}
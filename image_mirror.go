@@ -0,0 +1,60 @@
+package disk_management_demo
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// mirrorCopy is the content of a copy of a mirrored image file.
+type mirrorCopy struct {
+	content []byte
+	// generation is 0 for the image without trailer.
+	generation uint64
+	// err is the reason why the copy is not valid.
+	err error
+}
+
+// readMirrorCopy reads the image file and checks that it's complete, its trailer
+// is valid and the bitmap matches the checksum in the trailer.
+func readMirrorCopy(imageFilePath string) mirrorCopy {
+	content, err := os.ReadFile(imageFilePath)
+	if err != nil {
+		return mirrorCopy{err: errors.WithStack(err)}
+	}
+	if len(content) < bitmapSize {
+		return mirrorCopy{err: errors.Errorf("file size is not expected: %d", len(content))}
+	}
+	trailer, err := decodeTrailer(content[bitmapSize:])
+	if err != nil {
+		return mirrorCopy{err: errors.Wrap(err, "invalid image trailer")}
+	}
+	if trailer == nil {
+		return mirrorCopy{content: content}
+	}
+	if trailer.bitmapCRC != bitmapCRC(content[:bitmapSize]) {
+		return mirrorCopy{err: errors.New("checksum of bitmap mismatches")}
+	}
+	return mirrorCopy{content: content, generation: trailer.generation}
+}
+
+// resyncMirror makes the image file and its mirror the same, using the valid
+// copy of the newest generation. The image file is preferred if both are valid
+// in the same generation but diverge. It returns the path that is rewritten, or
+// an empty string if they are already the same. Nothing is changed if neither
+// copy is valid, so opening the image file reports the problem.
+func resyncMirror(imageFilePath, mirrorFilePath string) (string, error) {
+	primary, mirror := readMirrorCopy(imageFilePath), readMirrorCopy(mirrorFilePath)
+	switch {
+	case primary.err != nil && mirror.err != nil:
+		return "", nil
+	case mirror.err != nil || (primary.err == nil && primary.generation >= mirror.generation):
+		if mirror.err == nil && bytes.Equal(primary.content, mirror.content) {
+			return "", nil
+		}
+		return mirrorFilePath, writeFileAtomically(mirrorFilePath, primary.content)
+	default:
+		return imageFilePath, writeFileAtomically(imageFilePath, mirror.content)
+	}
+}
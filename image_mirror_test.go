@@ -0,0 +1,74 @@
+package disk_management_demo
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResyncMirror(t *testing.T) {
+	imageFile := createFileWithContent(t, nil)
+	mirrorFile := path.Join(t.TempDir(), "mirror")
+
+	// both copies are invalid
+	require.NoError(t, os.WriteFile(imageFile, []byte("broken"), 0600))
+	rewritten, err := resyncMirror(imageFile, mirrorFile)
+	require.NoError(t, err)
+	require.Empty(t, rewritten)
+
+	// the missing mirror is created
+	require.NoError(t, os.Remove(imageFile))
+	require.NoError(t, FormatImage(imageFile))
+	rewritten, err = resyncMirror(imageFile, mirrorFile)
+	require.NoError(t, err)
+	require.Equal(t, mirrorFile, rewritten)
+	rewritten, err = resyncMirror(imageFile, mirrorFile)
+	require.NoError(t, err)
+	require.Empty(t, rewritten)
+
+	m, err := newDiskManagerImpl(imageFile)
+	require.NoError(t, err)
+	_, err = m.Alloc(unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	gen1, err := os.ReadFile(imageFile)
+	require.NoError(t, err)
+
+	// the stale mirror is updated
+	rewritten, err = resyncMirror(imageFile, mirrorFile)
+	require.NoError(t, err)
+	require.Equal(t, mirrorFile, rewritten)
+	got, err := os.ReadFile(mirrorFile)
+	require.NoError(t, err)
+	require.Equal(t, gen1, got)
+
+	// the corrupt image file is restored from the mirror
+	corrupt := append([]byte(nil), gen1...)
+	corrupt[100] = 0xFF
+	require.NoError(t, os.WriteFile(imageFile, corrupt, 0600))
+	rewritten, err = resyncMirror(imageFile, mirrorFile)
+	require.NoError(t, err)
+	require.Equal(t, imageFile, rewritten)
+	got, err = os.ReadFile(imageFile)
+	require.NoError(t, err)
+	require.Equal(t, gen1, got)
+
+	// the diverged mirror of the same generation is overwritten
+	m, err = newDiskManagerImpl(imageFile)
+	require.NoError(t, err)
+	_, err = m.Alloc(unitSize)
+	require.NoError(t, err)
+	m.imageFilePath = mirrorFile
+	require.NoError(t, m.Close())
+	m, err = newDiskManagerImpl(imageFile)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	rewritten, err = resyncMirror(imageFile, mirrorFile)
+	require.NoError(t, err)
+	require.Equal(t, mirrorFile, rewritten)
+	m, err = newDiskManagerImpl(mirrorFile)
+	require.NoError(t, err)
+	require.EqualValues(t, unitSize, m.Stats().UsedSize)
+}
@@ -0,0 +1,92 @@
+package disk_management_demo
+
+import (
+	"os"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatImage(t *testing.T) {
+	imageFilePath := path.Join(t.TempDir(), "image")
+	require.NoError(t, FormatImage(imageFilePath))
+	err := FormatImage(imageFilePath)
+	require.ErrorIs(t, err, os.ErrExist)
+
+	m, err := NewDiskManager(imageFilePath)
+	require.NoError(t, err)
+	stats := m.Stats()
+	require.EqualValues(t, 0, stats.UsedSize)
+	require.EqualValues(t, spaceTotalSize, stats.LargestFreeSize)
+	require.NoError(t, m.Close())
+
+	imageFilePath = path.Join(t.TempDir(), "image")
+	err = FormatImage(imageFilePath, Range{Offset: 0, Size: 512})
+	require.ErrorContains(t, err, "reserved range should be aligned to 4KiB, got: 0, 512")
+	err = FormatImage(imageFilePath, Range{Offset: 0, Size: 2 * unitSize}, Range{Offset: unitSize, Size: unitSize})
+	require.ErrorContains(t, err, "reserved range at 4096 with size 4096 overlaps other ranges")
+	require.NoError(t, FormatImage(imageFilePath,
+		Range{Offset: 0, Size: unitSize},
+		Range{Offset: spaceTotalSize - allocLimit, Size: allocLimit},
+	))
+	m, err = NewDiskManager(imageFilePath)
+	require.NoError(t, err)
+	stats = m.Stats()
+	require.EqualValues(t, 0, stats.UsedSize)
+	require.EqualValues(t, unitSize+allocLimit, stats.ReservedSize)
+	require.EqualValues(t, spaceTotalSize-unitSize-allocLimit, stats.FreeSize)
+	require.NoError(t, m.Close())
+}
+
+func TestImageTrailer(t *testing.T) {
+	trailer, err := decodeTrailer(nil)
+	require.NoError(t, err)
+	require.Nil(t, trailer)
+	_, err = decodeTrailer([]byte{1, 2, 3})
+	require.ErrorIs(t, err, errNoTrailer)
+
+	trailer = &imageTrailer{
+		generation: 7,
+		bitmapCRC:  0x12345678,
+		sections: map[sectionKind][]byte{
+			sectionFreeSpaces: []byte("payload"),
+			100:               {},
+		},
+	}
+	data := trailer.encode()
+	got, err := decodeTrailer(data)
+	require.NoError(t, err)
+	require.Equal(t, trailer, got)
+
+	broken := slices.Clone(data)
+	broken[len(broken)-1]++
+	_, err = decodeTrailer(broken)
+	require.ErrorContains(t, err, "checksum of section 1 mismatches")
+	_, err = decodeTrailer(data[:len(data)-1])
+	require.ErrorContains(t, err, "section 1 is truncated")
+	_, err = decodeTrailer(append(slices.Clone(data), 0))
+	require.ErrorContains(t, err, "trailer has 1 unexpected bytes at the end")
+	broken = slices.Clone(data)
+	broken[4] = 2
+	_, err = decodeTrailer(broken)
+	require.ErrorContains(t, err, "unsupported trailer version: 2")
+}
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	target := path.Join(dir, "image")
+	require.NoError(t, writeFileAtomically(target, []byte("ab"), []byte("c")))
+	content, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, []byte("abc"), content)
+
+	// the temporary file is removed when the rename fails
+	require.NoError(t, os.Mkdir(path.Join(dir, "sub"), 0700))
+	require.NoError(t, os.WriteFile(path.Join(dir, "sub", "f"), nil, 0600))
+	require.Error(t, writeFileAtomically(path.Join(dir, "sub"), []byte("x")))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
@@ -0,0 +1,217 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// bitmapSummary is a two-level summary of a bitmap to skip the fully allocated
+// or fully free regions in large strides when searching continuous bits.
+//
+// The bitmap is viewed as 64-bit words. Every bit of level1 summarizes a word
+// of the bitmap, which is 64 units, and every bit of level2 summarizes a word of
+// level1, which is 4096 units. The bitmap length must be a multiple of 8 bytes.
+//
+// A nil *bitmapSummary is valid, which searches the bitmap word by word without
+// skipping.
+type bitmapSummary struct {
+	// full1 has a bit set when the word of bitmap is all ones.
+	full1 []uint64
+	// empty1 has a bit set when the word of bitmap is all zeros.
+	empty1 []uint64
+	// full2 has a bit set when the word of full1 is all ones.
+	full2 []uint64
+	// empty2 has a bit set when the word of empty1 is all ones.
+	empty2 []uint64
+}
+
+func newBitmapSummary(bitmap []byte) *bitmapSummary {
+	wordCnt := len(bitmap) / 8
+	level1Cnt := (wordCnt + 63) / 64
+	level2Cnt := (level1Cnt + 63) / 64
+	s := &bitmapSummary{
+		full1:  make([]uint64, level1Cnt),
+		empty1: make([]uint64, level1Cnt),
+		full2:  make([]uint64, level2Cnt),
+		empty2: make([]uint64, level2Cnt),
+	}
+	s.updateWords(bitmap, 0, wordCnt-1)
+	return s
+}
+
+func getWord(bitmap []byte, idx int) uint64 {
+	return binary.LittleEndian.Uint64(bitmap[idx*8:])
+}
+
+func setBit(words []uint64, idx int, set bool) {
+	if set {
+		words[idx/64] |= 1 << (idx % 64)
+	} else {
+		words[idx/64] &^= 1 << (idx % 64)
+	}
+}
+
+// update refreshes the summary after the bits of [offset, offset+length) are
+// changed in the bitmap.
+func (s *bitmapSummary) update(bitmap []byte, offset, length unit) {
+	if s == nil || length == 0 {
+		return
+	}
+	s.updateWords(bitmap, int(offset/64), int((offset+length-1)/64))
+}
+
+// updateWords refreshes the summary of the words in [first, last] of bitmap.
+func (s *bitmapSummary) updateWords(bitmap []byte, first, last int) {
+	for i := first; i <= last; i++ {
+		w := getWord(bitmap, i)
+		setBit(s.full1, i, w == ^uint64(0))
+		setBit(s.empty1, i, w == 0)
+	}
+	for i := first / 64; i <= last/64; i++ {
+		setBit(s.full2, i, s.full1[i] == ^uint64(0))
+		setBit(s.empty2, i, s.empty1[i] == ^uint64(0))
+	}
+}
+
+// nextUnset returns the index of the first unset bit of level1 that is not less
+// than idx. level2 is used to skip the words of level1 that are all ones. It
+// returns a value not less than the number of bits of level1 if not found.
+func nextUnset(level1, level2 []uint64, idx int) int {
+	if idx >= len(level1)*64 {
+		return idx
+	}
+	wordIdx := idx / 64
+	if w := ^level1[wordIdx] >> (idx % 64); w != 0 {
+		return idx + bits.TrailingZeros64(w)
+	}
+	// find the next word of level1 that is not all ones, which is the next unset
+	// bit of level2
+	for wordIdx++; wordIdx < len(level1); {
+		w := ^level2[wordIdx/64] >> (wordIdx % 64)
+		if w == 0 {
+			wordIdx = (wordIdx/64 + 1) * 64
+			continue
+		}
+		wordIdx += bits.TrailingZeros64(w)
+		if wordIdx >= len(level1) {
+			break
+		}
+		return wordIdx*64 + bits.TrailingZeros64(^level1[wordIdx])
+	}
+	return len(level1) * 64
+}
+
+// prevUnset returns the index of the last unset bit of level1 that is not
+// larger than idx. level2 is used to skip the words of level1 that are all
+// ones. It returns -1 if not found.
+func prevUnset(level1, level2 []uint64, idx int) int {
+	if idx < 0 {
+		return -1
+	}
+	wordIdx := idx / 64
+	if w := ^level1[wordIdx] << (63 - idx%64); w != 0 {
+		return idx - bits.LeadingZeros64(w)
+	}
+	for wordIdx--; wordIdx >= 0; {
+		w := ^level2[wordIdx/64] << (63 - wordIdx%64)
+		if w == 0 {
+			wordIdx = wordIdx/64*64 - 1
+			continue
+		}
+		wordIdx -= bits.LeadingZeros64(w)
+		return wordIdx*64 + 63 - bits.LeadingZeros64(^level1[wordIdx])
+	}
+	return -1
+}
+
+// uniformLevels returns the summary levels that mark the words whose bits are
+// all one if one is true, or all zero otherwise.
+func (s *bitmapSummary) uniformLevels(one bool) ([]uint64, []uint64) {
+	if one {
+		return s.full1, s.full2
+	}
+	return s.empty1, s.empty2
+}
+
+// findLeadingBitsCnt returns the number of continuous bits starting from
+// startOffset that are one if one is true, or zero otherwise.
+func (s *bitmapSummary) findLeadingBitsCnt(bitmap []byte, startOffset unit, one bool) unit {
+	wordCnt := len(bitmap) / 8
+	if int(startOffset) == wordCnt*64 {
+		return 0
+	}
+	if int(startOffset) > wordCnt*64 {
+		panic("unexpected startOffset")
+	}
+
+	var flip uint64
+	if one {
+		flip = ^uint64(0)
+	}
+	// after flipping, the first set bit is where the continuous bits end
+	wordIdx := int(startOffset / 64)
+	w := (getWord(bitmap, wordIdx) ^ flip) >> (startOffset % 64)
+	if w != 0 {
+		return unit(bits.TrailingZeros64(w))
+	}
+	ret := 64 - startOffset%64
+
+	for wordIdx++; wordIdx < wordCnt; wordIdx++ {
+		if s != nil {
+			level1, level2 := s.uniformLevels(one)
+			next := min(nextUnset(level1, level2, wordIdx), wordCnt)
+			ret += unit(next-wordIdx) * 64
+			wordIdx = next
+			if wordIdx == wordCnt {
+				break
+			}
+		}
+		w = getWord(bitmap, wordIdx) ^ flip
+		if w != 0 {
+			return ret + unit(bits.TrailingZeros64(w))
+		}
+		ret += 64
+	}
+	return ret
+}
+
+// findTrailingBitsCnt returns the number of continuous bits ending at
+// endOffset (exclusive) that are one if one is true, or zero otherwise.
+func (s *bitmapSummary) findTrailingBitsCnt(bitmap []byte, endOffset unit, one bool) unit {
+	wordCnt := len(bitmap) / 8
+	if endOffset == 0 {
+		return 0
+	}
+	if int(endOffset) > wordCnt*64 {
+		panic("unexpected endOffset")
+	}
+
+	var flip uint64
+	if one {
+		flip = ^uint64(0)
+	}
+	wordIdx := int((endOffset - 1) / 64)
+	w := (getWord(bitmap, wordIdx) ^ flip) << (63 - (endOffset-1)%64)
+	if w != 0 {
+		return unit(bits.LeadingZeros64(w))
+	}
+	ret := (endOffset-1)%64 + 1
+
+	for wordIdx--; wordIdx >= 0; wordIdx-- {
+		if s != nil {
+			level1, level2 := s.uniformLevels(one)
+			prev := prevUnset(level1, level2, wordIdx)
+			ret += unit(wordIdx-prev) * 64
+			wordIdx = prev
+			if wordIdx < 0 {
+				break
+			}
+		}
+		w = getWord(bitmap, wordIdx) ^ flip
+		if w != 0 {
+			return ret + unit(bits.LeadingZeros64(w))
+		}
+		ret += 64
+	}
+	return ret
+}
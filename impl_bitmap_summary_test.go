@@ -0,0 +1,87 @@
+package disk_management_demo
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// randomRunsBitmap returns a bitmap of wordCnt words that consists of random
+// length runs of zeros and ones, some of them are long enough to be skipped.
+func randomRunsBitmap(rnd *rand.Rand, wordCnt int) []byte {
+	bitmap := make([]byte, wordCnt*8)
+	total := unit(wordCnt * 64)
+	one := false
+	for offset := unit(0); offset < total; {
+		var length unit
+		if rnd.Intn(2) == 0 {
+			length = unit(rnd.Intn(100) + 1)
+		} else {
+			length = unit(rnd.Intn(20000) + 1)
+		}
+		length = min(length, total-offset)
+		if one {
+			allocInBitmap(bitmap, offset, length)
+		}
+		one = !one
+		offset += length
+	}
+	return bitmap
+}
+
+func checkSummaryFind(t *testing.T, rnd *rand.Rand, bitmap []byte, s *bitmapSummary) {
+	total := unit(len(bitmap) * 8)
+	for i := 0; i < 1000; i++ {
+		offset := unit(rnd.Intn(int(total) + 1))
+		for _, one := range []bool{true, false} {
+			require.Equal(t,
+				(*bitmapSummary)(nil).findLeadingBitsCnt(bitmap, offset, one),
+				s.findLeadingBitsCnt(bitmap, offset, one),
+				"offset %d, one %v", offset, one)
+			require.Equal(t,
+				(*bitmapSummary)(nil).findTrailingBitsCnt(bitmap, offset, one),
+				s.findTrailingBitsCnt(bitmap, offset, one),
+				"offset %d, one %v", offset, one)
+		}
+	}
+}
+
+func TestBitmapSummary(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	// not a multiple of 64 words to test the padding bits
+	for _, wordCnt := range []int{1, 100, 64 * 64 * 3, 64*64*3 + 5} {
+		bitmap := randomRunsBitmap(rnd, wordCnt)
+		s := newBitmapSummary(bitmap)
+		checkSummaryFind(t, rnd, bitmap, s)
+
+		total := unit(wordCnt * 64)
+		for i := 0; i < 100; i++ {
+			offset := unit(rnd.Intn(int(total)))
+			length := min(unit(rnd.Intn(10000)+1), total-offset)
+			if rnd.Intn(2) == 0 {
+				allocInBitmap(bitmap, offset, length)
+			} else {
+				freeInBitmap(bitmap, offset, length)
+			}
+			s.update(bitmap, offset, length)
+		}
+		require.Equal(t, newBitmapSummary(bitmap), s)
+		checkSummaryFind(t, rnd, bitmap, s)
+	}
+
+	bitmap := make([]byte, 64*64*8*2)
+	s := newBitmapSummary(bitmap)
+	require.EqualValues(t, 64*64*64*2, s.findLeadingBitsCnt(bitmap, 0, false))
+	require.EqualValues(t, 0, s.findLeadingBitsCnt(bitmap, 0, true))
+	require.EqualValues(t, 64*64*64*2-3, s.findTrailingBitsCnt(bitmap, 64*64*64*2-3, false))
+	allocInBitmap(bitmap, 64*64*64+1, 1)
+	s.update(bitmap, 64*64*64+1, 1)
+	require.EqualValues(t, 64*64*64+1, s.findLeadingBitsCnt(bitmap, 0, false))
+	require.EqualValues(t, 64*64*64-2, s.findTrailingBitsCnt(bitmap, 64*64*64*2, false))
+	require.EqualValues(t, 1, s.findLeadingBitsCnt(bitmap, 64*64*64+1, true))
+}
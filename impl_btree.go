@@ -0,0 +1,296 @@
+package disk_management_demo
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+)
+
+const (
+	btreeDegree   = 32
+	btreeMaxItems = 2*btreeDegree - 1
+	btreeMinItems = btreeDegree - 1
+)
+
+// btreeItem is an item of btree, which is ordered by its key.
+type btreeItem[K cmp.Ordered] interface {
+	key() K
+}
+
+// btree is a B-tree of the items with distinct keys. It finds an item, or the
+// items from a key, in O(log n).
+type btree[K cmp.Ordered, T btreeItem[K]] struct {
+	root   *btreeNode[K, T]
+	length int
+}
+
+type btreeNode[K cmp.Ordered, T btreeItem[K]] struct {
+	items    []T
+	children []*btreeNode[K, T]
+}
+
+func newBTree[K cmp.Ordered, T btreeItem[K]]() *btree[K, T] {
+	return &btree[K, T]{root: &btreeNode[K, T]{}}
+}
+
+// extentItem is a continuous free units recorded in extentIndex.
+type extentItem struct {
+	offset unit
+	length unit
+	// pos is the position of the free units inside its bucket, so the bucket
+	// can delete it without searching.
+	pos int
+}
+
+func (e extentItem) key() unit { return e.offset }
+
+// extentIndex indexes the continuous free units in varLengthBucket by their
+// offset. It's used to find the position of a free space in its bucket in
+// O(log n).
+type extentIndex = btree[unit, extentItem]
+
+func newExtentIndex() *extentIndex {
+	return newBTree[unit, extentItem]()
+}
+
+// find returns the index of the first item whose key is not less than k, and
+// whether the key of that item equals to k.
+func (n *btreeNode[K, T]) find(k K) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return n.items[i].key() >= k
+	})
+	return i, i < len(n.items) && n.items[i].key() == k
+}
+
+// get returns the item whose key equals to k. The returned pointer is only
+// valid before the next insert or delete.
+func (t *btree[K, T]) get(k K) (*T, bool) {
+	n := t.root
+	for {
+		i, found := n.find(k)
+		if found {
+			return &n.items[i], true
+		}
+		if len(n.children) == 0 {
+			return nil, false
+		}
+		n = n.children[i]
+	}
+}
+
+// floor returns the item with the largest key that is not larger than k.
+func (t *btree[K, T]) floor(k K) (T, bool) {
+	var (
+		ret T
+		ok  bool
+	)
+	n := t.root
+	for {
+		i, found := n.find(k)
+		if found {
+			return n.items[i], true
+		}
+		if i > 0 {
+			ret, ok = n.items[i-1], true
+		}
+		if len(n.children) == 0 {
+			return ret, ok
+		}
+		n = n.children[i]
+	}
+}
+
+// insert adds the item. The key of item should not exist in the tree.
+func (t *btree[K, T]) insert(item T) {
+	// fast path for appending the largest key, which is the case of
+	// freeSpaces.loadFromBitmap
+	last := t.root
+	for len(last.children) > 0 {
+		last = last.children[len(last.children)-1]
+	}
+	l := len(last.items)
+	if l < btreeMaxItems && (l == 0 || last.items[l-1].key() < item.key()) {
+		last.items = append(last.items, item)
+		t.length++
+		return
+	}
+
+	if len(t.root.items) >= btreeMaxItems {
+		mid, second := t.root.split(btreeMaxItems / 2)
+		t.root = &btreeNode[K, T]{
+			items:    []T{mid},
+			children: []*btreeNode[K, T]{t.root, second},
+		}
+	}
+	t.root.insert(item)
+	t.length++
+}
+
+// split splits the node at the i-th item. The i-th item is returned and the
+// items after it are moved to the returned new node.
+func (n *btreeNode[K, T]) split(i int) (T, *btreeNode[K, T]) {
+	item := n.items[i]
+	next := &btreeNode[K, T]{}
+	next.items = append(next.items, n.items[i+1:]...)
+	clear(n.items[i:])
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		clear(n.children[i+1:])
+		n.children = n.children[:i+1]
+	}
+	return item, next
+}
+
+func (n *btreeNode[K, T]) insert(item T) {
+	for {
+		i, found := n.find(item.key())
+		if found {
+			panic("key already exists in btree")
+		}
+		if len(n.children) == 0 {
+			n.items = slices.Insert(n.items, i, item)
+			return
+		}
+		if len(n.children[i].items) >= btreeMaxItems {
+			mid, second := n.children[i].split(btreeMaxItems / 2)
+			n.items = slices.Insert(n.items, i, mid)
+			n.children = slices.Insert(n.children, i+1, second)
+			if item.key() > mid.key() {
+				i++
+			}
+		}
+		n = n.children[i]
+	}
+}
+
+// delete removes the item whose key equals to k. The key should exist in the
+// tree.
+func (t *btree[K, T]) delete(k K) {
+	t.root.remove(k, false)
+	if len(t.root.items) == 0 && len(t.root.children) > 0 {
+		t.root = t.root.children[0]
+	}
+	t.length--
+}
+
+// remove removes the item whose key equals to k from the subtree. When
+// removeMax is true, it removes the item with the largest key instead. The
+// removed item is returned.
+func (n *btreeNode[K, T]) remove(k K, removeMax bool) T {
+	var (
+		i     int
+		found bool
+		zero  T
+	)
+	if removeMax {
+		if len(n.children) == 0 {
+			item := n.items[len(n.items)-1]
+			n.items[len(n.items)-1] = zero
+			n.items = n.items[:len(n.items)-1]
+			return item
+		}
+		i = len(n.items)
+	} else {
+		i, found = n.find(k)
+		if len(n.children) == 0 {
+			if !found {
+				panic("key not found in btree")
+			}
+			item := n.items[i]
+			n.items = slices.Delete(n.items, i, i+1)
+			return item
+		}
+	}
+
+	if len(n.children[i].items) <= btreeMinItems {
+		n.growChild(i)
+		return n.remove(k, removeMax)
+	}
+
+	child := n.children[i]
+	if found {
+		// replace the item with its predecessor, which is the largest item of
+		// the left child
+		item := n.items[i]
+		n.items[i] = child.remove(k, true)
+		return item
+	}
+	return child.remove(k, removeMax)
+}
+
+// growChild makes the i-th child have more than btreeMinItems items, by
+// stealing an item from its siblings or merging it with a sibling.
+func (n *btreeNode[K, T]) growChild(i int) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > btreeMinItems:
+		child, left := n.children[i], n.children[i-1]
+		stolen := left.items[len(left.items)-1]
+		left.items = left.items[:len(left.items)-1]
+		child.items = slices.Insert(child.items, 0, n.items[i-1])
+		n.items[i-1] = stolen
+		if len(left.children) > 0 {
+			grandChild := left.children[len(left.children)-1]
+			left.children[len(left.children)-1] = nil
+			left.children = left.children[:len(left.children)-1]
+			child.children = slices.Insert(child.children, 0, grandChild)
+		}
+	case i < len(n.items) && len(n.children[i+1].items) > btreeMinItems:
+		child, right := n.children[i], n.children[i+1]
+		stolen := right.items[0]
+		right.items = slices.Delete(right.items, 0, 1)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		if len(right.children) > 0 {
+			child.children = append(child.children, right.children[0])
+			right.children = slices.Delete(right.children, 0, 1)
+		}
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child, right := n.children[i], n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+		n.items = slices.Delete(n.items, i, i+1)
+		n.children = slices.Delete(n.children, i+1, i+2)
+	}
+}
+
+// ascend calls fn for every item in the ascending order of key.
+func (t *btree[K, T]) ascend(fn func(item T)) {
+	t.root.ascendFrom(nil, func(item T) bool {
+		fn(item)
+		return true
+	})
+}
+
+// ascendFrom calls fn for the items whose key is not less than k in the
+// ascending order of key, until fn returns false.
+func (t *btree[K, T]) ascendFrom(k K, fn func(item T) bool) {
+	t.root.ascendFrom(&k, fn)
+}
+
+// ascendFrom visits the subtree like btree.ascendFrom, and all items when from
+// is nil. It returns false when fn stops the visiting.
+func (n *btreeNode[K, T]) ascendFrom(from *K, fn func(item T) bool) bool {
+	i := 0
+	if from != nil {
+		i, _ = n.find(*from)
+	}
+	for ; i < len(n.items); i++ {
+		if len(n.children) > 0 && !n.children[i].ascendFrom(from, fn) {
+			return false
+		}
+		// only the leftmost visited subtree is bounded by from
+		from = nil
+		if !fn(n.items[i]) {
+			return false
+		}
+	}
+	if len(n.children) > 0 {
+		return n.children[len(n.children)-1].ascendFrom(from, fn)
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package disk_management_demo
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func checkExtentIndex(t *testing.T, idx *extentIndex, expected map[unit]unit) {
+	keys := make([]unit, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var got []unit
+	idx.ascend(func(item extentItem) {
+		got = append(got, item.offset)
+		require.Equal(t, expected[item.offset], item.length)
+	})
+	if len(keys) == 0 {
+		require.Empty(t, got)
+	} else {
+		require.Equal(t, keys, got)
+	}
+	require.Equal(t, len(expected), idx.length)
+}
+
+func TestExtentIndex(t *testing.T) {
+	idx := newExtentIndex()
+	_, ok := idx.get(1)
+	require.False(t, ok)
+	_, ok = idx.floor(1)
+	require.False(t, ok)
+
+	idx.insert(extentItem{offset: 10, length: 2})
+	idx.insert(extentItem{offset: 20, length: 3, pos: 1})
+	item, ok := idx.get(20)
+	require.True(t, ok)
+	require.Equal(t, extentItem{offset: 20, length: 3, pos: 1}, *item)
+	item.pos = 5
+	item, ok = idx.get(20)
+	require.True(t, ok)
+	require.Equal(t, 5, item.pos)
+
+	floor, ok := idx.floor(19)
+	require.True(t, ok)
+	require.EqualValues(t, 10, floor.offset)
+	floor, ok = idx.floor(20)
+	require.True(t, ok)
+	require.EqualValues(t, 20, floor.offset)
+	_, ok = idx.floor(9)
+	require.False(t, ok)
+
+	require.Panics(t, func() {
+		idx.insert(extentItem{offset: 10})
+	})
+	var got []unit
+	idx.ascendFrom(11, func(item extentItem) bool {
+		got = append(got, item.offset)
+		return true
+	})
+	require.Equal(t, []unit{20}, got)
+	idx.delete(10)
+	checkExtentIndex(t, idx, map[unit]unit{20: 3})
+}
+
+func TestExtentIndexRandom(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	idx := newExtentIndex()
+	expected := map[unit]unit{}
+	for i := 0; i < 100000; i++ {
+		offset := unit(rnd.Intn(50000))
+		if _, ok := expected[offset]; ok {
+			idx.delete(offset)
+			delete(expected, offset)
+		} else {
+			length := unit(rnd.Intn(100) + 1)
+			idx.insert(extentItem{offset: offset, length: length})
+			expected[offset] = length
+		}
+
+		probe := unit(rnd.Intn(50000))
+		floor, ok := idx.floor(probe)
+		expectedFloor := -1
+		for o := int(probe); o >= 0; o-- {
+			if _, ok2 := expected[unit(o)]; ok2 {
+				expectedFloor = o
+				break
+			}
+		}
+		if expectedFloor == -1 {
+			require.False(t, ok)
+		} else {
+			require.True(t, ok)
+			require.EqualValues(t, expectedFloor, floor.offset)
+		}
+
+		var got, expectedNext []unit
+		idx.ascendFrom(probe, func(item extentItem) bool {
+			got = append(got, item.offset)
+			return len(got) < 3
+		})
+		for o := probe; o < 50000 && len(expectedNext) < 3; o++ {
+			if _, ok2 := expected[o]; ok2 {
+				expectedNext = append(expectedNext, o)
+			}
+		}
+		require.Equal(t, expectedNext, got)
+	}
+	checkExtentIndex(t, idx, expected)
+
+	for offset := range expected {
+		idx.delete(offset)
+		delete(expected, offset)
+	}
+	checkExtentIndex(t, idx, expected)
+}
@@ -0,0 +1,597 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// buddyLeafOrder is the order of a leaf of buddyTree, which covers a 64-bit
+	// word of the bitmap.
+	buddyLeafOrder = 6
+	buddyLeafCnt   = unitTotalCnt >> buddyLeafOrder
+	buddyMaxOrder  = unitTotalCntBits
+)
+
+// buddyTree is a complete binary tree over the words of the bitmap. The root is
+// nodes[1], and the children of nodes[i] are nodes[2i] and nodes[2i+1]. The
+// leaves are nodes[buddyLeafCnt:], where nodes[buddyLeafCnt+i] covers the i-th
+// 64-bit word of the bitmap.
+//
+// A node of order k covers the 2^k units aligned to 2^k. Bit j of a node is set
+// when its units contain a free block of order j, which is 2^j free units
+// aligned to 2^j whose buddy is not free. So a node whose units are all free has
+// only the bit of its own order.
+type buddyTree struct {
+	nodes []uint32
+}
+
+// wordFreeBlocks returns the bitmap of the free blocks of every order inside
+// a 64-bit word of the bitmap. Bit i of ret[k] is set when the block of order k
+// starting from bit i is free, and the block of order k+1 containing it is not.
+func wordFreeBlocks(w uint64) (ret [buddyLeafOrder + 1]uint64) {
+	// alignedMasks[k] has the bits at the positions aligned to 2^k
+	alignedMasks := [buddyLeafOrder]uint64{
+		0x5555_5555_5555_5555,
+		0x1111_1111_1111_1111,
+		0x0101_0101_0101_0101,
+		0x0001_0001_0001_0001,
+		0x0000_0001_0000_0001,
+		0x0000_0000_0000_0001,
+	}
+	// full[k] has the bits of the first units of all free blocks of order k,
+	// including the ones inside a larger free block.
+	var full [buddyLeafOrder + 1]uint64
+	full[0] = ^w
+	for k := 1; k <= buddyLeafOrder; k++ {
+		full[k] = full[k-1] & (full[k-1] >> (1 << (k - 1))) & alignedMasks[k-1]
+	}
+	for k := 0; k < buddyLeafOrder; k++ {
+		ret[k] = full[k] &^ (full[k+1] | full[k+1]<<(1<<k))
+	}
+	ret[buddyLeafOrder] = full[buddyLeafOrder]
+	return ret
+}
+
+func leafMask(w uint64) uint32 {
+	var mask uint32
+	for k, blocks := range wordFreeBlocks(w) {
+		if blocks != 0 {
+			mask |= 1 << k
+		}
+	}
+	return mask
+}
+
+func nodeOrder(i int) int {
+	return buddyMaxOrder - (bits.Len(uint(i)) - 1)
+}
+
+func newBuddyTree(bitmap []byte) *buddyTree {
+	t := &buddyTree{nodes: make([]uint32, 2*buddyLeafCnt)}
+	for i := 0; i < buddyLeafCnt; i++ {
+		t.nodes[buddyLeafCnt+i] = leafMask(binary.LittleEndian.Uint64(bitmap[i*8:]))
+	}
+	for i := buddyLeafCnt - 1; i >= 1; i-- {
+		t.updateNode(i)
+	}
+	return t
+}
+
+// updateNode recalculates an internal node from its children.
+func (t *buddyTree) updateNode(i int) {
+	left, right := t.nodes[2*i], t.nodes[2*i+1]
+	childFull := uint32(1) << (nodeOrder(i) - 1)
+	if left == childFull && right == childFull {
+		t.nodes[i] = childFull << 1
+		return
+	}
+	t.nodes[i] = left | right
+}
+
+// update recalculates the nodes covering [offset, offset+length) after the
+// bitmap is changed.
+func (t *buddyTree) update(bitmap []byte, offset, length unit) {
+	lo := int(offset >> buddyLeafOrder)
+	hi := int((offset + length - 1) >> buddyLeafOrder)
+	for i := lo; i <= hi; i++ {
+		t.nodes[buddyLeafCnt+i] = leafMask(binary.LittleEndian.Uint64(bitmap[i*8:]))
+	}
+	lo, hi = lo+buddyLeafCnt, hi+buddyLeafCnt
+	for lo > 1 {
+		lo, hi = lo/2, hi/2
+		for i := lo; i <= hi; i++ {
+			t.updateNode(i)
+		}
+	}
+}
+
+// find returns the offset of the smallest free block whose order is at least
+// order. The leftmost one is chosen among the blocks of the same order.
+func (t *buddyTree) find(bitmap []byte, order int) (unit, bool) {
+	candidates := t.nodes[1] >> order << order
+	if candidates == 0 {
+		return 0, false
+	}
+	target := bits.TrailingZeros32(candidates)
+	i := 1
+	for i < buddyLeafCnt {
+		order := nodeOrder(i)
+		if t.nodes[i] == 1<<order {
+			// the node itself is the free block
+			depth := buddyMaxOrder - order
+			return unit(i-1<<depth) << order, true
+		}
+		i *= 2
+		if t.nodes[i]&(1<<target) == 0 {
+			i++
+		}
+	}
+	word := i - buddyLeafCnt
+	blocks := wordFreeBlocks(binary.LittleEndian.Uint64(bitmap[word*8:]))[target]
+	return unit(word)<<buddyLeafOrder + unit(bits.TrailingZeros64(blocks)), true
+}
+
+// buddyManager is a Manager that allocates power-of-two units aligned to their
+// size, like the buddy system. It shares the image format with diskManagerImpl,
+// but the free blocks and their coalescing are derived from the bitmap by
+// buddyTree. It's thread-safe.
+type buddyManager struct {
+	mu sync.RWMutex
+
+	imageFilePath string
+	bitmap        [bitmapSize]byte
+	summary       *bitmapSummary
+	tree          *buddyTree
+	reserved      *unitRanges
+	bad           *unitRanges
+	namespaces    *namespaces
+	refs          *refCounts
+	usedUnitCnt   unit
+	generation    uint64
+	// lastSnapshotID is the largest snapshot ID ever assigned, see
+	// takeSnapshot.
+	lastSnapshotID SnapshotID
+}
+
+// NewBuddyManager creates a Manager of the buddy system. It can be used as a
+// ManagerConstructor.
+func NewBuddyManager(imageFilePath string) (Manager, error) {
+	return newBuddyManager(imageFilePath)
+}
+
+func newBuddyManager(imageFilePath string) (*buddyManager, error) {
+	m := &buddyManager{
+		imageFilePath: imageFilePath,
+		reserved:      newReservedRanges(),
+		bad:           newBadRanges(),
+		namespaces:    newNamespaces(),
+		refs:          newRefCounts(),
+	}
+	// an allocation takes a whole block
+	m.namespaces.charge = func(size int64) int64 { return unitSize << sizeToOrder(size) }
+	trailer, err := readImage(imageFilePath, m.bitmap[:])
+	if err != nil {
+		return nil, err
+	}
+
+	m.summary = newBitmapSummary(m.bitmap[:])
+	if trailer != nil {
+		for kind := range trailer.sections {
+			// the snapshot of free spaces is not needed, the tree is always
+			// built from the bitmap
+			switch kind {
+			case sectionFreeSpaces, sectionReserved, sectionBad, sectionNamespaces, sectionRefCounts, sectionSnapshotInfo,
+				sectionSnapshotSeq:
+			default:
+				return nil, errors.Errorf("section kind %d of image trailer is not supported by the buddy allocator", kind)
+			}
+		}
+		m.generation = trailer.generation
+		for _, rs := range []*unitRanges{m.reserved, m.bad} {
+			if err = rs.decodeSection(trailer, m.bitmap[:], m.summary); err != nil {
+				return nil, err
+			}
+		}
+		if err = m.namespaces.decodeSection(trailer, m.bitmap[:], m.summary); err != nil {
+			return nil, err
+		}
+		if err = m.refs.decodeSection(trailer, m.bitmap[:]); err != nil {
+			return nil, err
+		}
+		if m.lastSnapshotID, err = decodeSnapshotSeq(trailer); err != nil {
+			return nil, errors.WithMessage(err, "invalid image trailer")
+		}
+	}
+	m.tree = newBuddyTree(m.bitmap[:])
+	m.usedUnitCnt = countOnes(m.bitmap[:])
+	return m, nil
+}
+
+// sizeToOrder returns the order of the smallest block that can hold size.
+func sizeToOrder(size int64) int {
+	return bits.Len32(uint32(byteSizeToUnitCnt(size) - 1))
+}
+
+// Alloc implements Manager.Alloc. The size is rounded up to the power-of-two
+// units, and the returned offset is aligned to the rounded size.
+func (m *buddyManager) Alloc(size int64) (int64, error) {
+	return m.AllocIn(DefaultNamespace, size)
+}
+
+// AllocIn implements Manager.AllocIn. Like the space it takes, the rounded size
+// is charged to the namespace.
+func (m *buddyManager) AllocIn(ns NamespaceID, size int64) (int64, error) {
+	if err := checkAllocSize(size, false); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.namespaces.admit(ns, size, m.freeSize()); err != nil {
+		return 0, err
+	}
+	offset, err := m.alloc(sizeToOrder(size), 0)
+	if err != nil {
+		return 0, err
+	}
+	m.namespaces.own(ns, offset, size)
+	return offset, nil
+}
+
+// AllocAligned implements Manager.AllocAligned. The alignment should be a power
+// of two, and the allocation is the start of a free block that is not smaller
+// than the alignment.
+func (m *buddyManager) AllocAligned(size int64, alignment int64) (int64, error) {
+	if err := checkAllocSize(size, false); err != nil {
+		return 0, err
+	}
+	if err := checkAlignment(alignment); err != nil {
+		return 0, err
+	}
+	if alignment&(alignment-1) != 0 {
+		return 0, errors.Errorf("alignment should be a power of two for the buddy allocator, got: %d", alignment)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.namespaces.admit(DefaultNamespace, size, m.freeSize()); err != nil {
+		return 0, err
+	}
+	return m.alloc(sizeToOrder(size), sizeToOrder(alignment))
+}
+
+// alloc allocates a block of order from the start of a free block whose order
+// is at least minBlockOrder.
+func (m *buddyManager) alloc(order, minBlockOrder int) (int64, error) {
+	offset, ok := m.tree.find(m.bitmap[:], max(order, minBlockOrder))
+	if !ok {
+		return 0, ErrNoEnoughSpace
+	}
+	length := unit(1) << order
+	allocInBitmap(m.bitmap[:], offset, length)
+	m.update(offset, length)
+	m.usedUnitCnt += length
+	return unitOffsetToByteOffset(offset), nil
+}
+
+// currentFreeSize is like freeSize, but it should be called without the lock
+// held.
+func (m *buddyManager) currentFreeSize() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.freeSize()
+}
+
+func (m *buddyManager) freeSize() int64 {
+	return unitOffsetToByteOffset(unitTotalCnt - m.usedUnitCnt)
+}
+
+func (m *buddyManager) update(offset, length unit) {
+	m.summary.update(m.bitmap[:], offset, length)
+	m.tree.update(m.bitmap[:], offset, length)
+}
+
+// Free implements Manager.Free. Like Alloc, the size is rounded up to the
+// power-of-two units, and startOffset should be aligned to the rounded size.
+func (m *buddyManager) Free(offset int64, size int64) error {
+	return m.FreeIn(DefaultNamespace, offset, size)
+}
+
+// FreeIn implements Manager.FreeIn. The size is rounded like Free.
+func (m *buddyManager) FreeIn(ns NamespaceID, offset int64, size int64) error {
+	if err := checkRange(offset, size); err != nil {
+		return err
+	}
+	order := sizeToOrder(size)
+	if offset%(unitSize<<order) != 0 {
+		return errors.Errorf("start offset should be aligned to the block size %d, got: %d", unitSize<<order, offset)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unitOffset := byteOffsetToUnitOffset(offset)
+	length := unit(1) << order
+	if m.reserved.overlaps(unitOffset, length) {
+		return errors.Errorf("range at %d with size %d overlaps reserved ranges", offset, size)
+	}
+	if err := m.namespaces.checkFree(ns, offset, size); err != nil {
+		return err
+	}
+	m.refs.release(unitOffset, length, m.free)
+	m.namespaces.remove(ns, offset)
+	return nil
+}
+
+// free frees the units except the bad ones.
+func (m *buddyManager) free(offset, length unit) {
+	m.bad.gaps(offset, length, func(offset, length unit) {
+		freeInBitmap(m.bitmap[:], offset, length)
+		m.update(offset, length)
+		m.usedUnitCnt -= length
+	})
+}
+
+// ReserveRange implements Manager.ReserveRange.
+func (m *buddyManager) ReserveRange(offset int64, size int64) error {
+	if err := checkReservedRange(offset, size); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unitOffset := byteOffsetToUnitOffset(offset)
+	unitCnt := byteSizeToUnitCnt(size)
+	if m.summary.findLeadingBitsCnt(m.bitmap[:], unitOffset, false) < unitCnt {
+		return errors.Errorf("range at %d with size %d is not free", offset, size)
+	}
+	allocInBitmap(m.bitmap[:], unitOffset, unitCnt)
+	m.update(unitOffset, unitCnt)
+	m.usedUnitCnt += unitCnt
+	m.reserved.add(unitOffset, unitCnt)
+	return nil
+}
+
+// UnreserveRange implements Manager.UnreserveRange.
+func (m *buddyManager) UnreserveRange(offset int64, size int64) error {
+	if err := checkReservedRange(offset, size); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unitOffset := byteOffsetToUnitOffset(offset)
+	unitCnt := byteSizeToUnitCnt(size)
+	if err := m.reserved.remove(unitOffset, unitCnt); err != nil {
+		return err
+	}
+	m.free(unitOffset, unitCnt)
+	return nil
+}
+
+// MarkBad implements Manager.MarkBad.
+func (m *buddyManager) MarkBad(offset int64, size int64) error {
+	if err := checkRange(offset, size); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.reserved.overlapsBytes(offset, size) {
+		return errors.Errorf("range at %d with size %d overlaps reserved ranges", offset, size)
+	}
+	unitOffset := byteOffsetToUnitOffset(offset)
+	unitCnt := byteSizeToUnitCnt(offset+size) - unitOffset
+	freeRunsIn(m.bitmap[:], m.summary, unitOffset, unitCnt, func(l location) {
+		allocInBitmap(m.bitmap[:], l.offset, l.length)
+		m.update(l.offset, l.length)
+		m.usedUnitCnt += l.length
+	})
+	m.bad.add(unitOffset, unitCnt)
+	return nil
+}
+
+// IncRef implements Manager.IncRef.
+func (m *buddyManager) IncRef(offset int64, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unitOffset, unitCnt, err := checkShared(offset, size, m.bitmap[:], m.summary, m.reserved, m.namespaces)
+	if err != nil {
+		return err
+	}
+	if err = m.refs.checkInc(unitOffset, unitCnt, m.bad); err != nil {
+		return err
+	}
+	m.refs.inc(unitOffset, unitCnt)
+	return nil
+}
+
+// DecRef implements Manager.DecRef. Unlike Free, the size is not rounded, so a
+// part of a block can be released.
+func (m *buddyManager) DecRef(offset int64, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	unitOffset, unitCnt, err := checkShared(offset, size, m.bitmap[:], m.summary, m.reserved, m.namespaces)
+	if err != nil {
+		return err
+	}
+	m.refs.release(unitOffset, unitCnt, m.free)
+	return nil
+}
+
+// SetNamespace implements Manager.SetNamespace.
+func (m *buddyManager) SetNamespace(ns NamespaceID, quota int64, reservation int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.namespaces.set(ns, quota, reservation, m.freeSize())
+}
+
+// NamespaceStats implements Manager.NamespaceStats.
+func (m *buddyManager) NamespaceStats(ns NamespaceID) (NamespaceStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.namespaces.stats(ns)
+}
+
+// IsAllocated implements Manager.IsAllocated.
+func (m *buddyManager) IsAllocated(offset int64, size int64) (bool, error) {
+	if err := checkRange(offset, size); err != nil {
+		return false, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	unitCnt := byteSizeToUnitCnt(offset%unitSize + size)
+	return m.summary.findLeadingBitsCnt(m.bitmap[:], byteOffsetToUnitOffset(offset), true) >= unitCnt, nil
+}
+
+// Stats implements Manager.Stats. The free spaces are collected by scanning the
+// bitmap.
+func (m *buddyManager) Stats() Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var (
+		largest unit
+		cnt     int64
+		counts  [totalBucketCnt]int64
+	)
+	forEachFreeRun(m.bitmap[:], m.summary, 0, unitTotalCnt, func(l location) bool {
+		largest = max(largest, l.length)
+		cnt++
+		counts[getBucketIdx(l.length)]++
+		return true
+	})
+	return Stats{
+		TotalSize:       spaceTotalSize,
+		UnitSize:        unitSize,
+		UsedSize:        unitOffsetToByteOffset(m.usedUnitCnt - m.reserved.total - m.bad.total),
+		FreeSize:        m.freeSize(),
+		ReservedSize:    unitOffsetToByteOffset(m.reserved.total),
+		BadSize:         unitOffsetToByteOffset(m.bad.total),
+		LargestFreeSize: unitOffsetToByteOffset(largest),
+		FreeExtentCnt:   cnt,
+		FreeHistogram:   histogramOf(&counts),
+	}
+}
+
+// Extents implements Manager.Extents.
+func (m *buddyManager) Extents(fn func(e Extent) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	extents(m.bitmap[:], m.summary, m.reserved, m.bad, nil, m.namespaces, m.refs, fn)
+}
+
+// Snapshot implements Manager.Snapshot.
+func (m *buddyManager) Snapshot() (SnapshotID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, err := takeSnapshot(m.imageFilePath, m.bitmap[:], m.trailer(), m.lastSnapshotID)
+	if err != nil {
+		return 0, err
+	}
+	m.lastSnapshotID = id
+	return id, nil
+}
+
+// ListSnapshots implements Manager.ListSnapshots.
+func (m *buddyManager) ListSnapshots() ([]SnapshotInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return listSnapshots(m.imageFilePath)
+}
+
+// DeleteSnapshot implements Manager.DeleteSnapshot.
+func (m *buddyManager) DeleteSnapshot(id SnapshotID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return deleteSnapshot(m.imageFilePath, id)
+}
+
+// RestoreSnapshot implements Manager.RestoreSnapshot.
+func (m *buddyManager) RestoreSnapshot(id SnapshotID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path, err := checkSnapshotExists(m.imageFilePath, id)
+	if err != nil {
+		return err
+	}
+	r, err := newBuddyManager(path)
+	if err != nil {
+		return errors.WithMessagef(err, "snapshot %d is broken", id)
+	}
+	m.bitmap = r.bitmap
+	m.summary = newBitmapSummary(m.bitmap[:])
+	m.tree = newBuddyTree(m.bitmap[:])
+	m.reserved = r.reserved
+	m.bad = r.bad
+	m.namespaces = r.namespaces
+	m.refs = r.refs
+	m.usedUnitCnt = r.usedUnitCnt
+	return nil
+}
+
+// DiffSnapshots implements Manager.DiffSnapshots.
+func (m *buddyManager) DiffSnapshots(from, to SnapshotID) ([]Extent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return diffSnapshots(m.imageFilePath, from, to)
+}
+
+// Close writes the bitmap and a new generation of trailer to the image file.
+func (m *buddyManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return writeFileAtomically(m.imageFilePath, m.bitmap[:], m.checkpointTrailer().encode())
+}
+
+// checkpointTrailer returns the trailer of the next generation.
+func (m *buddyManager) checkpointTrailer() *imageTrailer {
+	m.generation++
+	return m.trailer()
+}
+
+// trailer returns the trailer of the current generation.
+func (m *buddyManager) trailer() *imageTrailer {
+	t := &imageTrailer{
+		generation: m.generation,
+		bitmapCRC:  bitmapCRC(m.bitmap[:]),
+		sections:   map[sectionKind][]byte{},
+	}
+	for _, rs := range []*unitRanges{m.reserved, m.bad} {
+		if len(rs.ranges) > 0 {
+			t.sections[rs.kind] = rs.encode()
+		}
+	}
+	if len(m.namespaces.defs) > 0 {
+		t.sections[sectionNamespaces] = m.namespaces.encode()
+	}
+	if !m.refs.empty() {
+		t.sections[sectionRefCounts] = m.refs.encode()
+	}
+	if m.lastSnapshotID > 0 {
+		t.sections[sectionSnapshotSeq] = encodeSnapshotSeq(m.lastSnapshotID)
+	}
+	return t
+}
@@ -0,0 +1,120 @@
+package disk_management_demo
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWordFreeBlocks(t *testing.T) {
+	blocks := wordFreeBlocks(0)
+	require.Equal(t, uint64(1), blocks[buddyLeafOrder])
+	for k := 0; k < buddyLeafOrder; k++ {
+		require.Zero(t, blocks[k])
+	}
+	require.Equal(t, uint32(1<<buddyLeafOrder), leafMask(0))
+	require.Zero(t, leafMask(^uint64(0)))
+
+	// units 1, 4 and 8..63 are allocated
+	w := uint64(0xFFFF_FFFF_FFFF_FF00 | 0b0001_0010)
+	blocks = wordFreeBlocks(w)
+	require.Equal(t, uint64(0b0010_0001), blocks[0])
+	require.Equal(t, uint64(0b0100_0100), blocks[1])
+	require.Zero(t, blocks[2])
+	require.Equal(t, uint32(0b11), leafMask(w))
+}
+
+// findBuddyBlockByScan is the brute-force version of buddyTree.find. The units
+// after bitmap are treated as allocated.
+func findBuddyBlockByScan(bitmap []byte, order int) (unit, bool) {
+	total := unit(len(bitmap)) * 8
+	for k := order; k <= buddyMaxOrder; k++ {
+		size := unit(1) << k
+		for offset := unit(0); offset+size <= total; offset += size {
+			if !isFreeInBitmap(bitmap, offset, size) {
+				continue
+			}
+			if parent := offset &^ (2*size - 1); parent+2*size <= total {
+				if isFreeInBitmap(bitmap, parent, 2*size) {
+					continue
+				}
+			}
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+func isFreeInBitmap(bitmap []byte, offset, length unit) bool {
+	for u := offset; u < offset+length; u++ {
+		if bitmap[u/8]&(1<<(u%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuddyTreeFind(t *testing.T) {
+	bitmap := make([]byte, bitmapSize)
+	copy(bitmap, ones[:])
+	// only the first 4096 units are used in this test
+	for i := 0; i < 512; i++ {
+		bitmap[i] = byte(rand.Intn(256)) & byte(rand.Intn(256))
+	}
+	tree := newBuddyTree(bitmap)
+	for i := 0; i < 200; i++ {
+		order := rand.Intn(11)
+		expected, expectedOK := findBuddyBlockByScan(bitmap[:512], order)
+		got, ok := tree.find(bitmap, order)
+		require.Equal(t, expectedOK, ok)
+		if !ok {
+			continue
+		}
+		require.Equal(t, expected, got)
+
+		allocInBitmap(bitmap, got, 1<<order)
+		tree.update(bitmap, got, 1<<order)
+		if rand.Intn(2) == 0 {
+			offset := unit(rand.Intn(4096))
+			freeInBitmap(bitmap, offset, 1)
+			tree.update(bitmap, offset, 1)
+		}
+	}
+}
+
+func TestBuddyManager(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := newBuddyManager(tempFile)
+	require.NoError(t, err)
+
+	// 3 units are rounded up to 4
+	offset, err := m.Alloc(3 * unitSize)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, offset)
+	offset2, err := m.Alloc(512)
+	require.NoError(t, err)
+	require.EqualValues(t, 4*unitSize, offset2)
+	require.EqualValues(t, 5*unitSize, m.Stats().UsedSize)
+
+	err = m.Free(2*unitSize, 3*unitSize)
+	require.ErrorContains(t, err, "start offset should be aligned to the block size 16384, got: 8192")
+	require.NoError(t, m.Free(offset, 3*unitSize))
+	allocated, err := m.IsAllocated(3*unitSize, unitSize)
+	require.NoError(t, err)
+	require.False(t, allocated)
+	require.NoError(t, m.Close())
+
+	// the image is compatible with the bitmap implementation
+	m2, err := newDiskManagerImpl(tempFile)
+	require.NoError(t, err)
+	allocated, err = m2.IsAllocated(offset2, unitSize)
+	require.NoError(t, err)
+	require.True(t, allocated)
+	_, err = m2.Alloc(512)
+	require.NoError(t, err)
+	require.NoError(t, m2.Close())
+
+	_, err = newBuddyManager(tempFile)
+	require.ErrorContains(t, err, "section kind 2 of image trailer is not supported by the buddy allocator")
+}
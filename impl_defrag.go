@@ -0,0 +1,190 @@
+package disk_management_demo
+
+import (
+	"context"
+	"sort"
+)
+
+// defragCandidate is an allocated run whose both neighbours are free, so moving
+// it away merges them.
+type defragCandidate struct {
+	run         location
+	left, right unit
+}
+
+// defragCandidates returns the allocated runs between two continuous free units,
+// the cheapest to move first. Among the runs of the same length, the ones
+// merging larger free units come first.
+func (d *diskManagerImpl) defragCandidates() []defragCandidate {
+	var (
+		ret  []defragCandidate
+		prev location
+	)
+	forEachFreeRun(d.bitmap[:], d.summary, 0, unitTotalCnt, func(l location) bool {
+		if prev.length > 0 {
+			run := location{offset: prev.offset + prev.length, length: l.offset - prev.offset - prev.length}
+			ret = append(ret, defragCandidate{run: run, left: prev.length, right: l.length})
+		}
+		prev = l
+		return true
+	})
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].run.length != ret[j].run.length {
+			return ret[i].run.length < ret[j].run.length
+		}
+		return ret[i].left+ret[i].right > ret[j].left+ret[j].right
+	})
+	return ret
+}
+
+// movable returns true if the units of l are only allocated by Alloc of
+// DefaultNamespace, whose relocation doesn't change other metadata.
+func (d *diskManagerImpl) movable(l location) bool {
+	if d.reserved.overlaps(l.offset, l.length) || d.bad.overlaps(l.offset, l.length) ||
+		d.slabs.overlaps(l.offset, l.length) || d.refs.overlaps(l.offset, l.length) {
+		return false
+	}
+	return !d.namespaces.overlaps(unitOffsetToByteOffset(l.offset), unitOffsetToByteOffset(l.length))
+}
+
+// isolatedRun returns the continuous free units around l if l is still exactly
+// an allocated run between them.
+func (d *diskManagerImpl) isolatedRun(l location) (left, right location, ok bool) {
+	if d.summary.findLeadingBitsCnt(d.bitmap[:], l.offset, true) != l.length {
+		return location{}, location{}, false
+	}
+	left, right = d.freeSpaces.neighbours(l.offset, l.length)
+	return left, right, left.length > 0 && right.length > 0
+}
+
+// bestFit returns the smallest continuous free units that can hold length
+// units, except the ones starting at except. The continuous free units in
+// oneLengthBuckets are found by scanning the bitmap.
+func (s *freeSpaces) bestFit(length, except unit) (location, bool) {
+	var best location
+	better := func(l location) bool {
+		return l.length >= length && l.offset != except && (best.length == 0 || l.length < best.length)
+	}
+	if length < oneLengthBucketThreshold {
+		s.ascendSmall(func(l location) bool {
+			if better(l) {
+				best = l
+			}
+			return best.length != length
+		})
+		if best.length > 0 {
+			return best, true
+		}
+	}
+	for _, b := range s.buckets[getBucketIdx(max(length, oneLengthBucketThreshold)):] {
+		for _, l := range b.(*varLengthBucket).locations {
+			if better(*l) {
+				best = *l
+			}
+		}
+		if best.length > 0 {
+			return best, true
+		}
+	}
+	return location{}, false
+}
+
+// planningCopy returns a copy of d to plan the moves of a dry run on, so the
+// state of d including the order in freeSpaces is not changed. The metadata
+// other than the free spaces is shared, because planning only reads it. d should
+// be fully loaded.
+func (d *diskManagerImpl) planningCopy() *diskManagerImpl {
+	c := &diskManagerImpl{
+		bitmap:      d.bitmap,
+		slabs:       d.slabs,
+		reserved:    d.reserved,
+		bad:         d.bad,
+		namespaces:  d.namespaces,
+		refs:        d.refs,
+		usedUnitCnt: d.usedUnitCnt,
+		loadedUpTo:  unitTotalCnt,
+		generation:  d.generation,
+	}
+	c.summary = newBitmapSummary(c.bitmap[:])
+	c.freeSpaces = newFreeSpaces(c.bitmap[:], c.summary)
+	// the snapshot keeps the order of freeSpaces, so the copy makes the same
+	// decisions
+	if payload, ok := d.freeSpaces.snapshot(d.generation); ok {
+		if err := c.freeSpaces.loadFromSnapshot(payload, d.generation); err == nil {
+			return c
+		}
+		c.freeSpaces = newFreeSpaces(c.bitmap[:], c.summary)
+	}
+	c.freeSpaces.loadFromBitmap()
+	c.freeSpaces.rebuildMaxContinuousFree(0)
+	return c
+}
+
+// Defragment implements Defragmenter.Defragment.
+func (d *diskManagerImpl) Defragment(
+	ctx context.Context,
+	budget int64,
+	relocate RelocateFunc,
+	opts ...DefragOption,
+) ([]Relocation, error) {
+	o := &defragOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.dryRun {
+		d = d.planningCopy()
+	}
+
+	var (
+		moves    []Relocation
+		progress DefragProgress
+		err      error
+	)
+	for _, c := range d.defragCandidates() {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		size := unitOffsetToByteOffset(c.run.length)
+		if progress.MovedSize+size > budget {
+			// the candidates are ordered by length, so the rest can't fit either
+			break
+		}
+		left, right, ok := d.isolatedRun(c.run)
+		if !ok || !d.movable(c.run) {
+			continue
+		}
+		// moving into the right neighbour only shifts the run, while moving into
+		// the left one slides it to the start of the merged free units. Other
+		// continuous free units are not split if they are larger than the merged
+		// one.
+		dest, ok := d.freeSpaces.bestFit(c.run.length, right.offset)
+		if !ok || (dest.offset != left.offset && dest.length >= left.length+c.run.length+right.length) {
+			continue
+		}
+
+		d.takeUnits(dest.offset, c.run.length)
+		move := Relocation{
+			OldOffset: unitOffsetToByteOffset(c.run.offset),
+			NewOffset: unitOffsetToByteOffset(dest.offset),
+			Size:      size,
+		}
+		if !o.dryRun {
+			if err = relocate(move.OldOffset, move.NewOffset, move.Size); err != nil {
+				d.freeUnits(dest.offset, c.run.length)
+				break
+			}
+		}
+		d.freeUnits(c.run.offset, c.run.length)
+		moves = append(moves, move)
+
+		progress.MovedCnt++
+		progress.MovedSize += size
+		progress.FreeExtentCnt = int64(d.freeSpaces.count())
+		progress.LargestFreeSize = unitOffsetToByteOffset(d.freeSpaces.largest())
+		if o.progress != nil {
+			o.progress(progress)
+		}
+	}
+
+	return moves, err
+}
@@ -0,0 +1,119 @@
+package disk_management_demo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newFragmentedManager returns a manager whose first 40 units are
+//
+//	allocated [0, 4), free [4, 8), allocated [8, 12), free [12, 16), ...
+//
+// until free [28, 32), and allocated [32, 40).
+func newFragmentedManager(t *testing.T) *diskManager2 {
+	tempFile := createFileWithContent(t, nil)
+	m, err := newDiskManagerWithMutexImpl(tempFile)
+	require.NoError(t, err)
+	for i := 0; i < 9; i++ {
+		size := int64(4 * unitSize)
+		if i == 8 {
+			size *= 2
+		}
+		offset, err := m.Alloc(size)
+		require.NoError(t, err)
+		require.EqualValues(t, i*4*unitSize, offset)
+	}
+	for i := 1; i < 8; i += 2 {
+		require.NoError(t, m.Free(int64(i*4*unitSize), 4*unitSize))
+	}
+	return m
+}
+
+func TestDefragment(t *testing.T) {
+	m := newFragmentedManager(t)
+	var (
+		copied   []Relocation
+		progress []DefragProgress
+	)
+	relocate := func(oldOffset, newOffset, size int64) error {
+		copied = append(copied, Relocation{OldOffset: oldOffset, NewOffset: newOffset, Size: size})
+		return nil
+	}
+	moves, err := m.Defragment(context.Background(), spaceTotalSize, relocate,
+		DefragProgressFunc(func(p DefragProgress) { progress = append(progress, p) }))
+	require.NoError(t, err)
+	// [8, 12) slides to the left, then [16, 20) fills the hole at [28, 32), and
+	// the other runs are not between two free spaces any more
+	expected := []Relocation{
+		{OldOffset: 8 * unitSize, NewOffset: 4 * unitSize, Size: 4 * unitSize},
+		{OldOffset: 16 * unitSize, NewOffset: 28 * unitSize, Size: 4 * unitSize},
+	}
+	require.Equal(t, expected, moves)
+	require.Equal(t, expected, copied)
+	require.Equal(t, []DefragProgress{
+		{MovedCnt: 1, MovedSize: 4 * unitSize, FreeExtentCnt: 4, LargestFreeSize: spaceTotalSize - 40*unitSize},
+		{MovedCnt: 2, MovedSize: 8 * unitSize, FreeExtentCnt: 2, LargestFreeSize: spaceTotalSize - 40*unitSize},
+	}, progress)
+
+	var got []Extent
+	m.Extents(func(e Extent) bool {
+		got = append(got, e)
+		return e.Offset < 40*unitSize
+	})
+	require.Equal(t, []Extent{
+		{Offset: 0, Size: 8 * unitSize, Allocated: true},
+		{Offset: 8 * unitSize, Size: 16 * unitSize},
+		{Offset: 24 * unitSize, Size: 16 * unitSize, Allocated: true},
+		{Offset: 40 * unitSize, Size: spaceTotalSize - 40*unitSize},
+	}, got)
+	require.NoError(t, verifyFreeSpaces(m.m.freeSpaces, m.m.bitmap[:], m.m.summary))
+}
+
+func TestDefragmentDryRunAndBudget(t *testing.T) {
+	m := newFragmentedManager(t)
+	before := m.Stats()
+	beforeFreeSpaces, ok := m.m.freeSpaces.snapshot(0)
+	require.True(t, ok)
+	relocate := func(oldOffset, newOffset, size int64) error {
+		return errors.New("should not be called")
+	}
+	moves, err := m.Defragment(context.Background(), spaceTotalSize, relocate, DefragDryRun())
+	require.NoError(t, err)
+	require.Len(t, moves, 2)
+	require.Equal(t, before, m.Stats())
+	// the free spaces are not touched, so the later allocations are not affected
+	afterFreeSpaces, ok := m.m.freeSpaces.snapshot(0)
+	require.True(t, ok)
+	require.Equal(t, beforeFreeSpaces, afterFreeSpaces)
+	untouched := newFragmentedManager(t)
+	var offsets []int64
+	for i := 0; i < 4; i++ {
+		offset, err := m.Alloc(unitSize)
+		require.NoError(t, err)
+		expected, err := untouched.Alloc(unitSize)
+		require.NoError(t, err)
+		require.Equal(t, expected, offset)
+		offsets = append(offsets, offset)
+	}
+	for _, offset := range offsets {
+		require.NoError(t, m.Free(offset, unitSize))
+	}
+
+	// the failed move is undone
+	moves, err = m.Defragment(context.Background(), spaceTotalSize, relocate)
+	require.ErrorContains(t, err, "should not be called")
+	require.Empty(t, moves)
+	require.Equal(t, before, m.Stats())
+
+	moves, err = m.Defragment(context.Background(), 7*unitSize, func(_, _, _ int64) error { return nil })
+	require.NoError(t, err)
+	require.Len(t, moves, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = m.Defragment(ctx, spaceTotalSize, relocate)
+	require.ErrorIs(t, err, context.Canceled)
+}
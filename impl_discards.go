@@ -0,0 +1,67 @@
+package disk_management_demo
+
+// discards collects the freed units to be passed to a Discarder. The units are
+// dropped when they are allocated again before being discarded, so the data
+// written to them is never discarded. It's not persisted, the units freed
+// before a crash are not discarded.
+type discards struct {
+	discarder Discarder
+	// young is freed after the last flush, and old is freed before it.
+	young *unitRanges
+	old   *unitRanges
+	// err is the first error returned by discarder.
+	err error
+}
+
+func newDiscards(discarder Discarder) *discards {
+	return &discards{
+		discarder: discarder,
+		young:     newDiscardRanges(),
+		old:       newDiscardRanges(),
+	}
+}
+
+// freed records the freed units.
+func (ds *discards) freed(offset, length unit) {
+	ds.young.add(offset, length)
+}
+
+// allocated drops the allocated units.
+func (ds *discards) allocated(offset, length unit) {
+	ds.young.cut(offset, length)
+	ds.old.cut(offset, length)
+}
+
+// reset drops all the recorded units.
+func (ds *discards) reset() {
+	ds.young = newDiscardRanges()
+	ds.old = newDiscardRanges()
+}
+
+// flush discards the units freed before the last flush, so every unit is kept
+// for at least a period between two flushes. If all is true, the units freed
+// after the last flush are also discarded.
+func (ds *discards) flush(all bool) {
+	due := ds.old
+	if all {
+		for _, r := range ds.young.ranges {
+			due.add(r.offset, r.length)
+		}
+		ds.young = newDiscardRanges()
+	}
+	ds.old, ds.young = ds.young, newDiscardRanges()
+	if len(due.ranges) == 0 {
+		return
+	}
+	batch := make([]Range, 0, len(due.ranges))
+	for _, r := range due.ranges {
+		batch = append(batch, Range{Offset: unitOffsetToByteOffset(r.offset), Size: unitOffsetToByteOffset(r.length)})
+	}
+	if err := ds.discarder.Discard(batch); err != nil && ds.err == nil {
+		ds.err = err
+	}
+}
+
+func newDiscardRanges() *unitRanges {
+	return &unitRanges{name: "discard"}
+}
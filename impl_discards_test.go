@@ -0,0 +1,57 @@
+package disk_management_demo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingDiscarder records the discarded ranges, and returns err.
+type recordingDiscarder struct {
+	got [][]Range
+	err error
+}
+
+func (r *recordingDiscarder) Discard(ranges []Range) error {
+	r.got = append(r.got, ranges)
+	return r.err
+}
+
+func TestDiscards(t *testing.T) {
+	r := &recordingDiscarder{}
+	ds := newDiscards(r)
+	ds.freed(0, 4)
+	ds.freed(4, 4)
+	ds.freed(10, 2)
+	// nothing is freed before the last flush
+	ds.flush(false)
+	require.Empty(t, r.got)
+
+	ds.freed(20, 1)
+	ds.allocated(2, 1)
+	ds.flush(false)
+	require.Equal(t, [][]Range{{
+		{Offset: 0, Size: 2 * unitSize},
+		{Offset: 3 * unitSize, Size: 5 * unitSize},
+		{Offset: 10 * unitSize, Size: 2 * unitSize},
+	}}, r.got)
+
+	r.got = nil
+	ds.freed(30, 1)
+	ds.allocated(20, 1)
+	ds.flush(true)
+	require.Equal(t, [][]Range{{{Offset: 30 * unitSize, Size: unitSize}}}, r.got)
+
+	r.got = nil
+	ds.flush(true)
+	require.Empty(t, r.got)
+
+	r.err = errors.New("mock error")
+	ds.freed(0, 1)
+	ds.flush(true)
+	ds.freed(1, 1)
+	r.err = errors.New("another error")
+	ds.flush(true)
+	require.ErrorContains(t, ds.err, "mock error")
+}
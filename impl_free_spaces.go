@@ -1,6 +1,7 @@
 package disk_management_demo
 
 import (
+	"runtime"
 	"slices"
 	"sync"
 )
@@ -14,9 +15,18 @@ const (
 
 // freeSpaces is a structure to query continuous free units. It divides the
 // length of continuous free units into several buckets, and forward the
-// invocations to the bucket.
+// invocations to the bucket. The continuous free units in varLengthBucket are
+// also recorded in index ordered by offset.
+//
+// freeSpaces reads the bitmap to find the continuous free units in
+// oneLengthBucket, so the bitmap should be updated by the caller after every
+// take, and before every put of the freed units.
 type freeSpaces struct {
 	buckets [totalBucketCnt]bucket
+	index   *extentIndex
+
+	bitmap  []byte
+	summary *bitmapSummary
 
 	maxContinuousFree struct {
 		state maxContinuousFreeState
@@ -42,18 +52,19 @@ const (
 	stateExhausted
 )
 
-// newFreeSpaces creates a freeSpaces. The freeSpaces is not ready to use until
-// freeSpaces.loadFromBitmap is called.
-func newFreeSpaces() *freeSpaces {
-	s := &freeSpaces{}
+// newFreeSpaces creates a freeSpaces of the bitmap. summary can be nil. The
+// freeSpaces is not ready to use until freeSpaces.loadFromBitmap is called.
+func newFreeSpaces(bitmap []byte, summary *bitmapSummary) *freeSpaces {
+	s := &freeSpaces{index: newExtentIndex(), bitmap: bitmap, summary: summary}
 	for i := range s.buckets {
 		if i+1 < oneLengthBucketThreshold {
 			// buckets[0] has length 1, ... buckets[126] has length 127
-			s.buckets[i] = &oneLengthBucket{length: unit(i + 1)}
+			s.buckets[i] = &oneLengthBucket{length: unit(i + 1), bitmap: bitmap, summary: summary}
 		} else {
 			extraExponent := i + 1 - oneLengthBucketThreshold
 			s.buckets[i] = &varLengthBucket{
 				lengthLowerBound: oneLengthBucketThreshold * (1 << extraExponent),
+				index:            s.index,
 			}
 		}
 	}
@@ -62,44 +73,69 @@ func newFreeSpaces() *freeSpaces {
 
 // loadFromBitmap loads the continuous free units from the bitmap into the
 // freeSpaces.
-func (s *freeSpaces) loadFromBitmap(bitmap []byte) {
-	zerosCnt := unit(0)
-	zerosStartsAt := unit(0)
-
-	for i, b := range bitmap {
-		// quick path for 0xFF
-		if b == 0xFF {
-			if zerosCnt > 0 {
-				s.put(zerosStartsAt, zerosCnt)
-				zerosCnt = 0
-			}
-			continue
-		}
-		// quick path for 0x00
-		if b == 0x00 {
-			if zerosCnt == 0 {
-				zerosStartsAt = unit(i) * 8
-			}
-			zerosCnt += 8
-			continue
+//
+// The bitmap is divided into loadRegionCnt regions that are scanned by
+// concurrent workers, and the results are put into freeSpaces in order.
+func (s *freeSpaces) loadFromBitmap() {
+	total := unit(len(s.bitmap) * 8)
+	regionSize := (total/loadRegionCnt + 63) / 64 * 64
+	results := make([]chan []location, 0, loadRegionCnt)
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for start := unit(0); start < total; start += regionSize {
+		start := start
+		end := min(start+regionSize, total)
+		ch := make(chan []location, 1)
+		results = append(results, ch)
+		go func() {
+			sem <- struct{}{}
+			ch <- findFreeRuns(s.bitmap, s.summary, start, end)
+			<-sem
+		}()
+	}
+	for _, ch := range results {
+		for _, l := range <-ch {
+			s.put(l.offset, l.length)
 		}
+	}
+}
 
-		for bitIdx := unit(0); bitIdx < 8; bitIdx++ {
-			if b&(1<<bitIdx) != 0 {
-				if zerosCnt > 0 {
-					s.put(zerosStartsAt, zerosCnt)
-					zerosCnt = 0
-				}
-			} else {
-				if zerosCnt == 0 {
-					zerosStartsAt = unit(i)*8 + bitIdx
-				}
-				zerosCnt++
-			}
-		}
+// loadRegionCnt is the number of regions that loadFromBitmap divides the bitmap
+// into.
+const loadRegionCnt = 64
+
+// findFreeRuns returns the continuous free units that start in [start, end) of
+// the bitmap. The last one may end after end. end should be a multiple of 64.
+// summary can be nil.
+func findFreeRuns(bitmap []byte, summary *bitmapSummary, start, end unit) []location {
+	var ret []location
+	forEachFreeRun(bitmap, summary, start, end, func(l location) bool {
+		ret = append(ret, l)
+		return true
+	})
+	return ret
+}
+
+// forEachFreeRun is like findFreeRuns, but it calls fn for every continuous
+// free units in the ascending order of offset until fn returns false.
+func forEachFreeRun(bitmap []byte, summary *bitmapSummary, start, end unit, fn func(l location) bool) {
+	// end is a multiple of 64, so the scanning of this truncated bitmap stops at
+	// end
+	region := bitmap[:end/8]
+	offset := start
+	if start > 0 && bitmap[(start-1)/8]&(1<<((start-1)%8)) == 0 {
+		// skip the free units that belong to the previous region
+		offset += summary.findLeadingBitsCnt(region, offset, false)
 	}
-	if zerosCnt > 0 {
-		s.put(zerosStartsAt, zerosCnt)
+	for offset < end {
+		offset += summary.findLeadingBitsCnt(region, offset, true)
+		if offset == end {
+			break
+		}
+		length := summary.findLeadingBitsCnt(bitmap, offset, false)
+		if !fn(location{offset: offset, length: length}) {
+			return
+		}
+		offset += length
 	}
 }
 
@@ -134,6 +170,121 @@ func (s *freeSpaces) rebuildMaxContinuousFree(threshold unit) {
 	}
 }
 
+// largest returns the length of the maximum continuous free units.
+func (s *freeSpaces) largest() unit {
+	for i := len(s.buckets) - 1; i >= 0; i-- {
+		switch b := s.buckets[i].(type) {
+		case *oneLengthBucket:
+			if b.total > 0 {
+				return b.length
+			}
+		case *varLengthBucket:
+			maxLength := unit(0)
+			for _, l := range b.locations {
+				maxLength = max(maxLength, l.length)
+			}
+			if maxLength > 0 {
+				return maxLength
+			}
+		}
+	}
+	return 0
+}
+
+// count returns the number of continuous free units.
+func (s *freeSpaces) count() int {
+	ret := s.index.length
+	for _, b := range s.buckets[:oneLengthBucketThreshold-1] {
+		ret += b.(*oneLengthBucket).total
+	}
+	return ret
+}
+
+// neighbours returns the continuous free units that end at offset and start at
+// offset+length. A zero length means there's no such free units. The units in
+// [offset, offset+length) can be either allocated or free in the bitmap.
+func (s *freeSpaces) neighbours(offset, length unit) (left location, right location) {
+	left.length = s.summary.findTrailingBitsCnt(s.bitmap, offset, false)
+	left.offset = offset - left.length
+	right.offset = offset + length
+	right.length = s.summary.findLeadingBitsCnt(s.bitmap, right.offset, false)
+	return left, right
+}
+
+// ascendSmall calls fn for every continuous free units in oneLengthBuckets in
+// the ascending order of offset until fn returns false. Every region having them
+// is scanned once.
+func (s *freeSpaces) ascendSmall(fn func(l location) bool) {
+	var remain [oneLengthBucketThreshold]uint16
+	for region := 0; region < smallRunRegionCnt; region++ {
+		total := 0
+		for _, b := range s.buckets[:oneLengthBucketThreshold-1] {
+			o := b.(*oneLengthBucket)
+			remain[o.length] = 0
+			if o.total > 0 {
+				remain[o.length] = o.cnt[region]
+				total += int(o.cnt[region])
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		start := unit(region) << smallRunRegionBits
+		forEachFreeRun(s.bitmap, s.summary, start, start+smallRunRegionSize, func(l location) bool {
+			if l.length < oneLengthBucketThreshold && remain[l.length] > 0 {
+				if !fn(l) {
+					total = -1
+					return false
+				}
+				remain[l.length]--
+				total--
+			}
+			return total > 0
+		})
+		if total < 0 {
+			return
+		}
+	}
+}
+
+// histogram returns the number of continuous free units of every non-empty
+// bucket.
+func (s *freeSpaces) histogram() []HistogramBucket {
+	var counts [totalBucketCnt]int64
+	for i, b := range s.buckets {
+		switch v := b.(type) {
+		case *oneLengthBucket:
+			counts[i] = int64(v.total)
+		case *varLengthBucket:
+			counts[i] = int64(len(v.locations))
+		}
+	}
+	return histogramOf(&counts)
+}
+
+// histogramOf converts the number of continuous free units of every bucket to
+// the non-empty HistogramBucket.
+func histogramOf(counts *[totalBucketCnt]int64) []HistogramBucket {
+	var ret []HistogramBucket
+	for i, cnt := range counts {
+		if cnt == 0 {
+			continue
+		}
+		var h HistogramBucket
+		if i+1 < oneLengthBucketThreshold {
+			h.MinSize = unitOffsetToByteOffset(unit(i + 1))
+			h.MaxSize = h.MinSize
+		} else {
+			extraExponent := i + 1 - oneLengthBucketThreshold
+			h.MinSize = unitOffsetToByteOffset(oneLengthBucketThreshold * (1 << extraExponent))
+			h.MaxSize = min(2*h.MinSize, spaceTotalSize+unitSize) - unitSize
+		}
+		h.Count = cnt
+		ret = append(ret, h)
+	}
+	return ret
+}
+
 func (s *freeSpaces) put(offset unit, length unit) {
 	s.getBucket(length).put(offset, length)
 	if s.maxContinuousFree.state == stateExhausted {
@@ -142,10 +293,10 @@ func (s *freeSpaces) put(offset unit, length unit) {
 }
 
 func (s *freeSpaces) getBucket(length unit) bucket {
-	return s.buckets[s.getBucketIdx(length)]
+	return s.buckets[getBucketIdx(length)]
 }
 
-func (s *freeSpaces) getBucketIdx(length unit) int {
+func getBucketIdx(length unit) int {
 	if length == 0 {
 		panic("length should not be zero")
 	}
@@ -169,7 +320,7 @@ func (s *freeSpaces) take(length unit) (unit, bool) {
 	offset, ok := exactBucket.take(length)
 	if ok {
 		// when it's the same space with maxContinuousFree
-		if offset == cont.loc.offset {
+		if cont.state == stateValid && offset == cont.loc.offset {
 			cont.state = stateNeedRebuild
 		}
 		return offset, true
@@ -205,26 +356,120 @@ allocateFromMaxContinuousFree:
 		s.put(newOffset, newLength)
 		return oldOffset, true
 	}
+	item, _ := s.index.get(oldOffset)
 	if newLength < cont.bucket.lengthLowerBound {
 		// move the location to a smaller bucket
 		newBucket := s.getBucket(newLength).(*varLengthBucket)
-		oldIdx := slices.IndexFunc(cont.bucket.locations, func(l *location) bool {
-			return l.offset == oldOffset
-		})
-		l := len(cont.bucket.locations)
-		cont.bucket.locations[oldIdx], cont.bucket.locations[l-1] = cont.bucket.locations[l-1], nil
-		cont.bucket.locations = cont.bucket.locations[:l-1]
+		cont.bucket.removeByIdx(item.pos)
+		item.pos = len(newBucket.locations)
 		newBucket.locations = append(newBucket.locations, cont.loc)
 		cont.bucket = newBucket
 	}
 
+	// no other free space starts in (oldOffset, newOffset], so the order in
+	// index is kept when changing the offset in place
+	item.offset = newOffset
+	item.length = newLength
 	cont.loc.offset = newOffset
 	cont.loc.length = newLength
 	return oldOffset, true
 }
 
+// takeAligned takes length units starting at a multiple of align. Among the
+// continuous free units that can hold it, the ones in the smallest bucket are
+// preferred to keep the larger aligned regions, and in that bucket the one
+// wasting the least units before the aligned start is chosen. The units before
+// and after the taken ones are put back.
+//
+// The continuous free units in oneLengthBuckets are found by scanning the
+// bitmap, so they are only used when no varLengthBucket can hold it.
+func (s *freeSpaces) takeAligned(length, align unit) (unit, bool) {
+	fit := func(l *location) (unit, bool) {
+		start := (l.offset + align - 1) / align * align
+		return start, start+length <= l.offset+l.length
+	}
+
+	for _, b := range s.buckets[getBucketIdx(max(length, oneLengthBucketThreshold)):] {
+		var (
+			best      *location
+			bestStart unit
+		)
+		for _, l := range b.(*varLengthBucket).locations {
+			start, ok := fit(l)
+			if !ok {
+				continue
+			}
+			if best == nil || start-l.offset < bestStart-best.offset ||
+				(start-l.offset == bestStart-best.offset && l.length < best.length) {
+				best, bestStart = l, start
+			}
+			if start == l.offset {
+				break
+			}
+		}
+		if best != nil {
+			s.split(*best, bestStart, length)
+			return bestStart, true
+		}
+	}
+
+	if length >= oneLengthBucketThreshold {
+		return 0, false
+	}
+	var (
+		found      location
+		foundStart unit
+		ok         bool
+	)
+	s.ascendSmall(func(l location) bool {
+		foundStart, ok = fit(&l)
+		found = l
+		return !ok
+	})
+	if !ok {
+		return 0, false
+	}
+	s.split(found, foundStart, length)
+	return foundStart, true
+}
+
+// takeBestFit takes length units from the start of the smallest continuous free
+// units that can hold them. length should not be less than
+// oneLengthBucketThreshold, so only varLengthBuckets are searched.
+func (s *freeSpaces) takeBestFit(length unit) (unit, bool) {
+	for _, b := range s.buckets[getBucketIdx(length):] {
+		var best *location
+		for _, l := range b.(*varLengthBucket).locations {
+			if l.length >= length && (best == nil || l.length < best.length) {
+				best = l
+				if l.length == length {
+					break
+				}
+			}
+		}
+		if best != nil {
+			offset := best.offset
+			s.split(*best, offset, length)
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// split deletes the continuous free units l, and puts back the units of l
+// before start and after start+length.
+func (s *freeSpaces) split(l location, start, length unit) {
+	s.delete(l.offset, l.length)
+	if start > l.offset {
+		s.put(l.offset, start-l.offset)
+	}
+	if end := start + length; end < l.offset+l.length {
+		s.put(end, l.offset+l.length-end)
+	}
+}
+
 func (s *freeSpaces) delete(offset, length unit) {
-	if offset == s.maxContinuousFree.loc.offset {
+	if s.maxContinuousFree.state == stateValid && offset == s.maxContinuousFree.loc.offset {
 		s.maxContinuousFree.state = stateNeedRebuild
 	}
 	s.getBucket(length).delete(offset)
@@ -236,31 +481,101 @@ type bucket interface {
 	delete(offset unit)
 }
 
+const (
+	// smallRunRegionBits decides the size of the regions that oneLengthBucket
+	// counts the continuous free units in.
+	smallRunRegionBits = 13
+	smallRunRegionSize = 1 << smallRunRegionBits // 8Ki units, 1KiB of bitmap
+	smallRunRegionCnt  = unitTotalCnt / smallRunRegionSize
+)
+
+// oneLengthBucket records the continuous free units of the same length. To
+// bound the memory usage, it only counts the continuous free units starting in
+// every region, and finds them in the bitmap when taking. The memory usage is
+// about 68KiB for each bucket with free units, no matter how many continuous
+// free units there are.
 type oneLengthBucket struct {
 	length  unit
-	offsets []unit
+	bitmap  []byte
+	summary *bitmapSummary
+
+	// total is the number of continuous free units in the bucket.
+	total int
+	// cnt is the number of continuous free units that start in every region. It's
+	// allocated at the first put.
+	cnt []uint16
+	// empty1 has a bit set when cnt of the region is zero, and empty2 has a bit
+	// set when the word of empty1 is all ones. They are used by nextUnset to find
+	// the first region having continuous free units.
+	empty1 []uint64
+	empty2 []uint64
 }
 
 func (o *oneLengthBucket) put(offset unit, _ unit) {
-	o.offsets = append(o.offsets, offset)
+	if o.cnt == nil {
+		o.cnt = make([]uint16, smallRunRegionCnt)
+		o.empty1 = make([]uint64, smallRunRegionCnt/64)
+		o.empty2 = make([]uint64, (smallRunRegionCnt/64+63)/64)
+		for i := range o.empty1 {
+			o.empty1[i] = ^uint64(0)
+		}
+		for i := range o.empty2 {
+			o.empty2[i] = ^uint64(0)
+		}
+	}
+	region := int(offset >> smallRunRegionBits)
+	o.cnt[region]++
+	o.total++
+	if o.cnt[region] == 1 {
+		o.setEmpty(region, false)
+	}
+}
+
+func (o *oneLengthBucket) setEmpty(region int, empty bool) {
+	setBit(o.empty1, region, empty)
+	setBit(o.empty2, region/64, o.empty1[region/64] == ^uint64(0))
 }
 
+// take takes the first continuous free units in the first region having them.
 func (o *oneLengthBucket) take(length unit) (unit, bool) {
 	if length > o.length {
 		panic("unexpected length")
 	}
-	if len(o.offsets) == 0 {
+	if o.total == 0 {
 		return 0, false
 	}
-	offset := o.offsets[len(o.offsets)-1]
-	o.offsets = o.offsets[:len(o.offsets)-1]
+
+	start := unit(nextUnset(o.empty1, o.empty2, 0)) << smallRunRegionBits
+	var (
+		offset unit
+		found  bool
+	)
+	// when the freeSpaces is lazily loaded, the continuous free units that are
+	// not loaded start after the loaded ones, so the first found one is counted
+	forEachFreeRun(o.bitmap, o.summary, start, start+smallRunRegionSize, func(l location) bool {
+		if l.length == o.length {
+			offset, found = l.offset, true
+			return false
+		}
+		return true
+	})
+	if !found {
+		panic("counted continuous free units are not found in bitmap")
+	}
+	o.delete(offset)
 	return offset, true
 }
 
 func (o *oneLengthBucket) delete(offset unit) {
-	idx := slices.Index(o.offsets, offset)
-	o.offsets[idx] = o.offsets[len(o.offsets)-1]
-	o.offsets = o.offsets[:len(o.offsets)-1]
+	region := int(offset >> smallRunRegionBits)
+	if o.total == 0 || o.cnt[region] == 0 {
+		panic("continuous free units to delete are not counted")
+	}
+	o.cnt[region]--
+	o.total--
+	if o.cnt[region] == 0 {
+		o.setEmpty(region, true)
+	}
 }
 
 type location struct {
@@ -277,12 +592,14 @@ var locationPool = sync.Pool{
 type varLengthBucket struct {
 	lengthLowerBound unit
 	locations        []*location
+	index            *extentIndex
 }
 
 func (v *varLengthBucket) put(offset unit, length unit) {
 	l := locationPool.Get().(*location)
 	l.offset = offset
 	l.length = length
+	v.index.insert(extentItem{offset: offset, length: length, pos: len(v.locations)})
 	v.locations = append(v.locations, l)
 }
 
@@ -302,16 +619,27 @@ func (v *varLengthBucket) take(length unit) (unit, bool) {
 	return offset, true
 }
 
+// removeByIdx removes the location at idx from the bucket and keeps the
+// position of the moved location in the index updated. The location is not
+// removed from the index.
+func (v *varLengthBucket) removeByIdx(idx int) {
+	last := len(v.locations) - 1
+	if idx != last {
+		moved, _ := v.index.get(v.locations[last].offset)
+		moved.pos = idx
+	}
+	v.locations[idx], v.locations[last] = v.locations[last], nil
+	v.locations = v.locations[:last]
+}
+
 func (v *varLengthBucket) deleteByIdx(idx int) {
 	toDelete := v.locations[idx]
-	v.locations[idx], v.locations[len(v.locations)-1] = v.locations[len(v.locations)-1], nil
-	v.locations = v.locations[:len(v.locations)-1]
+	v.removeByIdx(idx)
+	v.index.delete(toDelete.offset)
 	locationPool.Put(toDelete)
 }
 
 func (v *varLengthBucket) delete(offset unit) {
-	idx := slices.IndexFunc(v.locations, func(l *location) bool {
-		return l.offset == offset
-	})
-	v.deleteByIdx(idx)
+	item, _ := v.index.get(offset)
+	v.deleteByIdx(item.pos)
 }
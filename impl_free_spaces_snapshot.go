@@ -0,0 +1,104 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// maxSnapshotRunCnt limits the size of the snapshot of freeSpaces to the size
+// of the bitmap. When there are more continuous free spaces, loading the
+// snapshot is not faster than scanning the bitmap so it's not persisted.
+const maxSnapshotRunCnt = bitmapSize / 8
+
+// noMaxContinuousFree is recorded in the snapshot when maxContinuousFree is not
+// valid.
+const noMaxContinuousFree = ^unit(0)
+
+// snapshot serializes the freeSpaces to be loaded by loadFromSnapshot. The
+// layout is, all integers are little-endian:
+//
+//	generation        uint64, the generation of the image it belongs to
+//	maxContinuousFree uint32, the offset, or noMaxContinuousFree
+//	runCnt            uint32
+//	runs              runCnt * {offset uint32, length uint32}
+//
+// The runs in oneLengthBuckets are ordered by offset, followed by the runs in
+// varLengthBuckets ordered by bucket. The order inside a varLengthBucket is
+// kept, so the loaded freeSpaces makes the same allocation decisions. It returns false when
+// there are more than maxSnapshotRunCnt continuous free spaces.
+func (s *freeSpaces) snapshot(generation uint64) ([]byte, bool) {
+	runCnt := s.count()
+	if runCnt > maxSnapshotRunCnt {
+		return nil, false
+	}
+
+	buf := make([]byte, 0, 16+runCnt*8)
+	buf = binary.LittleEndian.AppendUint64(buf, generation)
+	maxContinuousFree := noMaxContinuousFree
+	if s.maxContinuousFree.state == stateValid {
+		maxContinuousFree = s.maxContinuousFree.loc.offset
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(maxContinuousFree))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(runCnt))
+	appendRun := func(offset, length unit) {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(offset))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(length))
+	}
+	s.ascendSmall(func(l location) bool {
+		appendRun(l.offset, l.length)
+		return true
+	})
+	for _, b := range s.buckets[oneLengthBucketThreshold-1:] {
+		for _, l := range b.(*varLengthBucket).locations {
+			appendRun(l.offset, l.length)
+		}
+	}
+	return buf, true
+}
+
+// loadFromSnapshot loads the freeSpaces from the result of snapshot. The
+// freeSpaces should be newly created. generation is the generation of the image,
+// and the snapshot taken at another generation is rejected.
+func (s *freeSpaces) loadFromSnapshot(payload []byte, generation uint64) error {
+	if len(payload) < 16 {
+		return errors.Errorf("snapshot of free spaces is truncated")
+	}
+	if g := binary.LittleEndian.Uint64(payload); g != generation {
+		return errors.Errorf("snapshot of free spaces is taken at generation %d, but image is at generation %d", g, generation)
+	}
+	maxContinuousFree := unit(binary.LittleEndian.Uint32(payload[8:]))
+	runCnt := binary.LittleEndian.Uint32(payload[12:])
+	payload = payload[16:]
+	if uint64(len(payload)) != uint64(runCnt)*8 {
+		return errors.Errorf("snapshot of free spaces has %d bytes for %d runs", len(payload), runCnt)
+	}
+
+	for i := 0; i < len(payload); i += 8 {
+		offset := unit(binary.LittleEndian.Uint32(payload[i:]))
+		length := unit(binary.LittleEndian.Uint32(payload[i+4:]))
+		if length == 0 || uint64(offset)+uint64(length) > unitTotalCnt {
+			return errors.Errorf("free space at unit %d with length %d is out of range", offset, length)
+		}
+		if _, ok := s.index.get(offset); ok {
+			return errors.Errorf("free space at unit %d is duplicated", offset)
+		}
+		s.put(offset, length)
+	}
+
+	if maxContinuousFree == noMaxContinuousFree {
+		return nil
+	}
+	item, ok := s.index.get(maxContinuousFree)
+	if !ok {
+		return errors.Errorf("max continuous free space at unit %d does not exist", maxContinuousFree)
+	}
+	b, ok := s.getBucket(item.length).(*varLengthBucket)
+	if !ok {
+		return errors.Errorf("max continuous free space at unit %d is too short", maxContinuousFree)
+	}
+	s.maxContinuousFree.state = stateValid
+	s.maxContinuousFree.bucket = b
+	s.maxContinuousFree.loc = b.locations[item.pos]
+	return nil
+}
@@ -0,0 +1,69 @@
+package disk_management_demo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreeSpacesSnapshot(t *testing.T) {
+	bitmap := make([]byte, bitmapSize)
+	bitmap[0] = 0b0001_0010
+	bitmap[1] = 0b0111_0001
+	bitmap[bitmapSize/2] = 0b0000_0001
+	bitmap[bitmapSize-1] = 0b1000_0000
+	s := newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	s.rebuildMaxContinuousFree(0)
+	// shrink maxContinuousFree so it's not the first one of its bucket
+	offset, ok := s.take(200)
+	require.True(t, ok)
+	allocInBitmap(bitmap, offset, 200)
+
+	payload, ok := s.snapshot(3)
+	require.True(t, ok)
+	require.Len(t, payload, 16+s.count()*8)
+
+	got := newFreeSpaces(bitmap, nil)
+	require.NoError(t, got.loadFromSnapshot(payload, 3))
+	require.NoError(t, verifyFreeSpaces(got, bitmap, nil))
+	for i := range s.buckets {
+		require.Equal(t, s.buckets[i], got.buckets[i], "bucket %d", i)
+	}
+	require.Equal(t, stateValid, got.maxContinuousFree.state)
+	require.Equal(t, s.maxContinuousFree.bucket, got.maxContinuousFree.bucket)
+	require.Equal(t, s.maxContinuousFree.loc, got.maxContinuousFree.loc)
+	// the same allocation decisions are made
+	for _, length := range []unit{1, 3, 3, 2, 300, 1 << 20} {
+		expected, ok := s.take(length)
+		require.True(t, ok)
+		offset, ok = got.take(length)
+		require.True(t, ok)
+		require.Equal(t, expected, offset)
+		allocInBitmap(bitmap, offset, length)
+	}
+
+	err := newFreeSpaces(bitmap, nil).loadFromSnapshot(payload, 4)
+	require.ErrorContains(t, err, "snapshot of free spaces is taken at generation 3, but image is at generation 4")
+	err = newFreeSpaces(bitmap, nil).loadFromSnapshot(payload[:len(payload)-1], 3)
+	require.ErrorContains(t, err, "snapshot of free spaces has 47 bytes for 6 runs")
+
+	zeros := make([]byte, bitmapSize)
+	s = newFreeSpaces(zeros, nil)
+	s.loadFromBitmap()
+	payload, ok = s.snapshot(1)
+	require.True(t, ok)
+	got = newFreeSpaces(zeros, nil)
+	require.NoError(t, got.loadFromSnapshot(payload, 1))
+	require.Equal(t, stateNeedRebuild, got.maxContinuousFree.state)
+	offset, ok = got.take(1)
+	require.True(t, ok)
+	require.EqualValues(t, 0, offset)
+
+	s = newFreeSpaces(nil, nil)
+	for i := unit(0); i <= maxSnapshotRunCnt; i++ {
+		s.put(i*2, 1)
+	}
+	_, ok = s.snapshot(1)
+	require.False(t, ok)
+}
@@ -1,13 +1,15 @@
 package disk_management_demo
 
 import (
+	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestNewFreeSpaces(t *testing.T) {
-	s := newFreeSpaces()
+	s := newFreeSpaces(nil, nil)
 	require.Len(t, s.buckets, totalBucketCnt)
 
 	b0 := s.buckets[0].(*oneLengthBucket)
@@ -21,23 +23,23 @@ func TestNewFreeSpaces(t *testing.T) {
 }
 
 func TestInitFreeSpaces(t *testing.T) {
-	s := newFreeSpaces()
 	zeros := make([]byte, bitmapSize)
-	s.loadFromBitmap(zeros)
+	s := newFreeSpaces(zeros, nil)
+	s.loadFromBitmap()
 	checkBucketsHasExpectedLengthAndLocations(t, s, map[unit][]*location{
 		unitTotalCnt: {{offset: 0, length: unitTotalCnt}},
 	})
 
-	s = newFreeSpaces()
-	s.loadFromBitmap(ones[:])
+	s = newFreeSpaces(ones[:], nil)
+	s.loadFromBitmap()
 	checkBucketsHasExpectedLengthAndLocations(t, s, nil)
 
 	bitmap := make([]byte, bitmapSize)
-	s = newFreeSpaces()
+	s = newFreeSpaces(bitmap, nil)
 	bitmap[0] = 0b0001_0010
 	bitmap[1] = 0b0111_0001
 	bitmap[bitmapSize-1] = 0b1000_0000
-	s.loadFromBitmap(bitmap)
+	s.loadFromBitmap()
 	checkBucketsHasExpectedLengthAndLocations(t, s, map[unit][]*location{
 		1:                 {{offset: 0, length: 1}},
 		2:                 {{offset: 2, length: 2}},
@@ -47,7 +49,7 @@ func TestInitFreeSpaces(t *testing.T) {
 }
 
 func TestBucket(t *testing.T) {
-	s := newFreeSpaces()
+	s := newFreeSpaces(nil, nil)
 	require.EqualValues(t, 1, s.getBucket(1).(*oneLengthBucket).length)
 	require.EqualValues(t, 127, s.getBucket(127).(*oneLengthBucket).length)
 	require.EqualValues(t, 128, s.getBucket(128).(*varLengthBucket).lengthLowerBound)
@@ -55,3 +57,85 @@ func TestBucket(t *testing.T) {
 	require.EqualValues(t, 256, s.getBucket(256).(*varLengthBucket).lengthLowerBound)
 	require.EqualValues(t, unitTotalCnt, s.getBucket(unitTotalCnt).(*varLengthBucket).lengthLowerBound)
 }
+
+func TestLoadFromBitmapInParallel(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	bitmap := make([]byte, bitmapSize)
+	// long runs crossing the boundaries of loading regions, with some short
+	// runs between them
+	for offset := 0; offset < bitmapSize; {
+		length := rnd.Intn(bitmapSize / loadRegionCnt * 2)
+		end := min(offset+length, bitmapSize)
+		if rnd.Intn(2) == 0 {
+			copy(bitmap[offset:end], ones[:])
+		}
+		_, err := rnd.Read(bitmap[end:min(end+rnd.Intn(64), bitmapSize)])
+		require.NoError(t, err)
+		offset = end + 64
+	}
+	summary := newBitmapSummary(bitmap)
+
+	s := newFreeSpaces(bitmap, summary)
+	s.loadFromBitmap()
+	require.NoError(t, verifyFreeSpaces(s, bitmap, summary))
+}
+
+func TestTakeAligned(t *testing.T) {
+	bitmap := make([]byte, bitmapSize)
+	bitmap[0] = 0b0001_0010
+	bitmap[1] = 0b1111_1111
+	bitmap[2] = 0b0000_0011
+	bitmap[25] = 0b1111_1111
+	bitmap[bitmapSize-1] = 0b1000_0000
+	s := newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	take := func(length, align unit) (unit, bool) {
+		offset, ok := s.takeAligned(length, align)
+		if ok {
+			allocInBitmap(bitmap, offset, length)
+		}
+		return offset, ok
+	}
+
+	// the smallest bucket that can hold it is used, not the small free units
+	offset, ok := take(2, 4)
+	require.True(t, ok)
+	require.EqualValues(t, 20, offset)
+	offset, ok = take(8, 16)
+	require.True(t, ok)
+	require.EqualValues(t, 32, offset)
+	// [40, 200) is not large enough, and the aligned one wastes nothing
+	offset, ok = take(200, 16)
+	require.True(t, ok)
+	require.EqualValues(t, 208, offset)
+	checkBucketsHasExpectedLengthAndLocations(t, s, map[unit][]*location{
+		1:                 {{offset: 0, length: 1}},
+		2:                 {{offset: 2, length: 2}, {offset: 18, length: 2}},
+		3:                 {{offset: 5, length: 3}},
+		10:                {{offset: 22, length: 10}},
+		128:               {{offset: 40, length: 160}},
+		128 * 1024 * 1024: {{offset: 408, length: unitTotalCnt - 409}},
+	})
+
+	// only small free units are left
+	copy(bitmap, ones[:])
+	freeInBitmap(bitmap, 3, 3)
+	freeInBitmap(bitmap, 9, 4)
+	s = newFreeSpaces(bitmap, nil)
+	s.loadFromBitmap()
+	offset, ok = take(2, 4)
+	require.True(t, ok)
+	require.EqualValues(t, 4, offset)
+	_, ok = take(2, 8)
+	require.False(t, ok)
+	_, ok = take(1, 8)
+	require.False(t, ok)
+	offset, ok = take(2, 2)
+	require.True(t, ok)
+	require.EqualValues(t, 10, offset)
+	checkBucketsHasExpectedLengthAndLocations(t, s, map[unit][]*location{
+		1: {{offset: 3, length: 1}, {offset: 9, length: 1}, {offset: 12, length: 1}},
+	})
+}
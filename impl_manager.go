@@ -1,9 +1,6 @@
 package disk_management_demo
 
 import (
-	"io"
-	"os"
-
 	"github.com/pkg/errors"
 )
 
@@ -32,60 +29,291 @@ type unit uint32
 // allocation status of the units. This structure is not thread-safe.
 type diskManagerImpl struct {
 	imageFilePath string
+	// mirrorFilePath is the mirror of the image file, see WithMirror. It's
+	// empty if the image is not mirrored.
+	mirrorFilePath string
 
 	bitmap     [bitmapSize]byte
+	summary    *bitmapSummary
 	freeSpaces *freeSpaces
+	slabs      *slabs
+	reserved   *unitRanges
+	bad        *unitRanges
+	namespaces *namespaces
+	refs       *refCounts
+	// discards is nil unless the manager is created with WithDiscarder.
+	discards *discards
+	// usedUnitCnt is the number of allocated units in bitmap.
+	usedUnitCnt unit
+	// loadedUpTo is the end of the loaded prefix of the bitmap. All continuous
+	// free units that start before it are in freeSpaces. It's unitTotalCnt
+	// unless the manager is lazily loaded, see loadNextRegion.
+	loadedUpTo unit
+	// generation is the generation of the image trailer, which is increased by
+	// every Close.
+	generation uint64
+	// largeAlloc allows the allocations larger than allocLimit, see
+	// WithLargeAlloc.
+	largeAlloc bool
+	// lastSnapshotID is the largest snapshot ID ever assigned, see
+	// takeSnapshot.
+	lastSnapshotID SnapshotID
+	// tiers is the tiers defined by WithTiers, which is empty by default.
+	tiers *tiers
 }
 
 func newDiskManagerImpl(imageFilePath string) (*diskManagerImpl, error) {
-	f, err := os.OpenFile(imageFilePath, os.O_RDWR, 0600)
+	m, err := openDiskManagerImpl(imageFilePath)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
+	}
+	if m.loadedUpTo < unitTotalCnt {
+		m.freeSpaces.loadFromBitmap()
+		m.loadedUpTo = unitTotalCnt
+		m.freeSpaces.rebuildMaxContinuousFree(0)
 	}
-	stat, err := f.Stat()
+	return m, nil
+}
+
+// openDiskManagerImpl reads the image file. freeSpaces is loaded only when the
+// image has a valid snapshot of it, in which case loadedUpTo is unitTotalCnt.
+// Otherwise, caller should call freeSpaces.loadFromBitmap or loadNextRegion
+// before using it.
+func openDiskManagerImpl(imageFilePath string) (*diskManagerImpl, error) {
+	m := &diskManagerImpl{
+		imageFilePath: imageFilePath,
+		slabs:         newSlabs(),
+		reserved:      newReservedRanges(),
+		bad:           newBadRanges(),
+		namespaces:    newNamespaces(),
+		refs:          newRefCounts(),
+		tiers:         &tiers{},
+	}
+	trailer, err := readImage(imageFilePath, m.bitmap[:])
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
-	if s := stat.Size(); s != bitmapSize {
-		return nil, errors.Errorf("file size is not expected: %d", s)
+
+	m.summary = newBitmapSummary(m.bitmap[:])
+	m.freeSpaces = newFreeSpaces(m.bitmap[:], m.summary)
+	m.usedUnitCnt = countOnes(m.bitmap[:])
+	if trailer != nil {
+		m.generation = trailer.generation
+		var problems []string
+		m.slabs, problems = decodeSlabs(trailer.sections[sectionSlabs], m.bitmap[:])
+		if len(problems) > 0 {
+			return nil, errors.Errorf("invalid slabs in image trailer: %s", problems[0])
+		}
+		for _, rs := range []*unitRanges{m.reserved, m.bad} {
+			if err = rs.decodeSection(trailer, m.bitmap[:], m.summary); err != nil {
+				return nil, err
+			}
+		}
+		if err = m.namespaces.decodeSection(trailer, m.bitmap[:], m.summary); err != nil {
+			return nil, err
+		}
+		if err = m.refs.decodeSection(trailer, m.bitmap[:]); err != nil {
+			return nil, err
+		}
+		if m.lastSnapshotID, err = decodeSnapshotSeq(trailer); err != nil {
+			return nil, errors.WithMessage(err, "invalid image trailer")
+		}
+		for _, r := range m.bad.ranges {
+			m.slabs.retire(r.offset, r.length)
+		}
+		m.loadSnapshot(trailer)
 	}
+	return m, nil
+}
 
-	m := &diskManagerImpl{freeSpaces: newFreeSpaces(), imageFilePath: imageFilePath}
-	if _, err = io.ReadAtLeast(f, m.bitmap[:], bitmapSize); err != nil {
-		return nil, errors.WithStack(err)
+// loadSnapshot loads freeSpaces from the snapshot in trailer. readImage has
+// checked that the snapshot is taken with the current bitmap. A broken snapshot
+// is ignored, the caller will load freeSpaces from the bitmap.
+func (d *diskManagerImpl) loadSnapshot(trailer *imageTrailer) {
+	payload, ok := trailer.sections[sectionFreeSpaces]
+	if !ok {
+		return
 	}
-	if err = f.Close(); err != nil {
-		return nil, errors.WithStack(err)
+	if err := d.freeSpaces.loadFromSnapshot(payload, trailer.generation); err != nil {
+		d.freeSpaces = newFreeSpaces(d.bitmap[:], d.summary)
+		return
 	}
-	m.freeSpaces.loadFromBitmap(m.bitmap[:])
-	m.freeSpaces.rebuildMaxContinuousFree(0)
-	return m, nil
+	d.loadedUpTo = unitTotalCnt
+}
+
+// lazyLoadRegionSize is the number of units that loadNextRegion scans at a
+// time.
+const lazyLoadRegionSize = 1024 * 1024
+
+// loadNextRegion loads the continuous free units that start in the next region
+// after loadedUpTo into freeSpaces. It returns false if there's no more region
+// to load.
+func (d *diskManagerImpl) loadNextRegion() bool {
+	if d.loadedUpTo == unitTotalCnt {
+		return false
+	}
+	end := min((d.loadedUpTo+lazyLoadRegionSize)/64*64, unitTotalCnt)
+	newLoadedUpTo := end
+	for _, l := range findFreeRuns(d.bitmap[:], d.summary, d.loadedUpTo, end) {
+		d.freeSpaces.put(l.offset, l.length)
+		// the last one may end after end, and it can be allocated from now on
+		newLoadedUpTo = max(newLoadedUpTo, l.offset+l.length)
+	}
+	d.loadedUpTo = newLoadedUpTo
+	return d.loadedUpTo < unitTotalCnt
+}
+
+// isLoaded returns true if the continuous free units around [offset,
+// offset+length) are all loaded into freeSpaces, so the units can be freed.
+func (d *diskManagerImpl) isLoaded(offset, length unit) bool {
+	return d.loadedUpTo == unitTotalCnt || offset+length < d.loadedUpTo
 }
 
 // Alloc implements Manager.Alloc.
 func (d *diskManagerImpl) Alloc(size int64) (offset int64, _ error) {
-	if size <= 0 {
-		return 0, errors.Errorf("size should be positive, got: %d", size)
+	return d.AllocIn(DefaultNamespace, size)
+}
+
+// AllocIn implements Manager.AllocIn.
+func (d *diskManagerImpl) AllocIn(ns NamespaceID, size int64) (int64, error) {
+	if err := checkAllocSize(size, d.largeAlloc); err != nil {
+		return 0, err
+	}
+	if err := d.namespaces.admit(ns, size, d.freeSize()); err != nil {
+		return 0, err
 	}
+	offset, err := d.alloc(size)
+	if err != nil {
+		return 0, err
+	}
+	d.namespaces.own(ns, offset, size)
+	return offset, nil
+}
+
+// alloc allocates the space of size, which is already checked.
+func (d *diskManagerImpl) alloc(size int64) (int64, error) {
+	if size < unitSize {
+		return d.allocSectors(int(size / sectorSize))
+	}
+
+	cnt := byteSizeToUnitCnt(size)
+	var (
+		unitOffset unit
+		ok         bool
+	)
 	if size > allocLimit {
-		return 0, errors.Errorf("size should be less than 4MiB, got: %d", size)
+		unitOffset, ok = d.freeSpaces.takeBestFit(cnt)
+	} else {
+		unitOffset, ok = d.freeSpaces.take(cnt)
 	}
-	if size%512 != 0 {
-		return 0, errors.Errorf("size should be multiple of 512B, got: %d", size)
+	if !ok {
+		return 0, ErrNoEnoughSpace
+	}
+
+	d.markAllocated(unitOffset, cnt)
+	return unitOffsetToByteOffset(unitOffset), nil
+}
+
+// AllocAligned implements Manager.AllocAligned.
+func (d *diskManagerImpl) AllocAligned(size int64, alignment int64) (int64, error) {
+	if err := checkAllocSize(size, d.largeAlloc); err != nil {
+		return 0, err
+	}
+	if err := checkAlignment(alignment); err != nil {
+		return 0, err
+	}
+	if err := d.namespaces.admit(DefaultNamespace, size, d.freeSize()); err != nil {
+		return 0, err
 	}
 
+	align := byteSizeToUnitCnt(alignment)
+	if size >= unitSize && align == 1 {
+		return d.alloc(size)
+	}
 	cnt := byteSizeToUnitCnt(size)
-	unitOffset, ok := d.freeSpaces.take(cnt)
+	unitOffset, ok := d.freeSpaces.takeAligned(cnt, align)
 	if !ok {
 		return 0, ErrNoEnoughSpace
 	}
+	d.markAllocated(unitOffset, cnt)
+	if size < unitSize {
+		// the existing slabs can't guarantee the alignment, so the sectors are
+		// allocated from the start of a new slab
+		d.slabs.add(unitOffset, int(size/sectorSize))
+	}
+	return unitOffsetToByteOffset(unitOffset), nil
+}
 
-	allocInBitmap(d.bitmap[:], unitOffset, cnt)
+// allocSectors allocates cnt continuous sectors from a slab. A new unit is
+// allocated as a slab when no slab has enough free sectors.
+func (d *diskManagerImpl) allocSectors(cnt int) (int64, error) {
+	if unitOffset, first, ok := d.slabs.take(cnt); ok {
+		return unitOffsetToByteOffset(unitOffset) + int64(first*sectorSize), nil
+	}
+	unitOffset, ok := d.freeSpaces.take(1)
+	if !ok {
+		return 0, ErrNoEnoughSpace
+	}
+	d.markAllocated(unitOffset, 1)
+	d.slabs.add(unitOffset, cnt)
 	return unitOffsetToByteOffset(unitOffset), nil
 }
 
-// Free implements Manager.Free.
-func (d *diskManagerImpl) Free(offset int64, size int64) error {
+// freeSize returns the size of the free units.
+func (d *diskManagerImpl) freeSize() int64 {
+	return unitOffsetToByteOffset(unitTotalCnt - d.usedUnitCnt)
+}
+
+// markAllocated sets the bits of the units in bitmap and maintains the derived
+// summary, counter and discards. freeSpaces is not changed.
+func (d *diskManagerImpl) markAllocated(offset, length unit) {
+	allocInBitmap(d.bitmap[:], offset, length)
+	d.summary.update(d.bitmap[:], offset, length)
+	d.usedUnitCnt += length
+	if d.discards != nil {
+		d.discards.allocated(offset, length)
+	}
+}
+
+// markFree is the opposite of markAllocated.
+func (d *diskManagerImpl) markFree(offset, length unit) {
+	freeInBitmap(d.bitmap[:], offset, length)
+	d.summary.update(d.bitmap[:], offset, length)
+	d.usedUnitCnt -= length
+	if d.discards != nil {
+		d.discards.freed(offset, length)
+	}
+}
+
+// checkAllocSize checks the size of an allocation. The size can be larger than
+// allocLimit only when largeAlloc is true.
+func checkAllocSize(size int64, largeAlloc bool) error {
+	if size <= 0 {
+		return errors.Errorf("size should be positive, got: %d", size)
+	}
+	if size > allocLimit && !largeAlloc {
+		return errors.Errorf("size should be less than 4MiB, got: %d", size)
+	}
+	if size > spaceTotalSize {
+		return errors.Errorf("size should not be larger than 1TiB, got: %d", size)
+	}
+	if size%512 != 0 {
+		return errors.Errorf("size should be multiple of 512B, got: %d", size)
+	}
+	return nil
+}
+
+func checkAlignment(alignment int64) error {
+	if alignment <= 0 || alignment%unitSize != 0 {
+		return errors.Errorf("alignment should be a positive multiple of 4KiB, got: %d", alignment)
+	}
+	if alignment > spaceTotalSize {
+		return errors.Errorf("alignment should not be larger than 1TiB, got: %d", alignment)
+	}
+	return nil
+}
+
+func checkRange(offset int64, size int64) error {
 	if offset < 0 {
 		return errors.Errorf("start offset should be non-negative, got: %d", offset)
 	}
@@ -95,35 +323,442 @@ func (d *diskManagerImpl) Free(offset int64, size int64) error {
 	if offset+size > spaceTotalSize {
 		return errors.Errorf("start offset + size should be less than 1TiB, got: %d", offset+size)
 	}
+	return nil
+}
+
+// Free implements Manager.Free.
+func (d *diskManagerImpl) Free(offset int64, size int64) error {
+	return d.FreeIn(DefaultNamespace, offset, size)
+}
+
+// FreeIn implements Manager.FreeIn.
+func (d *diskManagerImpl) FreeIn(ns NamespaceID, offset int64, size int64) error {
+	if err := checkRange(offset, size); err != nil {
+		return err
+	}
+	if err := d.namespaces.checkFree(ns, offset, size); err != nil {
+		return err
+	}
+	if err := d.free(offset, size); err != nil {
+		return err
+	}
+	d.namespaces.remove(ns, offset)
+	return nil
+}
+
+// free releases the space of [offset, offset+size), which is already checked.
+func (d *diskManagerImpl) free(offset int64, size int64) error {
+	if d.reserved.overlapsBytes(offset, size) {
+		return errors.Errorf("range at %d with size %d overlaps reserved ranges", offset, size)
+	}
+
+	if size < unitSize || offset%unitSize != 0 {
+		return d.freeSectors(offset, size)
+	}
 
 	unitOffset := byteOffsetToUnitOffset(offset)
 	unitCnt := byteSizeToUnitCnt(size)
-	freeInBitmap(d.bitmap[:], unitOffset, unitCnt)
+	if d.slabs.overlaps(unitOffset, unitCnt) {
+		return errors.Errorf("range at %d with size %d contains sub-unit allocations", offset, size)
+	}
+	d.refs.release(unitOffset, unitCnt, d.freeUnits)
+	return nil
+}
 
-	nextUnitIdx := unitOffset + unitCnt
-	// TODO(lance6716): search the offset in in freesSpaces instead of bitmap
-	rightCnt := findLeadingZerosCnt(d.bitmap[:], nextUnitIdx)
-	if rightCnt > 0 {
-		d.freeSpaces.delete(nextUnitIdx, rightCnt)
+// freeSectors frees the sectors of a slab, and frees the unit of the slab when
+// all its sectors are freed.
+func (d *diskManagerImpl) freeSectors(offset int64, size int64) error {
+	if offset%sectorSize != 0 || size%sectorSize != 0 {
+		return errors.Errorf("start offset and size should be multiple of 512B, got: %d, %d", offset, size)
+	}
+	if offset%unitSize+size > unitSize {
+		return errors.Errorf("sub-unit allocation should not cross units, got: %d, %d", offset, size)
 	}
-	leftCnt := findTrailingZerosCnt(d.bitmap[:], unitOffset)
-	if leftCnt > 0 {
-		d.freeSpaces.delete(unitOffset-leftCnt, leftCnt)
+	unitOffset := byteOffsetToUnitOffset(offset)
+	empty, err := d.slabs.release(unitOffset, int(offset%unitSize/sectorSize), int(size/sectorSize))
+	if err != nil {
+		return err
+	}
+	if empty {
+		d.freeUnits(unitOffset, 1)
 	}
-	d.freeSpaces.put(unitOffset-leftCnt, leftCnt+unitCnt+rightCnt)
 	return nil
 }
 
-func (d *diskManagerImpl) Close() error {
-	f, err := os.CreateTemp("", "bitmap")
+// freeUnits frees the units and merges them with the neighbour free units. The
+// bad units are kept allocated.
+func (d *diskManagerImpl) freeUnits(unitOffset, unitCnt unit) {
+	d.bad.gaps(unitOffset, unitCnt, func(unitOffset, unitCnt unit) {
+		d.markFree(unitOffset, unitCnt)
+
+		left, right := d.freeSpaces.neighbours(unitOffset, unitCnt)
+		if right.length > 0 {
+			d.freeSpaces.delete(right.offset, right.length)
+		}
+		if left.length > 0 {
+			d.freeSpaces.delete(left.offset, left.length)
+		}
+		d.freeSpaces.put(unitOffset-left.length, left.length+unitCnt+right.length)
+	})
+}
+
+// takeUnits allocates the free units, which are taken out of freeSpaces.
+func (d *diskManagerImpl) takeUnits(unitOffset, unitCnt unit) {
+	left, right := d.freeSpaces.neighbours(unitOffset, unitCnt)
+	d.freeSpaces.split(location{
+		offset: left.offset,
+		length: left.length + unitCnt + right.length,
+	}, unitOffset, unitCnt)
+	d.markAllocated(unitOffset, unitCnt)
+}
+
+// ReserveRange implements Manager.ReserveRange.
+func (d *diskManagerImpl) ReserveRange(offset int64, size int64) error {
+	if err := checkReservedRange(offset, size); err != nil {
+		return err
+	}
+	unitOffset := byteOffsetToUnitOffset(offset)
+	unitCnt := byteSizeToUnitCnt(size)
+	if d.summary.findLeadingBitsCnt(d.bitmap[:], unitOffset, false) < unitCnt {
+		return errors.Errorf("range at %d with size %d is not free", offset, size)
+	}
+	d.takeUnits(unitOffset, unitCnt)
+	d.reserved.add(unitOffset, unitCnt)
+	return nil
+}
+
+// AllocRange implements RangeAllocator.AllocRange.
+func (d *diskManagerImpl) AllocRange(offset int64, size int64) error {
+	if err := checkRange(offset, size); err != nil {
+		return err
+	}
+	if offset%unitSize != 0 || size%unitSize != 0 {
+		return errors.Errorf("range should be aligned to 4KiB, got: %d, %d", offset, size)
+	}
+	unitOffset := byteOffsetToUnitOffset(offset)
+	unitCnt := byteSizeToUnitCnt(size)
+	if d.summary.findLeadingBitsCnt(d.bitmap[:], unitOffset, false) < unitCnt {
+		return errors.Errorf("range at %d with size %d is not free", offset, size)
+	}
+	d.takeUnits(unitOffset, unitCnt)
+	return nil
+}
+
+// UnreserveRange implements Manager.UnreserveRange.
+func (d *diskManagerImpl) UnreserveRange(offset int64, size int64) error {
+	if err := checkReservedRange(offset, size); err != nil {
+		return err
+	}
+	unitOffset := byteOffsetToUnitOffset(offset)
+	unitCnt := byteSizeToUnitCnt(size)
+	if err := d.reserved.remove(unitOffset, unitCnt); err != nil {
+		return err
+	}
+	d.freeUnits(unitOffset, unitCnt)
+	return nil
+}
+
+// MarkBad implements Manager.MarkBad.
+func (d *diskManagerImpl) MarkBad(offset int64, size int64) error {
+	if err := checkRange(offset, size); err != nil {
+		return err
+	}
+	if d.reserved.overlapsBytes(offset, size) {
+		return errors.Errorf("range at %d with size %d overlaps reserved ranges", offset, size)
+	}
+	unitOffset := byteOffsetToUnitOffset(offset)
+	unitCnt := byteSizeToUnitCnt(offset+size) - unitOffset
+	freeRunsIn(d.bitmap[:], d.summary, unitOffset, unitCnt, func(l location) {
+		d.takeUnits(l.offset, l.length)
+	})
+	d.slabs.retire(unitOffset, unitCnt)
+	d.bad.add(unitOffset, unitCnt)
+	return nil
+}
+
+// IncRef implements Manager.IncRef.
+func (d *diskManagerImpl) IncRef(offset int64, size int64) error {
+	unitOffset, unitCnt, err := d.checkShared(offset, size)
+	if err != nil {
+		return err
+	}
+	if err = d.refs.checkInc(unitOffset, unitCnt, d.bad); err != nil {
+		return err
+	}
+	d.refs.inc(unitOffset, unitCnt)
+	return nil
+}
+
+// DecRef implements Manager.DecRef.
+func (d *diskManagerImpl) DecRef(offset int64, size int64) error {
+	unitOffset, unitCnt, err := d.checkShared(offset, size)
+	if err != nil {
+		return err
+	}
+	d.refs.release(unitOffset, unitCnt, d.freeUnits)
+	return nil
+}
+
+// checkShared checks the range of IncRef and DecRef, see checkShared. The range
+// also should not contain the sub-unit allocations.
+func (d *diskManagerImpl) checkShared(offset int64, size int64) (unit, unit, error) {
+	unitOffset, unitCnt, err := checkShared(offset, size, d.bitmap[:], d.summary, d.reserved, d.namespaces)
+	if err != nil {
+		return 0, 0, err
+	}
+	if d.slabs.overlaps(unitOffset, unitCnt) {
+		return 0, 0, errors.Errorf("range at %d with size %d contains sub-unit allocations", offset, size)
+	}
+	return unitOffset, unitCnt, nil
+}
+
+// SetNamespace implements Manager.SetNamespace.
+func (d *diskManagerImpl) SetNamespace(ns NamespaceID, quota int64, reservation int64) error {
+	return d.namespaces.set(ns, quota, reservation, d.freeSize())
+}
+
+// NamespaceStats implements Manager.NamespaceStats.
+func (d *diskManagerImpl) NamespaceStats(ns NamespaceID) (NamespaceStats, error) {
+	return d.namespaces.stats(ns)
+}
+
+// Snapshot implements Manager.Snapshot. The snapshot has the trailer of the
+// current generation, which is not increased.
+func (d *diskManagerImpl) Snapshot() (SnapshotID, error) {
+	id, err := takeSnapshot(d.imageFilePath, d.bitmap[:], d.trailer(), d.lastSnapshotID)
 	if err != nil {
-		return errors.WithStack(err)
+		return 0, err
+	}
+	d.lastSnapshotID = id
+	return id, nil
+}
+
+// ListSnapshots implements Manager.ListSnapshots.
+func (d *diskManagerImpl) ListSnapshots() ([]SnapshotInfo, error) {
+	return listSnapshots(d.imageFilePath)
+}
+
+// DeleteSnapshot implements Manager.DeleteSnapshot.
+func (d *diskManagerImpl) DeleteSnapshot(id SnapshotID) error {
+	return deleteSnapshot(d.imageFilePath, id)
+}
+
+// RestoreSnapshot implements Manager.RestoreSnapshot. freeSpaces is rebuilt
+// from the restored bitmap, so the restored manager is fully loaded.
+func (d *diskManagerImpl) RestoreSnapshot(id SnapshotID) error {
+	path, err := checkSnapshotExists(d.imageFilePath, id)
+	if err != nil {
+		return err
+	}
+	r, err := openDiskManagerImpl(path)
+	if err != nil {
+		return errors.WithMessagef(err, "snapshot %d is broken", id)
+	}
+
+	// the derived structures refer to the bitmap, so they are built again on
+	// d.bitmap
+	d.bitmap = r.bitmap
+	d.summary = newBitmapSummary(d.bitmap[:])
+	d.freeSpaces = newFreeSpaces(d.bitmap[:], d.summary)
+	d.freeSpaces.loadFromBitmap()
+	d.freeSpaces.rebuildMaxContinuousFree(0)
+	d.loadedUpTo = unitTotalCnt
+	d.slabs = r.slabs
+	d.reserved = r.reserved
+	d.bad = r.bad
+	d.namespaces = r.namespaces
+	d.refs = r.refs
+	d.usedUnitCnt = r.usedUnitCnt
+	if d.discards != nil {
+		// the units may be allocated in the snapshot
+		d.discards.reset()
+	}
+	return nil
+}
+
+// DiffSnapshots implements Manager.DiffSnapshots.
+func (d *diskManagerImpl) DiffSnapshots(from, to SnapshotID) ([]Extent, error) {
+	return diffSnapshots(d.imageFilePath, from, to)
+}
+
+// IsAllocated implements Manager.IsAllocated.
+func (d *diskManagerImpl) IsAllocated(offset int64, size int64) (bool, error) {
+	if err := checkRange(offset, size); err != nil {
+		return false, err
+	}
+
+	unitOffset := byteOffsetToUnitOffset(offset)
+	if s, ok := d.slabs.units[unitOffset]; ok && offset%unitSize+size <= unitSize {
+		first := offset % unitSize / sectorSize
+		last := (offset%unitSize + size - 1) / sectorSize
+		mask := sectorMask(int(first), int(last-first+1))
+		return s.mask&mask == mask, nil
+	}
+	unitCnt := byteSizeToUnitCnt(offset%unitSize + size)
+	return d.summary.findLeadingBitsCnt(d.bitmap[:], unitOffset, true) >= unitCnt, nil
+}
+
+// Stats implements Manager.Stats.
+func (d *diskManagerImpl) Stats() Stats {
+	return Stats{
+		TotalSize:       spaceTotalSize,
+		UnitSize:        unitSize,
+		UsedSize:        unitOffsetToByteOffset(d.usedUnitCnt - d.reserved.total - d.bad.total),
+		FreeSize:        d.freeSize(),
+		ReservedSize:    unitOffsetToByteOffset(d.reserved.total),
+		BadSize:         unitOffsetToByteOffset(d.bad.total),
+		LargestFreeSize: unitOffsetToByteOffset(d.freeSpaces.largest()),
+		FreeExtentCnt:   int64(d.freeSpaces.count()),
+		FreeHistogram:   d.freeSpaces.histogram(),
+	}
+}
+
+// Extents implements Manager.Extents.
+func (d *diskManagerImpl) Extents(fn func(e Extent) bool) {
+	extents(d.bitmap[:], d.summary, d.reserved, d.bad, d.slabs, d.namespaces, d.refs, fn)
+}
+
+// extents calls fn for every continuous units of the same allocation status in
+// bitmap until fn returns false. The reserved and bad units are reported
+// separately from their allocated neighbours, and so are the allocated units of
+// slabs, namespaces and ref counts. ss can be nil if there's no slab.
+func extents(
+	bitmap []byte,
+	summary *bitmapSummary,
+	reserved, bad *unitRanges,
+	ss *slabs,
+	nss *namespaces,
+	refs *refCounts,
+	fn func(e Extent) bool,
+) {
+	for offset := unit(0); offset < unitTotalCnt; {
+		var (
+			e      Extent
+			length unit
+		)
+		nextReserved, hasReserved := reserved.next(offset)
+		nextBad, hasBad := bad.next(offset)
+		switch {
+		case hasReserved && nextReserved.offset <= offset:
+			e.Allocated, e.Reserved = true, true
+			length = nextReserved.offset + nextReserved.length - offset
+		case hasBad && nextBad.offset <= offset:
+			e.Allocated, e.Bad = true, true
+			length = nextBad.offset + nextBad.length - offset
+		default:
+			e.Allocated = bitmap[offset/8]&(1<<(offset%8)) != 0
+			length = summary.findLeadingBitsCnt(bitmap, offset, e.Allocated)
+			if e.Allocated && hasReserved {
+				length = min(length, nextReserved.offset-offset)
+			}
+			if e.Allocated && hasBad {
+				length = min(length, nextBad.offset-offset)
+			}
+			if e.Allocated {
+				length = describeAllocated(&e, offset, length, ss, nss, refs)
+			}
+		}
+		e.Offset = unitOffsetToByteOffset(offset)
+		e.Size = unitOffsetToByteOffset(length)
+		if !fn(e) {
+			return
+		}
+		offset += length
+	}
+}
+
+// describeAllocated sets the slab, namespace and ref count status of the
+// allocated units starting from offset in e, and returns the number of the
+// units of the same status, which is at most length.
+func describeAllocated(e *Extent, offset, length unit, ss *slabs, nss *namespaces, refs *refCounts) unit {
+	if ss != nil {
+		ss.index.ascendFrom(offset, func(s *slab) bool {
+			if s.offset == offset {
+				e.Packed = true
+				length = 1
+			} else {
+				length = min(length, s.offset-offset)
+			}
+			return false
+		})
+		if e.Packed {
+			// the sectors of a slab may belong to different namespaces
+			return length
+		}
+	}
+	if a, ok := nss.first(unitOffsetToByteOffset(offset)); ok {
+		start := byteOffsetToUnitOffset(a.offset)
+		if start <= offset {
+			e.Namespace = a.ns
+			length = min(length, byteSizeToUnitCnt(a.offset+a.size)-offset)
+		} else {
+			length = min(length, start-offset)
+		}
+	}
+	refs.in(offset, length, func(r refCountRun) bool {
+		if r.offset <= offset {
+			e.Shared = true
+			length = min(length, r.offset+r.length-offset)
+		} else {
+			length = min(length, r.offset-offset)
+		}
+		return false
+	})
+	return length
+}
+
+// Close writes the bitmap and a new generation of trailer to the image file,
+// and then to its mirror. If the latter fails, the mirror is resynchronized when
+// the image is opened again.
+func (d *diskManagerImpl) Close() error {
+	trailer := d.checkpointTrailer().encode()
+	if err := writeFileAtomically(d.imageFilePath, d.bitmap[:], trailer); err != nil {
+		return err
+	}
+	if d.mirrorFilePath == "" {
+		return nil
+	}
+	return errors.WithMessage(
+		writeFileAtomically(d.mirrorFilePath, d.bitmap[:], trailer),
+		"failed to write the mirror of image",
+	)
+}
+
+// checkpointTrailer returns the trailer of the next generation.
+func (d *diskManagerImpl) checkpointTrailer() *imageTrailer {
+	d.generation++
+	return d.trailer()
+}
+
+// trailer returns the trailer of the current generation. The snapshot of
+// freeSpaces is included when it's fully loaded and not too large.
+func (d *diskManagerImpl) trailer() *imageTrailer {
+	t := &imageTrailer{
+		generation: d.generation,
+		bitmapCRC:  bitmapCRC(d.bitmap[:]),
+		sections:   map[sectionKind][]byte{},
+	}
+	if len(d.slabs.units) > 0 {
+		t.sections[sectionSlabs] = d.slabs.encode()
+	}
+	for _, rs := range []*unitRanges{d.reserved, d.bad} {
+		if len(rs.ranges) > 0 {
+			t.sections[rs.kind] = rs.encode()
+		}
+	}
+	if len(d.namespaces.defs) > 0 {
+		t.sections[sectionNamespaces] = d.namespaces.encode()
+	}
+	if !d.refs.empty() {
+		t.sections[sectionRefCounts] = d.refs.encode()
 	}
-	if _, err = f.Write(d.bitmap[:]); err != nil {
-		return errors.WithStack(err)
+	if d.lastSnapshotID > 0 {
+		t.sections[sectionSnapshotSeq] = encodeSnapshotSeq(d.lastSnapshotID)
 	}
-	if err = f.Close(); err != nil {
-		return errors.WithStack(err)
+	if d.loadedUpTo == unitTotalCnt {
+		if payload, ok := d.freeSpaces.snapshot(d.generation); ok {
+			t.sections[sectionFreeSpaces] = payload
+		}
 	}
-	return errors.WithStack(os.Rename(f.Name(), d.imageFilePath))
+	return t
 }
@@ -1,36 +1,379 @@
 package disk_management_demo
 
-import "sync"
+import (
+	"context"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
+)
+
+// diskManager2 wraps diskManagerImpl to be thread-safe. Alloc and Free are
+// serialized by an exclusive lock, while the read-only queries share the lock
+// so they can run concurrently with each other.
 type diskManager2 struct {
 	m  *diskManagerImpl
-	mu *sync.Mutex
+	mu *sync.RWMutex
+
+	// below fields are only used with WithLazyRecovery
+
+	// loaded is broadcast when the background loading makes progress.
+	loaded     *sync.Cond
+	loaderDone chan struct{}
+	closed     bool
+
+	// below fields are only used with WithDiscarder
+
+	discardDelay time.Duration
+	// stopDiscard is closed to stop the background discarding when the delay is
+	// positive.
+	stopDiscard chan struct{}
+	discardDone chan struct{}
 }
 
-func newDiskManagerWithMutexImpl(imageFilePath string) (*diskManager2, error) {
-	m, err := newDiskManagerImpl(imageFilePath)
+func newDiskManagerWithMutexImpl(imageFilePath string, opts ...Option) (*diskManager2, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ts, err := newTiers(o.tiers)
 	if err != nil {
 		return nil, err
 	}
-	return &diskManager2{m: m, mu: &sync.Mutex{}}, nil
+	var m *diskManagerImpl
+	if o.mirror != "" {
+		if _, err = resyncMirror(imageFilePath, o.mirror); err != nil {
+			return nil, errors.WithMessage(err, "failed to resynchronize the mirror of image")
+		}
+	}
+	if o.lazyRecovery {
+		m, err = openDiskManagerImpl(imageFilePath)
+	} else {
+		m, err = newDiskManagerImpl(imageFilePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.largeAlloc = o.largeAlloc
+	m.mirrorFilePath = o.mirror
+	m.tiers = ts
+	d := &diskManager2{m: m, mu: &sync.RWMutex{}}
+	if o.discarder != nil {
+		m.discards = newDiscards(o.discarder)
+		d.discardDelay = o.discardDelay
+		if d.discardDelay > 0 {
+			d.stopDiscard = make(chan struct{})
+			d.discardDone = make(chan struct{})
+			go d.discardInBackground()
+		}
+	}
+	if o.lazyRecovery {
+		d.loaderDone = make(chan struct{})
+		d.loaded = sync.NewCond(d.mu)
+		go d.loadInBackground()
+	}
+	return d, nil
 }
 
 func NewDiskManagerImpl(imageFilePath string) (Manager, error) {
 	return newDiskManagerWithMutexImpl(imageFilePath)
 }
 
+// NewDiskManagerWithOptions is like NewDiskManagerImpl, but it can be configured
+// by options.
+func NewDiskManagerWithOptions(imageFilePath string, opts ...Option) (Manager, error) {
+	return newDiskManagerWithMutexImpl(imageFilePath, opts...)
+}
+
+func (d *diskManager2) loadInBackground() {
+	defer close(d.loaderDone)
+	for {
+		d.mu.Lock()
+		more := !d.closed && d.m.loadNextRegion()
+		d.loaded.Broadcast()
+		d.mu.Unlock()
+		if !more {
+			return
+		}
+	}
+}
+
+func (d *diskManager2) discardInBackground() {
+	defer close(d.discardDone)
+	ticker := time.NewTicker(d.discardDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopDiscard:
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			d.m.discards.flush(false)
+			d.mu.Unlock()
+		}
+	}
+}
+
+// discardNow discards the released units at once if the delay is zero. It
+// should be called with the exclusive lock held, so the units are not allocated
+// again before being discarded.
+func (d *diskManager2) discardNow() {
+	if d.m.discards != nil && d.discardDelay == 0 {
+		d.m.discards.flush(true)
+	}
+}
+
+// waitLoaded waits for the background loading until cond returns true or all
+// are loaded. It should be called with the exclusive lock held.
+func (d *diskManager2) waitLoaded(cond func() bool) error {
+	for d.m.loadedUpTo < unitTotalCnt && !cond() {
+		if d.closed {
+			return errors.New("manager is closed")
+		}
+		d.loaded.Wait()
+	}
+	return nil
+}
+
 func (d *diskManager2) Alloc(size int64) (startOffset int64, err error) {
+	return d.allocWithRetry(func() (int64, error) {
+		return d.m.Alloc(size)
+	})
+}
+
+func (d *diskManager2) AllocAligned(size int64, alignment int64) (startOffset int64, err error) {
+	return d.allocWithRetry(func() (int64, error) {
+		return d.m.AllocAligned(size, alignment)
+	})
+}
+
+func (d *diskManager2) AllocIn(ns NamespaceID, size int64) (startOffset int64, err error) {
+	return d.allocWithRetry(func() (int64, error) {
+		return d.m.AllocIn(ns, size)
+	})
+}
+
+// allocWithRetry calls alloc with the exclusive lock held. When lazily loading,
+// alloc is retried after more free spaces are loaded if it returns
+// ErrNoEnoughSpace.
+func (d *diskManager2) allocWithRetry(alloc func() (int64, error)) (startOffset int64, err error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	return d.m.Alloc(size)
+	for {
+		startOffset, err = alloc()
+		if !errors.Is(err, ErrNoEnoughSpace) || d.m.loadedUpTo == unitTotalCnt {
+			return startOffset, err
+		}
+		// some free spaces are not loaded yet
+		loadedUpTo := d.m.loadedUpTo
+		if err = d.waitLoaded(func() bool { return d.m.loadedUpTo > loadedUpTo }); err != nil {
+			return 0, err
+		}
+	}
 }
 
 func (d *diskManager2) Free(startOffset int64, size int64) error {
+	return d.changeLoaded(startOffset, size, d.m.Free)
+}
+
+func (d *diskManager2) FreeIn(ns NamespaceID, startOffset int64, size int64) error {
+	return d.changeLoaded(startOffset, size, func(startOffset int64, size int64) error {
+		return d.m.FreeIn(ns, startOffset, size)
+	})
+}
+
+func (d *diskManager2) IncRef(startOffset int64, size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m.IncRef(startOffset, size)
+}
+
+func (d *diskManager2) DecRef(startOffset int64, size int64) error {
+	return d.changeLoaded(startOffset, size, d.m.DecRef)
+}
+
+func (d *diskManager2) SetNamespace(ns NamespaceID, quota int64, reservation int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m.SetNamespace(ns, quota, reservation)
+}
+
+func (d *diskManager2) NamespaceStats(ns NamespaceID) (NamespaceStats, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.m.NamespaceStats(ns)
+}
+
+func (d *diskManager2) ReserveRange(startOffset int64, size int64) error {
+	return d.changeLoaded(startOffset, size, d.m.ReserveRange)
+}
+
+func (d *diskManager2) AllocRange(startOffset int64, size int64) error {
+	return d.changeLoaded(startOffset, size, d.m.AllocRange)
+}
+
+func (d *diskManager2) UnreserveRange(startOffset int64, size int64) error {
+	return d.changeLoaded(startOffset, size, d.m.UnreserveRange)
+}
+
+func (d *diskManager2) MarkBad(startOffset int64, size int64) error {
+	return d.changeLoaded(startOffset, size, d.m.MarkBad)
+}
+
+// changeLoaded calls change with the exclusive lock held, after the continuous
+// free units around [startOffset, startOffset+size) are loaded.
+func (d *diskManager2) changeLoaded(
+	startOffset int64,
+	size int64,
+	change func(startOffset int64, size int64) error,
+) error {
+	if err := checkRange(startOffset, size); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.waitLoaded(func() bool {
+		return d.m.isLoaded(byteOffsetToUnitOffset(startOffset), byteSizeToUnitCnt(startOffset%unitSize+size))
+	})
+	if err != nil {
+		return err
+	}
+	defer d.discardNow()
+	return change(startOffset, size)
+}
+
+func (d *diskManager2) Snapshot() (SnapshotID, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m.Snapshot()
+}
+
+func (d *diskManager2) ListSnapshots() ([]SnapshotInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.m.ListSnapshots()
+}
+
+func (d *diskManager2) DeleteSnapshot(id SnapshotID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m.DeleteSnapshot(id)
+}
+
+// RestoreSnapshot implements Manager.RestoreSnapshot. The background loading
+// stops because the restored manager is fully loaded.
+func (d *diskManager2) RestoreSnapshot(id SnapshotID) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	return d.m.Free(startOffset, size)
+	if err := d.m.RestoreSnapshot(id); err != nil {
+		return err
+	}
+	if d.loaded != nil {
+		d.loaded.Broadcast()
+	}
+	return nil
+}
+
+func (d *diskManager2) DiffSnapshots(from, to SnapshotID) ([]Extent, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.m.DiffSnapshots(from, to)
 }
 
+// Defragment implements Defragmenter.Defragment. It waits for the background
+// loading to finish, because the moves need all continuous free spaces.
+func (d *diskManager2) Defragment(
+	ctx context.Context,
+	budget int64,
+	relocate RelocateFunc,
+	opts ...DefragOption,
+) ([]Relocation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.waitLoaded(func() bool { return false }); err != nil {
+		return nil, err
+	}
+	defer d.discardNow()
+	return d.m.Defragment(ctx, budget, relocate, opts...)
+}
+
+// AllocInTier implements TierAllocator.AllocInTier. It waits for the
+// background loading to finish, because the free units of the tier should be
+// in freeSpaces to be taken.
+func (d *diskManager2) AllocInTier(size int64, tier string, fallback bool) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.waitLoaded(func() bool { return false }); err != nil {
+		return 0, err
+	}
+	return d.m.AllocInTier(size, tier, fallback)
+}
+
+func (d *diskManager2) TierStats(tier string) (TierStats, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.m.TierStats(tier)
+}
+
+// MigrateToTier implements TierAllocator.MigrateToTier. Like AllocInTier, it
+// waits for the background loading to finish.
+func (d *diskManager2) MigrateToTier(startOffset, size int64, tier string, relocate RelocateFunc) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.waitLoaded(func() bool { return false }); err != nil {
+		return 0, err
+	}
+	defer d.discardNow()
+	return d.m.MigrateToTier(startOffset, size, tier, relocate)
+}
+
+func (d *diskManager2) IsAllocated(startOffset int64, size int64) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.m.IsAllocated(startOffset, size)
+}
+
+func (d *diskManager2) Stats() Stats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.m.Stats()
+}
+
+func (d *diskManager2) currentFreeSize() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.m.freeSize()
+}
+
+func (d *diskManager2) Extents(fn func(e Extent) bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	d.m.Extents(fn)
+}
+
+// Close implements Manager.Close. The units that are not discarded yet are
+// discarded after the image is written. The units discarded before Close are
+// still recorded allocated by the image on disk until it's written, so their
+// content is lost if the Manager crashes and the caller keeps using them.
 func (d *diskManager2) Close() error {
-	return d.m.Close()
+	if d.loaderDone != nil {
+		d.mu.Lock()
+		d.closed = true
+		d.loaded.Broadcast()
+		d.mu.Unlock()
+		<-d.loaderDone
+	}
+	if d.stopDiscard != nil {
+		close(d.stopDiscard)
+		<-d.discardDone
+	}
+	if err := d.m.Close(); err != nil {
+		return err
+	}
+	if d.m.discards == nil {
+		return nil
+	}
+	d.m.discards.flush(true)
+	return d.m.discards.err
 }
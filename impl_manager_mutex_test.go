@@ -1,6 +1,11 @@
 package disk_management_demo
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
 	"testing"
 	"time"
 
@@ -28,3 +33,254 @@ func TestAllocDuration2(t *testing.T) {
 
 	t.Logf("%d Allocs took %s, %s/alloc", expectedCnt, elapsed, elapsed/time.Duration(expectedCnt))
 }
+
+func TestConcurrentQueries(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := newDiskManagerWithMutexImpl(tempFile)
+	require.NoError(t, err)
+
+	var (
+		writerWG sync.WaitGroup
+		readerWG sync.WaitGroup
+		done     = make(chan struct{})
+		// the goroutines can't call require, so they report the first error
+		writerErrs = make([]error, 4)
+		readerErrs = make([]error, 4)
+	)
+	for i := 0; i < 4; i++ {
+		writerWG.Add(1)
+		go func(i int) {
+			defer writerWG.Done()
+			writerErrs[i] = func() error {
+				for j := 0; j < 200; j++ {
+					offset, err := m.Alloc(unitSize)
+					if err != nil {
+						return err
+					}
+					allocated, err := m.IsAllocated(offset, unitSize)
+					if err != nil {
+						return err
+					}
+					if !allocated {
+						return fmt.Errorf("offset %d is not allocated", offset)
+					}
+					if err = m.Free(offset, unitSize); err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		readerWG.Add(1)
+		go func(i int) {
+			defer readerWG.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				stats := m.Stats()
+				if stats.TotalSize != stats.UsedSize+stats.FreeSize {
+					readerErrs[i] = fmt.Errorf("inconsistent stats: %+v", stats)
+					return
+				}
+				if _, err := m.IsAllocated(0, unitSize); err != nil {
+					readerErrs[i] = err
+					return
+				}
+			}
+		}(i)
+	}
+	writerWG.Wait()
+	close(done)
+	readerWG.Wait()
+	for _, err := range append(writerErrs, readerErrs...) {
+		require.NoError(t, err)
+	}
+
+	require.Zero(t, m.Stats().UsedSize)
+	cnt := 0
+	m.Extents(func(e Extent) bool {
+		require.False(t, e.Allocated)
+		cnt++
+		return true
+	})
+	require.Equal(t, 1, cnt)
+}
+
+func TestLazyRecovery(t *testing.T) {
+	bitmap := make([]byte, bitmapSize)
+	copy(bitmap, ones[:])
+	// free spaces at the beginning, the middle and the end
+	bitmap[0] = 0
+	bitmap[bitmapSize/2] = 0b1111_0000
+	bitmap[bitmapSize-1] = 0b1000_0111
+	tempFile := createFileWithContent(t, bitmap)
+
+	m, err := newDiskManagerWithMutexImpl(tempFile, WithLazyRecovery())
+	require.NoError(t, err)
+
+	// freeing the last unit waits for it to be loaded, and it's merged with its
+	// left neighbour
+	require.NoError(t, m.Free((unitTotalCnt-1)*unitSize, unitSize))
+	offset, err := m.Alloc(5 * unitSize)
+	require.NoError(t, err)
+	require.EqualValues(t, (unitTotalCnt-5)*unitSize, offset)
+
+	offset, err = m.Alloc(8 * unitSize)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, offset)
+	offset, err = m.Alloc(4 * unitSize)
+	require.NoError(t, err)
+	require.EqualValues(t, unitTotalCnt/2*unitSize, offset)
+	_, err = m.Alloc(unitSize)
+	require.ErrorIs(t, err, ErrNoEnoughSpace)
+	require.Zero(t, m.Stats().FreeSize)
+
+	require.NoError(t, m.Close())
+	got, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	require.Equal(t, ones[:], got[:bitmapSize])
+}
+
+func TestRestoreSnapshotDuringLazyRecovery(t *testing.T) {
+	bitmap := make([]byte, bitmapSize)
+	copy(bitmap, ones[:])
+	bitmap[bitmapSize-1] = 0b1000_0000
+	tempFile := createFileWithContent(t, bitmap)
+
+	m, err := newDiskManagerWithMutexImpl(tempFile, WithLazyRecovery())
+	require.NoError(t, err)
+	id, err := m.Snapshot()
+	require.NoError(t, err)
+	require.NoError(t, m.Free(0, unitSize))
+
+	// the restored manager is fully loaded
+	require.NoError(t, m.RestoreSnapshot(id))
+	allocated, err := m.IsAllocated(0, unitSize)
+	require.NoError(t, err)
+	require.True(t, allocated)
+	require.EqualValues(t, 7*unitSize, m.Stats().FreeSize)
+	require.EqualValues(t, 7*unitSize, m.Stats().LargestFreeSize)
+	require.NoError(t, verifyFreeSpaces(m.m.freeSpaces, m.m.bitmap[:], m.m.summary))
+	require.NoError(t, m.Close())
+}
+
+func TestCloseDuringLazyRecovery(t *testing.T) {
+	bitmap := make([]byte, bitmapSize)
+	bitmap[0] = 1
+	tempFile := createFileWithContent(t, bitmap)
+
+	m, err := newDiskManagerWithMutexImpl(tempFile, WithLazyRecovery())
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	m, err = newDiskManagerWithMutexImpl(tempFile)
+	require.NoError(t, err)
+	allocated, err := m.IsAllocated(0, unitSize)
+	require.NoError(t, err)
+	require.True(t, allocated)
+	require.EqualValues(t, unitSize, m.Stats().UsedSize)
+	require.NoError(t, verifyFreeSpaces(m.m.freeSpaces, m.m.bitmap[:], m.m.summary))
+}
+
+func TestLargeAlloc(t *testing.T) {
+	const mib = 1024 * 1024
+	tempFile := createFileWithContent(t, nil)
+	m, err := newDiskManagerWithMutexImpl(tempFile)
+	require.NoError(t, err)
+	_, err = m.Alloc(64 * mib)
+	require.ErrorContains(t, err, "size should be less than 4MiB, got: 67108864")
+	require.NoError(t, m.Close())
+
+	m, err = newDiskManagerWithMutexImpl(tempFile, WithLargeAlloc())
+	require.NoError(t, err)
+	_, err = m.Alloc(2 * spaceTotalSize)
+	require.ErrorContains(t, err, "size should not be larger than 1TiB, got: 2199023255552")
+
+	sizes := []int64{256 * mib, 64 * mib, 128 * mib, 64 * mib}
+	offsets := make([]int64, 0, len(sizes))
+	for _, size := range sizes {
+		offset, err := m.Alloc(size)
+		require.NoError(t, err)
+		offsets = append(offsets, offset)
+	}
+	require.Equal(t, []int64{0, 256 * mib, 320 * mib, 448 * mib}, offsets)
+	require.NoError(t, m.Free(0, 256*mib))
+	require.NoError(t, m.Free(320*mib, 128*mib))
+
+	// the smallest free space that can hold them is used
+	offset, err := m.Alloc(100 * mib)
+	require.NoError(t, err)
+	require.EqualValues(t, 320*mib, offset)
+	offset, err = m.Alloc(200 * mib)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, offset)
+	offset, err = m.AllocAligned(20*mib, 16*mib)
+	require.NoError(t, err)
+	require.EqualValues(t, 208*mib, offset)
+	// the small allocations are still served from maxContinuousFree
+	offset, err = m.Alloc(4 * mib)
+	require.NoError(t, err)
+	require.EqualValues(t, 512*mib, offset)
+
+	require.EqualValues(t, 200*mib+100*mib+64*mib*2+20*mib+4*mib, m.Stats().UsedSize)
+	require.NoError(t, verifyFreeSpaces(m.m.freeSpaces, m.m.bitmap[:], m.m.summary))
+	_, err = m.Alloc(spaceTotalSize)
+	require.ErrorIs(t, err, ErrNoEnoughSpace)
+	require.NoError(t, m.Close())
+}
+
+func TestDiscarder(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	r := &recordingDiscarder{}
+	m, err := newDiskManagerWithMutexImpl(tempFile, WithDiscarder(r, 0))
+	require.NoError(t, err)
+	offset, err := m.Alloc(4 * unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.Free(offset, 4*unitSize))
+	require.Equal(t, [][]Range{{{Offset: offset, Size: 4 * unitSize}}}, r.got)
+	require.NoError(t, m.Close())
+
+	// the units allocated again before the delay are not discarded
+	r = &recordingDiscarder{}
+	m, err = newDiskManagerWithMutexImpl(tempFile, WithDiscarder(r, time.Hour))
+	require.NoError(t, err)
+	offset, err = m.Alloc(4 * unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.Free(offset, 4*unitSize))
+	offset2, err := m.Alloc(2 * unitSize)
+	require.NoError(t, err)
+	require.Equal(t, offset, offset2)
+	require.Empty(t, r.got)
+	r.err = errors.New("mock error")
+	require.ErrorContains(t, m.Close(), "mock error")
+	require.Equal(t, [][]Range{{{Offset: offset + 2*unitSize, Size: 2 * unitSize}}}, r.got)
+}
+
+func TestMirror(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	mirrorFile := path.Join(t.TempDir(), "mirror")
+	m, err := newDiskManagerWithMutexImpl(tempFile, WithMirror(mirrorFile))
+	require.NoError(t, err)
+	offset, err := m.Alloc(unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	// the lost image file is recovered from the mirror
+	require.NoError(t, os.Remove(tempFile))
+	m, err = newDiskManagerWithMutexImpl(tempFile, WithMirror(mirrorFile))
+	require.NoError(t, err)
+	allocated, err := m.IsAllocated(offset, unitSize)
+	require.NoError(t, err)
+	require.True(t, allocated)
+	require.NoError(t, m.Close())
+	primary, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	mirror, err := os.ReadFile(mirrorFile)
+	require.NoError(t, err)
+	require.Equal(t, primary, mirror)
+}
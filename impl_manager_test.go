@@ -1,6 +1,7 @@
 package disk_management_demo
 
 import (
+	"math"
 	"math/rand"
 	"os"
 	"path"
@@ -19,12 +20,17 @@ func checkBucketsHasExpectedLengthAndLocations(
 	if expected == nil {
 		expected = make(map[unit][]*location)
 	}
+	smallOffsets := map[unit][]unit{}
+	s.ascendSmall(func(l location) bool {
+		smallOffsets[l.length] = append(smallOffsets[l.length], l.offset)
+		return true
+	})
 	for _, b := range s.buckets {
 		switch v := b.(type) {
 		case *oneLengthBucket:
 			locations, ok := expected[v.length]
 			if !ok {
-				require.Len(t, v.offsets, 0)
+				require.Zero(t, v.total)
 				continue
 			}
 
@@ -32,7 +38,8 @@ func checkBucketsHasExpectedLengthAndLocations(
 			for _, l := range locations {
 				offsets = append(offsets, l.offset)
 			}
-			require.Equal(t, offsets, v.offsets)
+			require.Equal(t, offsets, smallOffsets[v.length])
+			require.Equal(t, len(offsets), v.total)
 		case *varLengthBucket:
 			locations, ok := expected[v.lengthLowerBound]
 			if !ok {
@@ -76,6 +83,15 @@ func TestNewDiskManagerImpl(t *testing.T) {
 	require.NoError(t, m.Close())
 }
 
+// managerImpls are the Manager implementations that should pass the same tests.
+var managerImpls = []struct {
+	name string
+	new  func(imageFilePath string) (Manager, error)
+}{
+	{"bitmap", func(imageFilePath string) (Manager, error) { return newDiskManagerImpl(imageFilePath) }},
+	{"buddy", NewBuddyManager},
+}
+
 func TestAlloc(t *testing.T) {
 	imageContent := make([]byte, bitmapSize)
 	copy(imageContent, ones[:])
@@ -86,86 +102,653 @@ func TestAlloc(t *testing.T) {
 	}
 	imageContent[144] = 0b1000_0000
 
-	tempFile := createFileWithContent(t, imageContent)
+	bitmapExpected := slices.Clone(ones[:])
+	// with maxContinuousFree, these 127 bits are not used
+	for i := 129; i < 144; i++ {
+		bitmapExpected[i] = 0
+	}
+	bitmapExpected[144] = 0b1000_0000
+	// the buddy system uses the smallest free block first
+	buddyUnitOffsets := []unit{1158, 1156, 1157, 1152, 1153, 1154, 1155}
+	for u := unit(1024); u < 1152; u++ {
+		buddyUnitOffsets = append(buddyUnitOffsets, u)
+	}
+
+	cases := map[string]struct {
+		unitOffsets []unit
+		expected    []byte
+	}{
+		"bitmap": {
+			unitOffsets: []unit{1024, 1025, 1026, 1027, 1028, 1029, 1030, 1031},
+			expected:    bitmapExpected,
+		},
+		"buddy": {
+			unitOffsets: buddyUnitOffsets,
+			expected:    ones[:],
+		},
+	}
+
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			tempFile := createFileWithContent(t, imageContent)
+			m, err := impl.new(tempFile)
+			require.NoError(t, err)
+			_, err = m.Alloc(0)
+			require.ErrorContains(t, err, "size should be positive, got: 0")
+			_, err = m.Alloc(1)
+			require.ErrorContains(t, err, "size should be multiple of 512B, got: 1")
+			_, err = m.Alloc(1024 * 1024 * 1024)
+			require.ErrorContains(t, err, "size should be less than 4MiB, got: 1073741824")
+
+			offset, err := m.Alloc(allocLimit)
+			require.NoError(t, err)
+			require.EqualValues(t, 0, offset)
+
+			for _, u := range cases[impl.name].unitOffsets {
+				offset, err = m.Alloc(unitSize)
+				require.NoError(t, err)
+				require.Equal(t, unitOffsetToByteOffset(u), offset)
+			}
+			_, err = m.Alloc(unitSize)
+			require.ErrorIs(t, err, ErrNoEnoughSpace)
+			err = m.Close()
+			require.NoError(t, err)
+
+			got, err := os.ReadFile(tempFile)
+			require.NoError(t, err)
+			require.Equal(t, cases[impl.name].expected, got[:bitmapSize])
+		})
+	}
+}
+
+func TestFree(t *testing.T) {
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			tempFile := createFileWithContent(t, nil)
+			m, err := impl.new(tempFile)
+			require.NoError(t, err)
+			checkBuckets := func(expected map[unit][]*location) {
+				if d, ok := m.(*diskManagerImpl); ok {
+					checkBucketsHasExpectedLengthAndLocations(t, d.freeSpaces, expected)
+				}
+			}
+
+			// alloc 4KiB, 4MiB, 4KiB at the front. The buddy system aligns
+			// the 4MiB to its size, and fills the hole before it.
+
+			offset, err := m.Alloc(unitSize)
+			require.NoError(t, err)
+			require.EqualValues(t, 0, offset)
+			offset2, err := m.Alloc(allocLimit)
+			require.NoError(t, err)
+			offset3, err := m.Alloc(unitSize)
+			require.NoError(t, err)
+			if impl.name == "buddy" {
+				require.EqualValues(t, allocLimit, offset2)
+				require.EqualValues(t, unitSize, offset3)
+			} else {
+				require.EqualValues(t, unitSize, offset2)
+				require.EqualValues(t, unitSize+allocLimit, offset3)
+			}
+			checkBuckets(map[unit][]*location{
+				128 * 1024 * 1024: {{offset: 1026, length: 256*1024*1024 - 1026}},
+			})
+
+			err = m.Free(offset2, allocLimit)
+			require.NoError(t, err)
+			checkBuckets(map[unit][]*location{
+				1024:              {{offset: 1, length: 1024}},
+				128 * 1024 * 1024: {{offset: 1026, length: 256*1024*1024 - 1026}},
+			})
+
+			err = m.Free(offset, unitSize)
+			require.NoError(t, err)
+			checkBuckets(map[unit][]*location{
+				1024:              {{offset: 0, length: 1025}},
+				128 * 1024 * 1024: {{offset: 1026, length: 256*1024*1024 - 1026}},
+			})
+
+			err = m.Free(offset3, unitSize)
+			require.NoError(t, err)
+			checkBuckets(map[unit][]*location{
+				unitTotalCnt: {{offset: 0, length: unitTotalCnt}},
+			})
+			stats := m.Stats()
+			require.Zero(t, stats.UsedSize)
+			require.EqualValues(t, spaceTotalSize, stats.LargestFreeSize)
+			require.EqualValues(t, 1, stats.FreeExtentCnt)
+		})
+	}
+}
+
+func TestAllocAligned(t *testing.T) {
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			tempFile := createFileWithContent(t, nil)
+			m, err := impl.new(tempFile)
+			require.NoError(t, err)
+			_, err = m.AllocAligned(unitSize, 1000)
+			require.ErrorContains(t, err, "alignment should be a positive multiple of 4KiB, got: 1000")
+			_, err = m.AllocAligned(unitSize, 2*spaceTotalSize)
+			require.ErrorContains(t, err, "alignment should not be larger than 1TiB, got: 2199023255552")
+
+			offset, err := m.Alloc(unitSize)
+			require.NoError(t, err)
+			require.EqualValues(t, 0, offset)
+			offset, err = m.AllocAligned(64*1024, 1024*1024)
+			require.NoError(t, err)
+			require.EqualValues(t, 1024*1024, offset)
+
+			// a sub-unit allocation starts at the aligned unit
+			offset, err = m.AllocAligned(512, 64*1024)
+			require.NoError(t, err)
+			require.Zero(t, offset%(64*1024))
+			allocated, err := m.IsAllocated(offset, 512)
+			require.NoError(t, err)
+			require.True(t, allocated)
+			require.NoError(t, m.Free(offset, 512))
+
+			_, err = m.AllocAligned(unitSize, 3*unitSize)
+			if impl.name == "buddy" {
+				require.ErrorContains(t, err, "alignment should be a power of two for the buddy allocator, got: 12288")
+			} else {
+				require.NoError(t, err)
+			}
+
+			rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+			for i := 0; i < 1000; i++ {
+				size := unitSize * (rnd.Int63n(allocLimit/unitSize) + 1)
+				alignment := int64(unitSize) << rnd.Intn(12)
+				if rnd.Intn(2) == 0 {
+					offset, err = m.AllocAligned(size, alignment)
+				} else {
+					offset, err = m.Alloc(size)
+					alignment = unitSize
+				}
+				require.NoError(t, err)
+				require.Zero(t, offset%alignment)
+			}
+			if d, ok := m.(*diskManagerImpl); ok {
+				require.NoError(t, verifyFreeSpaces(d.freeSpaces, d.bitmap[:], d.summary))
+			}
+			require.NoError(t, m.Close())
+		})
+	}
+}
+
+func TestReserveRange(t *testing.T) {
+	const mib = 1024 * 1024
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			tempFile := path.Join(t.TempDir(), "image")
+			require.NoError(t, FormatImage(tempFile,
+				Range{Offset: 0, Size: mib},
+				Range{Offset: spaceTotalSize - 16*mib, Size: 16 * mib},
+			))
+			m, err := impl.new(tempFile)
+			require.NoError(t, err)
+
+			offset, err := m.Alloc(unitSize)
+			require.NoError(t, err)
+			require.EqualValues(t, mib, offset)
+			err = m.Free(0, unitSize)
+			require.ErrorContains(t, err, "range at 0 with size 4096 overlaps reserved ranges")
+			err = m.ReserveRange(mib, unitSize)
+			require.ErrorContains(t, err, "range at 1048576 with size 4096 is not free")
+			err = m.ReserveRange(mib, 512)
+			require.ErrorContains(t, err, "reserved range should be aligned to 4KiB, got: 1048576, 512")
+
+			require.NoError(t, m.ReserveRange(2*mib, mib))
+			require.NoError(t, m.UnreserveRange(2*mib+mib/2, mib/2))
+			err = m.UnreserveRange(2*mib+mib/2, mib/2)
+			require.ErrorContains(t, err, "range at 2621440 with size 524288 is not reserved")
+
+			var got []Extent
+			m.Extents(func(e Extent) bool {
+				got = append(got, e)
+				return true
+			})
+			require.Equal(t, []Extent{
+				{Offset: 0, Size: mib, Allocated: true, Reserved: true},
+				{Offset: mib, Size: unitSize, Allocated: true},
+				{Offset: mib + unitSize, Size: mib - unitSize},
+				{Offset: 2 * mib, Size: mib / 2, Allocated: true, Reserved: true},
+				{Offset: 2*mib + mib/2, Size: spaceTotalSize - 16*mib - 2*mib - mib/2},
+				{Offset: spaceTotalSize - 16*mib, Size: 16 * mib, Allocated: true, Reserved: true},
+			}, got)
+
+			stats := m.Stats()
+			require.EqualValues(t, unitSize, stats.UsedSize)
+			require.EqualValues(t, mib+mib/2+16*mib, stats.ReservedSize)
+			require.EqualValues(t, spaceTotalSize-unitSize-stats.ReservedSize, stats.FreeSize)
+			require.NoError(t, m.Close())
+
+			m, err = impl.new(tempFile)
+			require.NoError(t, err)
+			require.Equal(t, stats, m.Stats())
+			require.NoError(t, m.Close())
+		})
+	}
+}
+
+func TestMarkBad(t *testing.T) {
+	const mib = 1024 * 1024
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			tempFile := path.Join(t.TempDir(), "image")
+			require.NoError(t, FormatImage(tempFile, Range{Offset: 0, Size: mib}))
+			m, err := impl.new(tempFile)
+			require.NoError(t, err)
+
+			offset, err := m.Alloc(4 * unitSize)
+			require.NoError(t, err)
+			require.EqualValues(t, mib, offset)
+			err = m.MarkBad(mib-512, unitSize)
+			require.ErrorContains(t, err, "range at 1048064 with size 4096 overlaps reserved ranges")
+			// the touched units are marked bad, no matter they are allocated or
+			// free
+			require.NoError(t, m.MarkBad(mib+unitSize+100, 10))
+			require.NoError(t, m.MarkBad(2*mib-100, 200))
+
+			// the bad unit is kept allocated
+			require.NoError(t, m.Free(mib, 4*unitSize))
+			allocated, err := m.IsAllocated(mib+unitSize, unitSize)
+			require.NoError(t, err)
+			require.True(t, allocated)
+
+			var got []Extent
+			m.Extents(func(e Extent) bool {
+				got = append(got, e)
+				return true
+			})
+			require.Equal(t, []Extent{
+				{Offset: 0, Size: mib, Allocated: true, Reserved: true},
+				{Offset: mib, Size: unitSize},
+				{Offset: mib + unitSize, Size: unitSize, Allocated: true, Bad: true},
+				{Offset: mib + 2*unitSize, Size: mib - 3*unitSize},
+				{Offset: 2*mib - unitSize, Size: 2 * unitSize, Allocated: true, Bad: true},
+				{Offset: 2*mib + unitSize, Size: spaceTotalSize - 2*mib - unitSize},
+			}, got)
+
+			stats := m.Stats()
+			require.EqualValues(t, 0, stats.UsedSize)
+			require.EqualValues(t, 3*unitSize, stats.BadSize)
+			require.EqualValues(t, spaceTotalSize-mib-3*unitSize, stats.FreeSize)
+			require.NoError(t, m.Close())
+
+			m, err = impl.new(tempFile)
+			require.NoError(t, err)
+			require.Equal(t, stats, m.Stats())
+			require.NoError(t, m.Close())
+		})
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	const mib = 1024 * 1024
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			tempFile := createFileWithContent(t, nil)
+			m, err := impl.new(tempFile)
+			require.NoError(t, err)
+
+			require.NoError(t, m.SetNamespace(1, 2*unitSize, 0))
+			require.NoError(t, m.SetNamespace(2, 0, spaceTotalSize-mib))
+			err = m.SetNamespace(3, 0, 2*mib)
+			require.ErrorIs(t, err, ErrNoEnoughSpace)
+			require.ErrorContains(t, err, "can't guarantee reservation 2097152 of namespace 3")
+			err = m.SetNamespace(DefaultNamespace, 0, 0)
+			require.ErrorContains(t, err, "default namespace can't be configured")
+
+			offset1, err := m.AllocIn(1, unitSize)
+			require.NoError(t, err)
+			_, err = m.AllocIn(1, 2*unitSize)
+			require.ErrorIs(t, err, ErrQuotaExceeded)
+			_, err = m.AllocIn(4, 512)
+			require.ErrorContains(t, err, "namespace 4 does not exist")
+
+			// the space not used by namespace 2 is kept for it
+			_, err = m.Alloc(mib)
+			require.ErrorIs(t, err, ErrNoEnoughSpace)
+			_, err = m.Alloc(mib / 2)
+			require.NoError(t, err)
+			offset2, err := m.AllocIn(2, 4*mib)
+			require.NoError(t, err)
+
+			err = m.Free(offset1, unitSize)
+			require.ErrorContains(t, err, "overlaps allocations of namespace 1")
+			err = m.FreeIn(2, offset1, unitSize)
+			require.ErrorContains(t, err, "is not an allocation of namespace 2")
+
+			stats, err := m.NamespaceStats(1)
+			require.NoError(t, err)
+			require.Equal(t, NamespaceStats{Quota: 2 * unitSize, UsedSize: unitSize}, stats)
+			stats, err = m.NamespaceStats(2)
+			require.NoError(t, err)
+			require.Equal(t, NamespaceStats{Reservation: spaceTotalSize - mib, UsedSize: 4 * mib}, stats)
+			_, err = m.NamespaceStats(3)
+			require.ErrorContains(t, err, "namespace 3 does not exist")
+			require.NoError(t, m.Close())
+
+			// the usage is rebuilt from the allocations
+			m, err = impl.new(tempFile)
+			require.NoError(t, err)
+			stats, err = m.NamespaceStats(2)
+			require.NoError(t, err)
+			require.EqualValues(t, 4*mib, stats.UsedSize)
+			require.NoError(t, m.FreeIn(1, offset1, unitSize))
+			require.NoError(t, m.FreeIn(2, offset2, 4*mib))
+			stats, err = m.NamespaceStats(1)
+			require.NoError(t, err)
+			require.Zero(t, stats.UsedSize)
+
+			// the space taken rather than the requested size is charged
+			_, err = m.AllocIn(1, unitSize+sectorSize)
+			require.NoError(t, err)
+			stats, err = m.NamespaceStats(1)
+			require.NoError(t, err)
+			require.EqualValues(t, 2*unitSize, stats.UsedSize)
+			_, err = m.AllocIn(1, sectorSize)
+			require.ErrorIs(t, err, ErrQuotaExceeded)
+			require.NoError(t, m.Close())
+		})
+	}
+}
+
+func TestRefCounts(t *testing.T) {
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			tempFile := createFileWithContent(t, nil)
+			m, err := impl.new(tempFile)
+			require.NoError(t, err)
+
+			offset, err := m.Alloc(4 * unitSize)
+			require.NoError(t, err)
+			err = m.IncRef(offset+512, unitSize)
+			require.ErrorContains(t, err, "shared range should be aligned to 4KiB")
+			err = m.IncRef(offset+4*unitSize, unitSize)
+			require.ErrorContains(t, err, "is not allocated")
+			require.NoError(t, m.IncRef(offset, 4*unitSize))
+			require.NoError(t, m.IncRef(offset+unitSize, unitSize))
+
+			// the units are shared, so only the last reference releases them
+			require.NoError(t, m.Free(offset, 4*unitSize))
+			allocated, err := m.IsAllocated(offset, 4*unitSize)
+			require.NoError(t, err)
+			require.True(t, allocated)
+			require.NoError(t, m.Close())
+
+			m, err = impl.new(tempFile)
+			require.NoError(t, err)
+			require.NoError(t, m.DecRef(offset, 4*unitSize))
+			allocated, err = m.IsAllocated(offset, 4*unitSize)
+			require.NoError(t, err)
+			require.False(t, allocated)
+			allocated, err = m.IsAllocated(offset+unitSize, unitSize)
+			require.NoError(t, err)
+			require.True(t, allocated)
+			require.EqualValues(t, unitSize, m.Stats().UsedSize)
+
+			require.NoError(t, m.DecRef(offset+unitSize, unitSize))
+			require.Zero(t, m.Stats().UsedSize)
+			err = m.DecRef(offset, unitSize)
+			require.ErrorContains(t, err, "is not allocated")
+			require.NoError(t, m.Close())
+		})
+	}
+}
+
+func TestRefCountsRejected(t *testing.T) {
+	tempFile := path.Join(t.TempDir(), "image")
+	require.NoError(t, FormatImage(tempFile, Range{Offset: 0, Size: unitSize}))
 	m, err := newDiskManagerImpl(tempFile)
 	require.NoError(t, err)
-	_, err = m.Alloc(0)
-	require.ErrorContains(t, err, "size should be positive, got: 0")
-	_, err = m.Alloc(1)
-	require.ErrorContains(t, err, "size should be multiple of 512B, got: 1")
-	_, err = m.Alloc(1024 * 1024 * 1024)
-	require.ErrorContains(t, err, "size should be less than 4MiB, got: 1073741824")
 
-	i := 0
-	offset, err := m.Alloc(allocLimit)
+	err = m.IncRef(0, unitSize)
+	require.ErrorContains(t, err, "range at 0 with size 4096 overlaps reserved ranges")
+	offset, err := m.Alloc(512)
 	require.NoError(t, err)
-	require.EqualValues(t, i, offset)
-	i += allocLimit
+	err = m.IncRef(offset, unitSize)
+	require.ErrorContains(t, err, "contains sub-unit allocations")
+	require.NoError(t, m.SetNamespace(1, 0, 0))
+	offset, err = m.AllocIn(1, unitSize)
+	require.NoError(t, err)
+	err = m.IncRef(offset, unitSize)
+	require.ErrorContains(t, err, "overlaps allocations of namespace 1")
 
-	for ; i < allocLimit+8*unitSize; i += unitSize {
-		offset, err = m.Alloc(unitSize)
-		require.NoError(t, err)
-		require.EqualValues(t, i, offset)
+	offset, err = m.Alloc(2 * unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.MarkBad(offset+unitSize, unitSize))
+	err = m.IncRef(offset, 2*unitSize)
+	require.ErrorContains(t, err, "contains bad units")
+	require.NoError(t, m.IncRef(offset, unitSize))
+	// the count can't wrap around to release the shared unit
+	run, _ := m.refs.runs.get(byteOffsetToUnitOffset(offset))
+	run.extra = math.MaxUint32
+	err = m.IncRef(offset, unitSize)
+	require.ErrorContains(t, err, "reaches the maximum")
+}
+
+func TestSnapshots(t *testing.T) {
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			tempFile := createFileWithContent(t, nil)
+			m, err := impl.new(tempFile)
+			require.NoError(t, err)
+
+			offset1, err := m.Alloc(4 * unitSize)
+			require.NoError(t, err)
+			id1, err := m.Snapshot()
+			require.NoError(t, err)
+			require.EqualValues(t, 1, id1)
+
+			require.NoError(t, m.Free(offset1, 4*unitSize))
+			offset2, err := m.Alloc(64 * unitSize)
+			require.NoError(t, err)
+			id2, err := m.Snapshot()
+			require.NoError(t, err)
+			require.EqualValues(t, 2, id2)
+
+			infos, err := m.ListSnapshots()
+			require.NoError(t, err)
+			require.Len(t, infos, 2)
+			require.Equal(t, id1, infos[0].ID)
+			require.Equal(t, id2, infos[1].ID)
+			require.False(t, infos[1].CreatedAt.Before(infos[0].CreatedAt))
+
+			diff, err := m.DiffSnapshots(id1, id2)
+			require.NoError(t, err)
+			// the freed units are reused by the second allocation
+			require.Equal(t, []Extent{
+				{Offset: 4 * unitSize, Size: 60 * unitSize, Allocated: true},
+			}, diff)
+			require.Zero(t, offset2)
+
+			require.NoError(t, m.RestoreSnapshot(id1))
+			allocated, err := m.IsAllocated(offset1, 4*unitSize)
+			require.NoError(t, err)
+			require.True(t, allocated)
+			require.EqualValues(t, 4*unitSize, m.Stats().UsedSize)
+			offset, err := m.Alloc(4 * unitSize)
+			require.NoError(t, err)
+			require.EqualValues(t, 4*unitSize, offset)
+			require.NoError(t, m.Close())
+
+			m, err = impl.new(tempFile)
+			require.NoError(t, err)
+			require.EqualValues(t, 8*unitSize, m.Stats().UsedSize)
+			require.NoError(t, m.DeleteSnapshot(id2))
+			err = m.DeleteSnapshot(id2)
+			require.ErrorContains(t, err, "snapshot 2 does not exist")
+			err = m.RestoreSnapshot(id2)
+			require.ErrorContains(t, err, "snapshot 2 does not exist")
+			_, err = m.DiffSnapshots(id1, id2)
+			require.ErrorContains(t, err, "snapshot 2 does not exist")
+			infos, err = m.ListSnapshots()
+			require.NoError(t, err)
+			require.Len(t, infos, 1)
+			// the ID of the deleted snapshot is not reused, even after restoring
+			// an older snapshot and reopening
+			id3, err := m.Snapshot()
+			require.NoError(t, err)
+			require.EqualValues(t, 3, id3)
+			require.NoError(t, m.DeleteSnapshot(id3))
+			require.NoError(t, m.Close())
+			m, err = impl.new(tempFile)
+			require.NoError(t, err)
+			id4, err := m.Snapshot()
+			require.NoError(t, err)
+			require.EqualValues(t, 4, id4)
+			require.NoError(t, m.Close())
+		})
 	}
-	_, err = m.Alloc(unitSize)
-	require.ErrorIs(t, err, ErrNoEnoughSpace)
-	err = m.Close()
+}
+
+func TestSnapshotKeepsGeneration(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := newDiskManagerImpl(tempFile)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	require.EqualValues(t, 1, m.generation)
+	_, err = m.Snapshot()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, m.generation)
+	require.NoError(t, m.Close())
+	require.EqualValues(t, 2, m.generation)
+}
+
+func TestMarkBadSubUnit(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := newDiskManagerImpl(tempFile)
 	require.NoError(t, err)
 
-	got, err := os.ReadFile(tempFile)
+	offset, err := m.Alloc(512)
 	require.NoError(t, err)
-	expected := slices.Clone(ones[:])
-	// with maxContinuousFree, these 127 bits are not used
-	for i = 129; i < 144; i++ {
-		expected[i] = 0
-	}
-	expected[144] = 0b1000_0000
-	require.Equal(t, expected, got)
+	require.EqualValues(t, 0, offset)
+	require.NoError(t, m.MarkBad(0, 512))
+	// the free sectors of the bad unit are not handed out
+	offset, err = m.Alloc(512)
+	require.NoError(t, err)
+	require.EqualValues(t, unitSize, offset)
+	require.NoError(t, m.Close())
+
+	m, err = newDiskManagerImpl(tempFile)
+	require.NoError(t, err)
+	offset, err = m.Alloc(512)
+	require.NoError(t, err)
+	require.EqualValues(t, unitSize+512, offset)
+	require.NoError(t, m.Free(0, 512))
+	allocated, err := m.IsAllocated(0, unitSize)
+	require.NoError(t, err)
+	require.True(t, allocated)
+	require.EqualValues(t, unitSize, m.Stats().UsedSize)
 }
 
-func TestFree(t *testing.T) {
+func TestAllocSubUnit(t *testing.T) {
 	tempFile := createFileWithContent(t, nil)
 	m, err := newDiskManagerImpl(tempFile)
 	require.NoError(t, err)
 
-	// alloc 4KiB, 4MiB, 4KiB at the front
+	// 512B, 1KiB, 1.5KiB and 1KiB are packed into the first unit
+	var offsets []int64
+	for _, size := range []int64{512, 1024, 1536, 1024} {
+		offset, err := m.Alloc(size)
+		require.NoError(t, err)
+		offsets = append(offsets, offset)
+	}
+	require.Equal(t, []int64{0, 512, 1536, 3072}, offsets)
+	offset, err := m.Alloc(512)
+	require.NoError(t, err)
+	require.EqualValues(t, unitSize, offset)
+	require.EqualValues(t, 2*unitSize, m.Stats().UsedSize)
 
-	i := 0
-	offset, err := m.Alloc(unitSize)
+	allocated, err := m.IsAllocated(512, 1024)
 	require.NoError(t, err)
-	require.EqualValues(t, i, offset)
-	i += unitSize
-	offset2, err := m.Alloc(allocLimit)
+	require.True(t, allocated)
+	require.NoError(t, m.Free(512, 1024))
+	allocated, err = m.IsAllocated(512, 512)
 	require.NoError(t, err)
-	require.EqualValues(t, i, offset2)
-	i += allocLimit
-	offset3, err := m.Alloc(unitSize)
+	require.False(t, allocated)
+	allocated, err = m.IsAllocated(0, 512)
 	require.NoError(t, err)
-	require.EqualValues(t, i, offset3)
-	i += unitSize
-	checkBucketsHasExpectedLengthAndLocations(t, m.freeSpaces, map[unit][]*location{
-		128 * 1024 * 1024: {{offset: 1026, length: 256*1024*1024 - 1026}},
-	})
+	require.True(t, allocated)
+
+	err = m.Free(512, 512)
+	require.ErrorContains(t, err, "sectors at 512 with size 512 are not allocated")
+	err = m.Free(3072, 2048)
+	require.ErrorContains(t, err, "sub-unit allocation should not cross units, got: 3072, 2048")
+	err = m.Free(0, unitSize)
+	require.ErrorContains(t, err, "range at 0 with size 4096 contains sub-unit allocations")
+	err = m.Free(2*unitSize, 512)
+	require.ErrorContains(t, err, "unit at 8192 is not shared by sub-unit allocations")
 
-	err = m.Free(offset2, allocLimit)
+	// the freed space is reused and persisted
+	offset, err = m.Alloc(1024)
 	require.NoError(t, err)
-	checkBucketsHasExpectedLengthAndLocations(t, m.freeSpaces, map[unit][]*location{
-		1024:              {{offset: 1, length: 1024}},
-		128 * 1024 * 1024: {{offset: 1026, length: 256*1024*1024 - 1026}},
-	})
+	require.EqualValues(t, 512, offset)
+	require.NoError(t, m.Close())
+
+	m, err = newDiskManagerImpl(tempFile)
+	require.NoError(t, err)
+	require.Len(t, m.slabs.units, 2)
+	for _, f := range [][2]int64{{0, 512}, {512, 1024}, {1536, 1536}, {3072, 1024}, {unitSize, 512}} {
+		require.NoError(t, m.Free(f[0], f[1]))
+	}
+	require.Empty(t, m.slabs.units)
+	require.Zero(t, m.Stats().UsedSize)
+	require.NoError(t, verifyFreeSpaces(m.freeSpaces, m.bitmap[:], m.summary))
+}
 
-	err = m.Free(offset, unitSize)
+func TestQuery(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := newDiskManagerImpl(tempFile)
 	require.NoError(t, err)
-	checkBucketsHasExpectedLengthAndLocations(t, m.freeSpaces, map[unit][]*location{
-		1024:              {{offset: 0, length: 1025}},
-		128 * 1024 * 1024: {{offset: 1026, length: 256*1024*1024 - 1026}},
-	})
 
-	err = m.Free(offset3, unitSize)
+	offset, err := m.Alloc(allocLimit)
+	require.NoError(t, err)
+	offset2, err := m.Alloc(unitSize)
+	require.NoError(t, err)
+	require.NoError(t, m.Free(offset, allocLimit))
+
+	_, err = m.IsAllocated(-1, unitSize)
+	require.ErrorContains(t, err, "start offset should be non-negative, got: -1")
+	allocated, err := m.IsAllocated(offset2, unitSize)
 	require.NoError(t, err)
-	checkBucketsHasExpectedLengthAndLocations(t, m.freeSpaces, map[unit][]*location{
-		unitTotalCnt: {{offset: 0, length: unitTotalCnt}},
+	require.True(t, allocated)
+	allocated, err = m.IsAllocated(offset2-unitSize, 2*unitSize)
+	require.NoError(t, err)
+	require.False(t, allocated)
+
+	require.Equal(t, Stats{
+		TotalSize:       spaceTotalSize,
+		UnitSize:        unitSize,
+		UsedSize:        unitSize,
+		FreeSize:        spaceTotalSize - unitSize,
+		LargestFreeSize: spaceTotalSize - allocLimit - unitSize,
+		FreeExtentCnt:   2,
+		FreeHistogram: []HistogramBucket{
+			{MinSize: 1024 * unitSize, MaxSize: 2048*unitSize - unitSize, Count: 1},
+			{MinSize: spaceTotalSize / 2, MaxSize: spaceTotalSize - unitSize, Count: 1},
+		},
+	}, m.Stats())
+
+	var extents []Extent
+	m.Extents(func(e Extent) bool {
+		extents = append(extents, e)
+		return true
 	})
+	require.Equal(t, []Extent{
+		{Offset: 0, Size: allocLimit},
+		{Offset: allocLimit, Size: unitSize, Allocated: true},
+		{Offset: allocLimit + unitSize, Size: spaceTotalSize - allocLimit - unitSize},
+	}, extents)
+
+	extents = extents[:0]
+	m.Extents(func(e Extent) bool {
+		extents = append(extents, e)
+		return false
+	})
+	require.Len(t, extents, 1)
 }
 
 func TestAllocDuration(t *testing.T) {
@@ -207,15 +790,85 @@ func TestRecover(t *testing.T) {
 	t.Logf("Recover took %s", elapsed)
 }
 
+func TestRecoverFromSnapshot(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	m, err := newDiskManagerImpl(tempFile)
+	require.NoError(t, err)
+	var offsets []int64
+	for i := 0; i < 1000; i++ {
+		offset, err := m.Alloc(int64(i%16+1) * unitSize)
+		require.NoError(t, err)
+		offsets = append(offsets, offset)
+	}
+	for i := 0; i < len(offsets); i += 3 {
+		require.NoError(t, m.Free(offsets[i], int64(i%16+1)*unitSize))
+	}
+	require.NoError(t, m.Close())
+
+	start := time.Now()
+	m2, err := openDiskManagerImpl(tempFile)
+	elapsed := time.Since(start)
+	require.NoError(t, err)
+	t.Logf("Recover from snapshot took %s", elapsed)
+	require.EqualValues(t, 1, m2.generation)
+	require.EqualValues(t, unitTotalCnt, m2.loadedUpTo)
+	require.NoError(t, verifyFreeSpaces(m2.freeSpaces, m2.bitmap[:], m2.summary))
+	require.Equal(t, m.Stats(), m2.Stats())
+	for i := 0; i < 100; i++ {
+		expected, err := m.Alloc(int64(i%8+1) * unitSize)
+		require.NoError(t, err)
+		offset, err := m2.Alloc(int64(i%8+1) * unitSize)
+		require.NoError(t, err)
+		require.Equal(t, expected, offset)
+	}
+	require.NoError(t, m2.Close())
+
+	// the bitmap changed without the trailer is corrupt, rather than making the
+	// snapshot stale
+	content, err := os.ReadFile(tempFile)
+	require.NoError(t, err)
+	last := content[bitmapSize-1]
+	content[bitmapSize-1] = ^last
+	require.NoError(t, os.WriteFile(tempFile, content, 0600))
+	_, err = openDiskManagerImpl(tempFile)
+	require.ErrorContains(t, err, "checksum of bitmap mismatches, the image may be corrupt")
+
+	// a broken snapshot is ignored
+	trailer, err := decodeTrailer(content[bitmapSize:])
+	require.NoError(t, err)
+	content[bitmapSize-1] = last
+	trailer.sections[sectionFreeSpaces] = trailer.sections[sectionFreeSpaces][:3]
+	require.NoError(t, writeFileAtomically(tempFile, content[:bitmapSize], trailer.encode()))
+	m2, err = openDiskManagerImpl(tempFile)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, m2.generation)
+	require.Zero(t, m2.loadedUpTo)
+	m2, err = newDiskManagerImpl(tempFile)
+	require.NoError(t, err)
+	require.NoError(t, verifyFreeSpaces(m2.freeSpaces, m2.bitmap[:], m2.summary))
+}
+
 func TestUtilization10PercentFree(t *testing.T) {
-	testUtilizationWithFreePercent(t, 10)
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			testUtilizationWithFreePercent(t, impl.new, 10)
+		})
+	}
 }
 
 func TestUtilization50PercentFree(t *testing.T) {
-	testUtilizationWithFreePercent(t, 50)
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			testUtilizationWithFreePercent(t, impl.new, 50)
+		})
+	}
 }
 
-func testUtilizationWithFreePercent(t *testing.T, percent int) {
+func testUtilizationWithFreePercent(
+	t *testing.T,
+	newManager func(imageFilePath string) (Manager, error),
+	percent int,
+) {
 	seed := time.Now().UnixNano()
 	seed = 1709977821053597000
 	t.Logf("seed: %d", seed)
@@ -238,7 +891,7 @@ func testUtilizationWithFreePercent(t *testing.T, percent int) {
 	)
 
 	tempFile := createFileWithContent(t, nil)
-	m, err := newDiskManagerImpl(tempFile)
+	m, err := newManager(tempFile)
 	require.NoError(t, err)
 
 	for {
@@ -276,14 +929,26 @@ func testUtilizationWithFreePercent(t *testing.T, percent int) {
 }
 
 func TestUtilizationAfter10TiB(t *testing.T) {
-	testUtilizationAfter(t, 10*1024*1024*1024*1024)
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			testUtilizationAfter(t, impl.new, 10*1024*1024*1024*1024)
+		})
+	}
 }
 
 func TestUtilizationAfter100TiB(t *testing.T) {
-	testUtilizationAfter(t, 100*1024*1024*1024*1024)
+	for _, impl := range managerImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			testUtilizationAfter(t, impl.new, 100*1024*1024*1024*1024)
+		})
+	}
 }
 
-func testUtilizationAfter(t *testing.T, targetWriteAmount int64) {
+func testUtilizationAfter(
+	t *testing.T,
+	newManager func(imageFilePath string) (Manager, error),
+	targetWriteAmount int64,
+) {
 	seed := time.Now().UnixNano()
 	t.Logf("seed: %d", seed)
 	rnd := rand.New(rand.NewSource(seed))
@@ -309,7 +974,7 @@ func testUtilizationAfter(t *testing.T, targetWriteAmount int64) {
 	)
 
 	tempFile := createFileWithContent(t, nil)
-	m, err := newDiskManagerImpl(tempFile)
+	m, err := newManager(tempFile)
 	require.NoError(t, err)
 
 	for {
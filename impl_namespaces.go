@@ -0,0 +1,317 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// namespace is the configuration and usage of a namespace other than
+// DefaultNamespace.
+type namespace struct {
+	// quota is the maximum used size, 0 means no limit.
+	quota       int64
+	reservation int64
+	used        int64
+}
+
+// outstanding returns the size of the reservation that is not used yet, which
+// should be kept free for the namespace.
+func (n *namespace) outstanding() int64 {
+	return max(0, n.reservation-n.used)
+}
+
+// ownedAlloc is an allocation of a namespace.
+type ownedAlloc struct {
+	offset int64
+	size   int64
+	ns     NamespaceID
+}
+
+func (a ownedAlloc) key() int64 { return a.offset }
+
+// namespaces accounts the allocations of the namespaces. The allocations of
+// DefaultNamespace are not recorded, so the managers that don't use namespaces
+// pay nothing. The used size of a namespace is rebuilt from its allocations when
+// the image is opened.
+type namespaces struct {
+	defs map[NamespaceID]*namespace
+	// owned orders the allocations by offset, and they don't overlap.
+	owned *btree[int64, ownedAlloc]
+	// charge returns the space taken by an allocation of size, which is charged
+	// to the namespace instead of size.
+	charge func(size int64) int64
+}
+
+func newNamespaces() *namespaces {
+	return &namespaces{
+		defs:   map[NamespaceID]*namespace{},
+		owned:  newBTree[int64, ownedAlloc](),
+		charge: chargedSize,
+	}
+}
+
+// chargedSize returns the space taken by an allocation of size in
+// diskManagerImpl. An allocation smaller than a unit takes its sectors in a
+// slab, otherwise it takes whole units.
+func chargedSize(size int64) int64 {
+	if size < unitSize {
+		return (size + sectorSize - 1) / sectorSize * sectorSize
+	}
+	return roundUpToUnit(size)
+}
+
+// outstanding returns the total outstanding reservation of the namespaces except
+// the given one.
+func (nss *namespaces) outstanding(except NamespaceID) int64 {
+	var total int64
+	for id, n := range nss.defs {
+		if id != except {
+			total += n.outstanding()
+		}
+	}
+	return total
+}
+
+// set creates or updates the namespace. freeSize is the size of the free space
+// of the storage, which should hold the outstanding reservations of all
+// namespaces.
+func (nss *namespaces) set(ns NamespaceID, quota, reservation, freeSize int64) error {
+	if ns == DefaultNamespace {
+		return errors.New("default namespace can't be configured")
+	}
+	if quota < 0 || reservation < 0 {
+		return errors.Errorf("quota and reservation should be non-negative, got: %d, %d", quota, reservation)
+	}
+	if quota > 0 && reservation > quota {
+		return errors.Errorf("reservation should not be larger than quota, got: %d, %d", reservation, quota)
+	}
+	n := &namespace{quota: quota, reservation: reservation}
+	if old, ok := nss.defs[ns]; ok {
+		n.used = old.used
+	}
+	if quota > 0 && n.used > quota {
+		return errors.Errorf("quota %d is less than the used size %d of namespace %d", quota, n.used, ns)
+	}
+	if nss.outstanding(ns)+n.outstanding() > freeSize {
+		return errors.WithMessagef(ErrNoEnoughSpace, "can't guarantee reservation %d of namespace %d", reservation, ns)
+	}
+	nss.defs[ns] = n
+	return nil
+}
+
+// admit checks whether the namespace can allocate size bytes, which is charged
+// by the space it takes. The allocation
+// should not exceed the quota of the namespace, and should not take the space
+// kept for the outstanding reservations of other namespaces.
+func (nss *namespaces) admit(ns NamespaceID, size, freeSize int64) error {
+	if len(nss.defs) == 0 && ns == DefaultNamespace {
+		return nil
+	}
+	size = nss.charge(size)
+	var own int64
+	if ns != DefaultNamespace {
+		n, ok := nss.defs[ns]
+		if !ok {
+			return errors.Errorf("namespace %d does not exist", ns)
+		}
+		if n.quota > 0 && n.used+size > n.quota {
+			return ErrQuotaExceeded
+		}
+		own = n.outstanding()
+	}
+	if freeSize-size < nss.outstanding(ns)+max(0, own-size) {
+		return ErrNoEnoughSpace
+	}
+	return nil
+}
+
+// first returns the first allocation that ends after offset.
+func (nss *namespaces) first(offset int64) (ownedAlloc, bool) {
+	if a, ok := nss.owned.floor(offset); ok && a.offset+a.size > offset {
+		return a, true
+	}
+	var (
+		ret   ownedAlloc
+		found bool
+	)
+	nss.owned.ascendFrom(offset, func(a ownedAlloc) bool {
+		ret, found = a, true
+		return false
+	})
+	return ret, found
+}
+
+// own records the allocation of the namespace.
+func (nss *namespaces) own(ns NamespaceID, offset, size int64) {
+	if ns == DefaultNamespace {
+		return
+	}
+	nss.owned.insert(ownedAlloc{offset: offset, size: size, ns: ns})
+	nss.defs[ns].used += nss.charge(size)
+}
+
+// checkFree checks whether the namespace can free [offset, offset+size). A
+// namespace other than DefaultNamespace can only free its whole allocation, and
+// DefaultNamespace can't free the allocations of others.
+func (nss *namespaces) checkFree(ns NamespaceID, offset, size int64) error {
+	a, ok := nss.first(offset)
+	if ns == DefaultNamespace {
+		if ok && a.offset < offset+size {
+			return errors.Errorf("range at %d with size %d overlaps allocations of namespace %d", offset, size, a.ns)
+		}
+		return nil
+	}
+	if !ok || a != (ownedAlloc{offset: offset, size: size, ns: ns}) {
+		return errors.Errorf("range at %d with size %d is not an allocation of namespace %d", offset, size, ns)
+	}
+	return nil
+}
+
+// remove removes the allocation at offset checked by checkFree.
+func (nss *namespaces) remove(ns NamespaceID, offset int64) {
+	if ns == DefaultNamespace {
+		return
+	}
+	a, _ := nss.owned.get(offset)
+	nss.defs[ns].used -= nss.charge(a.size)
+	nss.owned.delete(offset)
+}
+
+func (nss *namespaces) stats(ns NamespaceID) (NamespaceStats, error) {
+	n, ok := nss.defs[ns]
+	if !ok {
+		return NamespaceStats{}, errors.Errorf("namespace %d does not exist", ns)
+	}
+	return NamespaceStats{Quota: n.quota, Reservation: n.reservation, UsedSize: n.used}, nil
+}
+
+const (
+	namespaceDefSize  = 4 + 8 + 8
+	ownedAllocRecSize = 8 + 8 + 4
+)
+
+// encode serializes the namespaces as the payload of the section. The payload
+// is
+//
+//	defCnt uint32
+//	defs   defCnt * {id uint32, quota int64, reservation int64}
+//	owned  {offset int64, size int64, id uint32} in the ascending order of offset
+//
+// The used sizes are not persisted, they are rebuilt from the allocations.
+func (nss *namespaces) encode() []byte {
+	ids := make([]NamespaceID, 0, len(nss.defs))
+	for id := range nss.defs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	buf := make([]byte, 0, 4+len(ids)*namespaceDefSize+nss.owned.length*ownedAllocRecSize)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(ids)))
+	for _, id := range ids {
+		n := nss.defs[id]
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(id))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(n.quota))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(n.reservation))
+	}
+	nss.owned.ascend(func(a ownedAlloc) {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(a.offset))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(a.size))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(a.ns))
+	})
+	return buf
+}
+
+// decode adds the namespaces and allocations in the payload of the section to
+// nss. The records that are malformed are skipped and reported in problems.
+func (nss *namespaces) decode(payload []byte) (problems []string) {
+	if len(payload) < 4 {
+		return []string{"namespace section is truncated"}
+	}
+	defCnt := int(binary.LittleEndian.Uint32(payload))
+	payload = payload[4:]
+	if len(payload) < defCnt*namespaceDefSize || (len(payload)-defCnt*namespaceDefSize)%ownedAllocRecSize != 0 {
+		return []string{"namespace section is truncated"}
+	}
+	for i := 0; i < defCnt; i++ {
+		id := NamespaceID(binary.LittleEndian.Uint32(payload))
+		quota := int64(binary.LittleEndian.Uint64(payload[4:]))
+		reservation := int64(binary.LittleEndian.Uint64(payload[12:]))
+		payload = payload[namespaceDefSize:]
+		var problem string
+		switch _, ok := nss.defs[id]; {
+		case id == DefaultNamespace:
+			problem = "is the default namespace"
+		case ok:
+			problem = "is defined more than once"
+		case quota < 0 || reservation < 0 || (quota > 0 && reservation > quota):
+			problem = fmt.Sprintf("has invalid quota %d and reservation %d", quota, reservation)
+		default:
+			nss.defs[id] = &namespace{quota: quota, reservation: reservation}
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("namespace %d %s", id, problem))
+	}
+	for ; len(payload) > 0; payload = payload[ownedAllocRecSize:] {
+		offset := int64(binary.LittleEndian.Uint64(payload))
+		size := int64(binary.LittleEndian.Uint64(payload[8:]))
+		id := NamespaceID(binary.LittleEndian.Uint32(payload[16:]))
+		var problem string
+		switch _, ok := nss.defs[id]; {
+		case !ok:
+			problem = "belongs to unknown namespace"
+		case checkRange(offset, size) != nil:
+			problem = "is out of range"
+		case nss.overlaps(offset, size):
+			problem = "overlaps other allocations"
+		default:
+			nss.own(id, offset, size)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("allocation at %d with size %d of namespace %d %s", offset, size, id, problem))
+	}
+	return problems
+}
+
+// overlaps returns true if any allocation of the namespaces overlaps [offset,
+// offset+size).
+func (nss *namespaces) overlaps(offset, size int64) bool {
+	a, ok := nss.first(offset)
+	return ok && a.offset < offset+size
+}
+
+// dropUnallocated removes the allocations whose units are not all allocated in
+// bitmap, and returns their descriptions.
+func (nss *namespaces) dropUnallocated(bitmap []byte, summary *bitmapSummary) []string {
+	var dropped []ownedAlloc
+	nss.owned.ascend(func(a ownedAlloc) {
+		unitOffset := byteOffsetToUnitOffset(a.offset)
+		unitCnt := byteSizeToUnitCnt(a.offset+a.size) - unitOffset
+		if summary.findLeadingBitsCnt(bitmap, unitOffset, true) < unitCnt {
+			dropped = append(dropped, a)
+		}
+	})
+	problems := make([]string, 0, len(dropped))
+	for _, a := range dropped {
+		nss.remove(a.ns, a.offset)
+		problems = append(problems, fmt.Sprintf("allocation at %d with size %d of namespace %d is free in bitmap", a.offset, a.size, a.ns))
+	}
+	return problems
+}
+
+// decodeSection decodes the section of namespaces in trailer. The records should
+// be well-formed and the allocations should be allocated in bitmap.
+func (nss *namespaces) decodeSection(trailer *imageTrailer, bitmap []byte, summary *bitmapSummary) error {
+	payload, ok := trailer.sections[sectionNamespaces]
+	if !ok {
+		return nil
+	}
+	problems := nss.decode(payload)
+	problems = append(problems, nss.dropUnallocated(bitmap, summary)...)
+	if len(problems) > 0 {
+		return errors.Errorf("invalid namespaces in image trailer: %s", problems[0])
+	}
+	return nil
+}
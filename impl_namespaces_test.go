@@ -0,0 +1,85 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamespacesAdmit(t *testing.T) {
+	nss := newNamespaces()
+	require.NoError(t, nss.admit(DefaultNamespace, 100, 100))
+
+	require.NoError(t, nss.set(1, 3*unitSize, 2*unitSize, 10*unitSize))
+	require.ErrorContains(t, nss.set(2, unitSize, 2*unitSize, 10*unitSize), "reservation should not be larger than quota, got: 8192, 4096")
+	require.ErrorContains(t, nss.set(2, -1, 0, 10*unitSize), "quota and reservation should be non-negative, got: -1, 0")
+
+	// others can't take the 2 units reserved for namespace 1, and a partial
+	// unit is charged as a whole unit
+	require.ErrorIs(t, nss.admit(DefaultNamespace, 8*unitSize+sectorSize, 10*unitSize), ErrNoEnoughSpace)
+	require.NoError(t, nss.admit(DefaultNamespace, 8*unitSize, 10*unitSize))
+	// namespace 1 can use its reservation even if the free space is low
+	require.NoError(t, nss.admit(1, 2*unitSize, 2*unitSize))
+	require.ErrorIs(t, nss.admit(1, 3*unitSize+1, 10*unitSize), ErrQuotaExceeded)
+
+	nss.own(1, 4096, 2*unitSize+sectorSize)
+	require.EqualValues(t, 3*unitSize, nss.defs[1].used)
+	require.Zero(t, nss.outstanding(DefaultNamespace))
+	require.ErrorIs(t, nss.admit(1, 100, 10*unitSize), ErrQuotaExceeded)
+	require.ErrorContains(t, nss.set(1, 2*unitSize, 0, 10*unitSize), "quota 8192 is less than the used size 12288 of namespace 1")
+
+	err := nss.checkFree(DefaultNamespace, 4000, 100)
+	require.ErrorContains(t, err, "range at 4000 with size 100 overlaps allocations of namespace 1")
+	require.False(t, nss.overlaps(0, 4096))
+	require.True(t, nss.overlaps(12288, 1))
+	err = nss.checkFree(1, 4096, 100)
+	require.ErrorContains(t, err, "range at 4096 with size 100 is not an allocation of namespace 1")
+	require.NoError(t, nss.checkFree(1, 4096, 2*unitSize+sectorSize))
+	nss.remove(1, 4096)
+	require.Zero(t, nss.defs[1].used)
+	require.Zero(t, nss.owned.length)
+}
+
+func TestChargedSize(t *testing.T) {
+	require.EqualValues(t, sectorSize, chargedSize(100))
+	require.EqualValues(t, 3*sectorSize, chargedSize(3*sectorSize))
+	require.EqualValues(t, unitSize, chargedSize(unitSize))
+	require.EqualValues(t, 2*unitSize, chargedSize(unitSize+sectorSize))
+}
+
+func TestNamespacesEncode(t *testing.T) {
+	nss := newNamespaces()
+	require.NoError(t, nss.set(2, 0, 10, 1000))
+	require.NoError(t, nss.set(1, 8192, 0, 1000))
+	nss.own(1, 8192, 4096)
+	nss.own(2, 0, 512)
+	nss.own(1, 512, 1024)
+
+	decoded := newNamespaces()
+	require.Empty(t, decoded.decode(nss.encode()))
+	require.Equal(t, nss.defs, decoded.defs)
+	require.Equal(t, nss.encode(), decoded.encode())
+
+	bitmap := make([]byte, bitmapSize)
+	allocInBitmap(bitmap, 0, 1)
+	require.Equal(t, []string{"allocation at 8192 with size 4096 of namespace 1 is free in bitmap"},
+		decoded.dropUnallocated(bitmap, newBitmapSummary(bitmap)))
+	require.EqualValues(t, 1024, decoded.defs[1].used)
+
+	payload := nss.encode()
+	payload = binary.LittleEndian.AppendUint64(payload, 12288)
+	payload = binary.LittleEndian.AppendUint64(payload, 512)
+	payload = binary.LittleEndian.AppendUint32(payload, 3)
+	payload = binary.LittleEndian.AppendUint64(payload, 12000)
+	payload = binary.LittleEndian.AppendUint64(payload, 512)
+	payload = binary.LittleEndian.AppendUint32(payload, 1)
+	decoded = newNamespaces()
+	require.Equal(t, []string{
+		"allocation at 12288 with size 512 of namespace 3 belongs to unknown namespace",
+		"allocation at 12000 with size 512 of namespace 1 overlaps other allocations",
+	}, decoded.decode(payload))
+	require.Equal(t, nss.defs, decoded.defs)
+	require.Equal(t, nss.encode(), decoded.encode())
+	require.Equal(t, []string{"namespace section is truncated"}, newNamespaces().decode(payload[:3]))
+}
@@ -0,0 +1,287 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// refCounts records the reference counts of the allocated units that are shared
+// by IncRef. An allocated unit that is not in refCounts has a count of one, so
+// only the shared units take memory. The counts are kept as the runs of
+// continuous units of the same count, so sharing a large range changes a few
+// runs rather than every unit.
+type refCounts struct {
+	// runs don't overlap, and the adjacent runs have different counts.
+	runs *btree[unit, refCountRun]
+}
+
+func newRefCounts() *refCounts {
+	return &refCounts{runs: newBTree[unit, refCountRun]()}
+}
+
+// refCountRun is continuous units of the same count.
+type refCountRun struct {
+	offset unit
+	length unit
+	// extra is the count minus one, which is positive for the shared units.
+	extra uint32
+}
+
+func (r refCountRun) key() unit { return r.offset }
+
+// empty returns true if no unit is shared.
+func (rc *refCounts) empty() bool {
+	return rc.runs.length == 0
+}
+
+// in calls fn for the runs that overlap [offset, offset+length) in the
+// ascending order of offset, until fn returns false.
+func (rc *refCounts) in(offset, length unit, fn func(r refCountRun) bool) {
+	if r, ok := rc.runs.floor(offset); ok && r.offset < offset && r.offset+r.length > offset {
+		if !fn(r) {
+			return
+		}
+	}
+	rc.runs.ascendFrom(offset, func(r refCountRun) bool {
+		return r.offset < offset+length && fn(r)
+	})
+}
+
+// checkInc checks that the counts of the units in [offset, offset+length) can
+// be increased. The bad units can't be shared, and a count can't exceed the
+// maximum, or it would wrap around and release the shared units.
+func (rc *refCounts) checkInc(offset, length unit, bad *unitRanges) error {
+	if bad.overlaps(offset, length) {
+		return errors.Errorf("range at %d with size %d contains bad units",
+			unitOffsetToByteOffset(offset), unitOffsetToByteOffset(length))
+	}
+	var err error
+	rc.in(offset, length, func(r refCountRun) bool {
+		if r.extra == math.MaxUint32 {
+			err = errors.Errorf("reference count of unit at %d reaches the maximum",
+				unitOffsetToByteOffset(max(r.offset, offset)))
+		}
+		return err == nil
+	})
+	return err
+}
+
+// inc increases the counts of the units in [offset, offset+length), which
+// should be checked by checkInc.
+func (rc *refCounts) inc(offset, length unit) {
+	rc.update(offset, length, func(r refCountRun) uint32 {
+		return r.extra + 1
+	})
+}
+
+// release decreases the counts of the units in [offset, offset+length), and
+// calls fn for every continuous units whose count drops to zero, in the
+// ascending order of offset.
+func (rc *refCounts) release(offset, length unit, fn func(offset, length unit)) {
+	if rc.empty() {
+		fn(offset, length)
+		return
+	}
+	rc.update(offset, length, func(r refCountRun) uint32 {
+		if r.extra == 0 {
+			fn(r.offset, r.length)
+			return 0
+		}
+		return r.extra - 1
+	})
+}
+
+// update sets the counts of the units in [offset, offset+length). fn is called
+// in the ascending order of offset for the runs in the range and the units
+// between them, which are passed as runs whose extra is 0, and it returns the
+// new extra of them.
+func (rc *refCounts) update(offset, length unit, fn func(r refCountRun) uint32) {
+	end := offset + length
+	rc.split(offset)
+	rc.split(end)
+
+	var pieces []refCountRun
+	next := offset
+	rc.runs.ascendFrom(offset, func(r refCountRun) bool {
+		if r.offset >= end {
+			return false
+		}
+		if r.offset > next {
+			pieces = append(pieces, refCountRun{offset: next, length: r.offset - next})
+		}
+		pieces = append(pieces, r)
+		next = r.offset + r.length
+		return true
+	})
+	if end > next {
+		pieces = append(pieces, refCountRun{offset: next, length: end - next})
+	}
+
+	for _, p := range pieces {
+		extra := fn(p)
+		switch {
+		case p.extra == 0 && extra > 0:
+			rc.runs.insert(refCountRun{offset: p.offset, length: p.length, extra: extra})
+		case p.extra > 0 && extra == 0:
+			rc.runs.delete(p.offset)
+		case p.extra > 0:
+			r, _ := rc.runs.get(p.offset)
+			r.extra = extra
+		}
+	}
+	for _, p := range pieces {
+		rc.merge(p.offset)
+	}
+	rc.merge(end)
+}
+
+// split makes a run start at u if u is inside the run.
+func (rc *refCounts) split(u unit) {
+	r, ok := rc.runs.floor(u)
+	if !ok || r.offset == u || r.offset+r.length <= u {
+		return
+	}
+	first, _ := rc.runs.get(r.offset)
+	first.length = u - r.offset
+	rc.runs.insert(refCountRun{offset: u, length: r.offset + r.length - u, extra: r.extra})
+}
+
+// merge merges the run starting at u into the previous run if they're adjacent
+// and have the same count.
+func (rc *refCounts) merge(u unit) {
+	r, ok := rc.runs.get(u)
+	if !ok || u == 0 {
+		return
+	}
+	cur := *r
+	prev, ok := rc.runs.floor(u - 1)
+	if !ok || prev.offset+prev.length != u || prev.extra != cur.extra {
+		return
+	}
+	rc.runs.delete(u)
+	p, _ := rc.runs.get(prev.offset)
+	p.length += cur.length
+}
+
+// shared returns the shared units as the runs of the same count, in the
+// ascending order of offset.
+func (rc *refCounts) shared() []refCountRun {
+	runs := make([]refCountRun, 0, rc.runs.length)
+	rc.runs.ascend(func(r refCountRun) { runs = append(runs, r) })
+	return runs
+}
+
+// encode serializes the counts as the payload of the section, which is a
+// sequence of {offset uint32, length uint32, extra uint32} in the ascending
+// order of offset, where extra is the count minus one.
+func (rc *refCounts) encode() []byte {
+	runs := rc.shared()
+	buf := make([]byte, 0, len(runs)*12)
+	for _, r := range runs {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(r.offset))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(r.length))
+		buf = binary.LittleEndian.AppendUint32(buf, r.extra)
+	}
+	return buf
+}
+
+// decode adds the counts in the payload of the section to rc. The runs that are
+// malformed are skipped and reported in problems.
+func (rc *refCounts) decode(payload []byte) (problems []string) {
+	if len(payload)%12 != 0 {
+		return []string{"ref count section is truncated"}
+	}
+	for i := 0; i < len(payload); i += 12 {
+		offset := unit(binary.LittleEndian.Uint32(payload[i:]))
+		length := unit(binary.LittleEndian.Uint32(payload[i+4:]))
+		extra := binary.LittleEndian.Uint32(payload[i+8:])
+		var problem string
+		switch {
+		case length == 0:
+			problem = "is empty"
+		case uint64(offset)+uint64(length) > unitTotalCnt:
+			problem = "is out of range"
+		case extra == 0:
+			problem = "has no extra reference"
+		case rc.overlaps(offset, length):
+			problem = "overlaps other ref counts"
+		default:
+			rc.runs.insert(refCountRun{offset: offset, length: length, extra: extra})
+			rc.merge(offset)
+			rc.merge(offset + length)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("ref counts at unit %d with length %d %s", offset, length, problem))
+	}
+	return problems
+}
+
+// overlaps returns true if any unit in [offset, offset+length) is shared.
+func (rc *refCounts) overlaps(offset, length unit) bool {
+	ret := false
+	rc.in(offset, length, func(refCountRun) bool {
+		ret = true
+		return false
+	})
+	return ret
+}
+
+// dropUnallocated removes the counts of the units that are free in bitmap, and
+// returns their descriptions.
+func (rc *refCounts) dropUnallocated(bitmap []byte) []string {
+	var problems []string
+	for _, r := range rc.shared() {
+		for u := r.offset; u < r.offset+r.length; u++ {
+			if bitmap[u/8]&(1<<(u%8)) == 0 {
+				rc.update(u, 1, func(refCountRun) uint32 { return 0 })
+				problems = append(problems, fmt.Sprintf("ref count of unit %d is %d, but it's free in bitmap", u, r.extra+1))
+			}
+		}
+	}
+	return problems
+}
+
+// decodeSection decodes the section of ref counts in trailer. The runs should be
+// well-formed and all allocated in bitmap.
+func (rc *refCounts) decodeSection(trailer *imageTrailer, bitmap []byte) error {
+	problems := rc.decode(trailer.sections[sectionRefCounts])
+	problems = append(problems, rc.dropUnallocated(bitmap)...)
+	if len(problems) > 0 {
+		return errors.Errorf("invalid ref counts in image trailer: %s", problems[0])
+	}
+	return nil
+}
+
+// checkShared checks [offset, offset+size) for IncRef and DecRef. The range
+// should be aligned to units, allocated, and not reserved or owned by other
+// namespaces. It returns the units of the range.
+func checkShared(
+	offset int64,
+	size int64,
+	bitmap []byte,
+	summary *bitmapSummary,
+	reserved *unitRanges,
+	nss *namespaces,
+) (unit, unit, error) {
+	if err := checkRange(offset, size); err != nil {
+		return 0, 0, err
+	}
+	if offset%unitSize != 0 || size%unitSize != 0 {
+		return 0, 0, errors.Errorf("shared range should be aligned to 4KiB, got: %d, %d", offset, size)
+	}
+	unitOffset := byteOffsetToUnitOffset(offset)
+	unitCnt := byteSizeToUnitCnt(size)
+	if reserved.overlaps(unitOffset, unitCnt) {
+		return 0, 0, errors.Errorf("range at %d with size %d overlaps reserved ranges", offset, size)
+	}
+	if summary.findLeadingBitsCnt(bitmap, unitOffset, true) < unitCnt {
+		return 0, 0, errors.Errorf("range at %d with size %d is not allocated", offset, size)
+	}
+	if err := nss.checkFree(DefaultNamespace, offset, size); err != nil {
+		return 0, 0, err
+	}
+	return unitOffset, unitCnt, nil
+}
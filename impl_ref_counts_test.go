@@ -0,0 +1,123 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefCountsRelease(t *testing.T) {
+	rc := newRefCounts()
+	var released []location
+	collect := func(offset, length unit) {
+		released = append(released, location{offset: offset, length: length})
+	}
+	rc.release(0, 4, collect)
+	require.Equal(t, []location{{0, 4}}, released)
+
+	rc.inc(10, 4)
+	rc.inc(12, 4)
+	require.Equal(t, []refCountRun{
+		{offset: 10, length: 2, extra: 1},
+		{offset: 12, length: 2, extra: 2},
+		{offset: 14, length: 2, extra: 1},
+	}, rc.shared())
+
+	released = nil
+	rc.release(8, 10, collect)
+	require.Equal(t, []location{{8, 2}, {16, 2}}, released)
+	require.Equal(t, []refCountRun{{offset: 12, length: 2, extra: 1}}, rc.shared())
+
+	released = nil
+	rc.release(10, 6, collect)
+	require.Equal(t, []location{{10, 2}, {14, 2}}, released)
+	released = nil
+	rc.release(12, 2, collect)
+	require.Equal(t, []location{{12, 2}}, released)
+	require.True(t, rc.empty())
+}
+
+func TestRefCountsRandom(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	rc := newRefCounts()
+	expected := map[unit]uint32{}
+	for i := 0; i < 10000; i++ {
+		offset := unit(rnd.Intn(1000))
+		length := unit(rnd.Intn(100) + 1)
+		if rnd.Intn(2) == 0 {
+			rc.inc(offset, length)
+			for u := offset; u < offset+length; u++ {
+				expected[u]++
+			}
+			continue
+		}
+		var released, expectedReleased []unit
+		rc.release(offset, length, func(offset, length unit) {
+			for u := offset; u < offset+length; u++ {
+				released = append(released, u)
+			}
+		})
+		for u := offset; u < offset+length; u++ {
+			switch expected[u] {
+			case 0:
+				expectedReleased = append(expectedReleased, u)
+			case 1:
+				delete(expected, u)
+			default:
+				expected[u]--
+			}
+		}
+		require.Equal(t, expectedReleased, released)
+	}
+
+	got := map[unit]uint32{}
+	runs := rc.shared()
+	for i, r := range runs {
+		require.Positive(t, r.extra)
+		if i > 0 {
+			prev := runs[i-1]
+			require.False(t, prev.offset+prev.length == r.offset && prev.extra == r.extra, "runs %v and %v should be merged", prev, r)
+		}
+		for u := r.offset; u < r.offset+r.length; u++ {
+			got[u] = r.extra
+		}
+	}
+	require.Equal(t, expected, got)
+}
+
+func TestRefCountsEncode(t *testing.T) {
+	rc := newRefCounts()
+	rc.inc(1, 3)
+	rc.inc(2, 1)
+	rc.inc(100, 1)
+
+	decoded := newRefCounts()
+	require.Empty(t, decoded.decode(rc.encode()))
+	require.Equal(t, rc.shared(), decoded.shared())
+
+	bitmap := make([]byte, bitmapSize)
+	allocInBitmap(bitmap, 0, 8)
+	require.Equal(t, []string{"ref count of unit 100 is 2, but it's free in bitmap"}, decoded.dropUnallocated(bitmap))
+	require.Equal(t, []refCountRun{{offset: 1, length: 1, extra: 1}, {offset: 2, length: 1, extra: 2}, {offset: 3, length: 1, extra: 1}}, decoded.shared())
+
+	payload := rc.encode()
+	payload = binary.LittleEndian.AppendUint32(payload, 3)
+	payload = binary.LittleEndian.AppendUint32(payload, 2)
+	payload = binary.LittleEndian.AppendUint32(payload, 1)
+	payload = binary.LittleEndian.AppendUint32(payload, 200)
+	payload = binary.LittleEndian.AppendUint32(payload, 1)
+	payload = binary.LittleEndian.AppendUint32(payload, 0)
+	decoded = newRefCounts()
+	require.Equal(t, []string{
+		"ref counts at unit 3 with length 2 overlaps other ref counts",
+		"ref counts at unit 200 with length 1 has no extra reference",
+	}, decoded.decode(payload))
+	require.Equal(t, rc.shared(), decoded.shared())
+	require.Equal(t, []string{"ref count section is truncated"}, newRefCounts().decode(payload[:5]))
+}
@@ -0,0 +1,234 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sectorSize     = 512
+	sectorsPerUnit = unitSize / sectorSize // 8
+)
+
+// slab is a unit shared by the allocations smaller than unitSize. Bit i of mask
+// is set when the i-th sector of the unit is allocated.
+type slab struct {
+	offset unit
+	mask   uint8
+	// pos is the position in slabs.partial[longestFreeSectors(mask)]. It's -1
+	// when all sectors are allocated or the slab is retired.
+	pos int
+	// retired is true when the unit is bad, so its free sectors are not handed
+	// out any more.
+	retired bool
+}
+
+func (s *slab) key() unit { return s.offset }
+
+// slabs packs the allocations smaller than unitSize into partially used units.
+// A slab is allocated in the bitmap as a whole unit, and it's freed when all its
+// sectors are freed.
+type slabs struct {
+	units map[unit]*slab
+	// index orders the slabs by offset, so the slabs in a range are found
+	// without visiting every unit of it.
+	index *btree[unit, *slab]
+	// partial[n] has the slabs whose longest continuous free sectors is n.
+	partial [sectorsPerUnit][]*slab
+}
+
+func newSlabs() *slabs {
+	return &slabs{units: map[unit]*slab{}, index: newBTree[unit, *slab]()}
+}
+
+// sectorMask returns the mask of cnt sectors starting from the first sector.
+func sectorMask(first, cnt int) uint8 {
+	return uint8((1<<cnt - 1) << first)
+}
+
+// longestFreeSectors returns the number of the longest continuous free sectors
+// in mask.
+func longestFreeSectors(mask uint8) int {
+	ret, cur := 0, 0
+	for i := 0; i < sectorsPerUnit; i++ {
+		if mask&(1<<i) != 0 {
+			cur = 0
+			continue
+		}
+		cur++
+		ret = max(ret, cur)
+	}
+	return ret
+}
+
+// findFreeSectors returns the first sector of the first cnt continuous free
+// sectors in mask, or -1 if not found.
+func findFreeSectors(mask uint8, cnt int) int {
+	want := sectorMask(0, cnt)
+	for i := 0; i+cnt <= sectorsPerUnit; i++ {
+		if mask&(want<<i) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// setMask changes the mask of s and moves it to the matching partial list.
+func (ss *slabs) setMask(s *slab, mask uint8) {
+	if s.pos >= 0 {
+		list := ss.partial[longestFreeSectors(s.mask)]
+		last := len(list) - 1
+		list[s.pos] = list[last]
+		list[s.pos].pos = s.pos
+		list[last] = nil
+		ss.partial[longestFreeSectors(s.mask)] = list[:last]
+	}
+	s.mask = mask
+	s.pos = -1
+	if n := longestFreeSectors(mask); n > 0 && mask != 0 && !s.retired {
+		s.pos = len(ss.partial[n])
+		ss.partial[n] = append(ss.partial[n], s)
+	}
+}
+
+// take allocates cnt continuous sectors from the existing slabs. It returns the
+// unit and the first sector.
+func (ss *slabs) take(cnt int) (unit, int, bool) {
+	for n := cnt; n < sectorsPerUnit; n++ {
+		list := ss.partial[n]
+		if len(list) == 0 {
+			continue
+		}
+		s := list[len(list)-1]
+		first := findFreeSectors(s.mask, cnt)
+		ss.setMask(s, s.mask|sectorMask(first, cnt))
+		return s.offset, first, true
+	}
+	return 0, 0, false
+}
+
+// add records a newly allocated unit as a slab whose first cnt sectors are
+// allocated.
+func (ss *slabs) add(offset unit, cnt int) {
+	s := &slab{offset: offset, pos: -1}
+	ss.put(s)
+	ss.setMask(s, sectorMask(0, cnt))
+}
+
+// put records s in units and index.
+func (ss *slabs) put(s *slab) {
+	ss.units[s.offset] = s
+	ss.index.insert(s)
+}
+
+// delete is the opposite of put.
+func (ss *slabs) delete(offset unit) {
+	if _, ok := ss.units[offset]; ok {
+		delete(ss.units, offset)
+		ss.index.delete(offset)
+	}
+}
+
+// in calls fn for the slabs in [offset, offset+length) in the ascending order
+// of offset.
+func (ss *slabs) in(offset, length unit, fn func(s *slab)) {
+	ss.index.ascendFrom(offset, func(s *slab) bool {
+		if s.offset >= offset+length {
+			return false
+		}
+		fn(s)
+		return true
+	})
+}
+
+// release frees cnt sectors starting from the first sector of the unit. It
+// returns true when all sectors of the unit are freed, and the unit is no longer
+// a slab.
+func (ss *slabs) release(offset unit, first, cnt int) (bool, error) {
+	s, ok := ss.units[offset]
+	if !ok {
+		return false, errors.Errorf("unit at %d is not shared by sub-unit allocations", unitOffsetToByteOffset(offset))
+	}
+	mask := sectorMask(first, cnt)
+	if s.mask&mask != mask {
+		return false, errors.Errorf("sectors at %d with size %d are not allocated",
+			unitOffsetToByteOffset(offset)+int64(first*sectorSize), cnt*sectorSize)
+	}
+	if s.mask == mask {
+		ss.setMask(s, 0)
+		ss.delete(offset)
+		return true, nil
+	}
+	ss.setMask(s, s.mask&^mask)
+	return false, nil
+}
+
+// retire stops handing out the free sectors of the slabs in [offset,
+// offset+length). Their allocated sectors can still be released.
+func (ss *slabs) retire(offset, length unit) {
+	ss.in(offset, length, func(s *slab) {
+		s.retired = true
+		ss.setMask(s, s.mask)
+	})
+}
+
+// overlaps returns true if any unit in [offset, offset+length) is a slab.
+func (ss *slabs) overlaps(offset, length unit) bool {
+	ret := false
+	ss.index.ascendFrom(offset, func(s *slab) bool {
+		ret = s.offset < offset+length
+		return false
+	})
+	return ret
+}
+
+// sorted returns the slabs in the ascending order of offset.
+func (ss *slabs) sorted() []*slab {
+	ret := make([]*slab, 0, len(ss.units))
+	ss.index.ascend(func(s *slab) { ret = append(ret, s) })
+	return ret
+}
+
+// encode serializes the slabs as the payload of sectionSlabs, which is a
+// sequence of {offset uint32, mask uint8} in the ascending order of offset.
+func (ss *slabs) encode() []byte {
+	buf := make([]byte, 0, len(ss.units)*5)
+	for _, s := range ss.sorted() {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(s.offset))
+		buf = append(buf, s.mask)
+	}
+	return buf
+}
+
+// decodeSlabs decodes the payload of sectionSlabs. The slabs that are not
+// consistent with bitmap are skipped and reported in problems.
+func decodeSlabs(payload []byte, bitmap []byte) (_ *slabs, problems []string) {
+	ss := newSlabs()
+	if len(payload)%5 != 0 {
+		return ss, []string{"slab section is truncated"}
+	}
+	for i := 0; i < len(payload); i += 5 {
+		offset := unit(binary.LittleEndian.Uint32(payload[i:]))
+		mask := payload[i+4]
+		var problem string
+		switch {
+		case offset >= unitTotalCnt:
+			problem = "is out of range"
+		case mask == 0:
+			problem = "has no allocated sector"
+		case ss.units[offset] != nil:
+			problem = "is duplicated"
+		case bitmap[offset/8]&(1<<(offset%8)) == 0:
+			problem = "is free in bitmap"
+		default:
+			s := &slab{offset: offset, pos: -1}
+			ss.put(s)
+			ss.setMask(s, mask)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("slab at unit %d %s", offset, problem))
+	}
+	return ss, problems
+}
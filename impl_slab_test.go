@@ -0,0 +1,98 @@
+package disk_management_demo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSectorMask(t *testing.T) {
+	require.Equal(t, uint8(0b0000_0001), sectorMask(0, 1))
+	require.Equal(t, uint8(0b0011_1000), sectorMask(3, 3))
+	require.Equal(t, uint8(0b1111_1111), sectorMask(0, 8))
+
+	require.Equal(t, 8, longestFreeSectors(0))
+	require.Equal(t, 0, longestFreeSectors(0xFF))
+	require.Equal(t, 3, longestFreeSectors(0b1000_1101))
+	require.Equal(t, 4, longestFreeSectors(0b0000_1111))
+
+	require.Equal(t, 4, findFreeSectors(0b0000_1111, 4))
+	require.Equal(t, -1, findFreeSectors(0b0000_1111, 5))
+	require.Equal(t, 1, findFreeSectors(0b1000_1001, 2))
+	require.Equal(t, 4, findFreeSectors(0b1000_1001, 3))
+}
+
+func TestSlabs(t *testing.T) {
+	ss := newSlabs()
+	_, _, ok := ss.take(1)
+	require.False(t, ok)
+
+	ss.add(10, 3)
+	offset, first, ok := ss.take(2)
+	require.True(t, ok)
+	require.EqualValues(t, 10, offset)
+	require.Equal(t, 3, first)
+	_, _, ok = ss.take(4)
+	require.False(t, ok)
+	offset, first, ok = ss.take(3)
+	require.True(t, ok)
+	require.EqualValues(t, 10, offset)
+	require.Equal(t, 5, first)
+	require.Equal(t, uint8(0xFF), ss.units[10].mask)
+	require.Equal(t, -1, ss.units[10].pos)
+	_, _, ok = ss.take(1)
+	require.False(t, ok)
+
+	_, err := ss.release(11, 0, 1)
+	require.ErrorContains(t, err, "unit at 45056 is not shared by sub-unit allocations")
+	empty, err := ss.release(10, 3, 2)
+	require.NoError(t, err)
+	require.False(t, empty)
+	_, err = ss.release(10, 3, 1)
+	require.ErrorContains(t, err, "sectors at 42496 with size 512 are not allocated")
+	offset, first, ok = ss.take(1)
+	require.True(t, ok)
+	require.EqualValues(t, 10, offset)
+	require.Equal(t, 3, first)
+
+	ss.add(20, 1)
+	require.True(t, ss.overlaps(15, 6))
+	require.False(t, ss.overlaps(11, 9))
+	require.True(t, ss.overlaps(0, unitTotalCnt))
+	require.Equal(t, []unit{10, 20}, slabOffsets(ss))
+
+	bitmap := make([]byte, bitmapSize)
+	bitmap[1] = 0b0000_0100
+	bitmap[2] = 0b0001_0000
+	got, problems := decodeSlabs(ss.encode(), bitmap)
+	require.Empty(t, problems)
+	require.Equal(t, ss.units, got.units)
+	require.Equal(t, slabOffsets(ss), slabOffsets(got))
+
+	payload := ss.encode()
+	payload = append(payload, payload[:5]...)
+	payload = append(payload, 30, 0, 0, 0, 1)
+	got, problems = decodeSlabs(payload, bitmap)
+	require.Equal(t, []string{
+		"slab at unit 10 is duplicated",
+		"slab at unit 30 is free in bitmap",
+	}, problems)
+	require.Equal(t, ss.units, got.units)
+	_, problems = decodeSlabs(payload[:4], bitmap)
+	require.Equal(t, []string{"slab section is truncated"}, problems)
+
+	empty, err = ss.release(20, 0, 1)
+	require.NoError(t, err)
+	require.True(t, empty)
+	require.NotContains(t, ss.units, unit(20))
+	require.Equal(t, []unit{10}, slabOffsets(ss))
+	require.Empty(t, ss.partial[7])
+}
+
+func slabOffsets(ss *slabs) []unit {
+	var ret []unit
+	for _, s := range ss.sorted() {
+		ret = append(ret, s.offset)
+	}
+	return ret
+}
@@ -0,0 +1,222 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A snapshot is an image file next to the image file, named by snapshotPath. It
+// has the bitmap and the trailer of the manager when it's taken, plus a section
+// of snapshotInfo, so it can be checked and opened like a normal image.
+
+// snapshotFileInfix separates the image file name and the snapshot ID in the
+// name of a snapshot file.
+const snapshotFileInfix = ".snapshot-"
+
+func snapshotPath(imageFilePath string, id SnapshotID) string {
+	return imageFilePath + snapshotFileInfix + strconv.FormatUint(uint64(id), 10)
+}
+
+// snapshotIDs returns the IDs of the snapshot files of the image file in the
+// ascending order.
+func snapshotIDs(imageFilePath string) ([]SnapshotID, error) {
+	entries, err := os.ReadDir(filepath.Dir(imageFilePath))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	prefix := filepath.Base(imageFilePath) + snapshotFileInfix
+	var ids []SnapshotID
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || id == 0 {
+			continue
+		}
+		ids = append(ids, SnapshotID(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+const snapshotInfoSize = 8 + 8
+
+// encodeSnapshotInfo serializes the payload of the section, which is
+// {id uint64, createdAt int64} where createdAt is in Unix nanoseconds.
+func encodeSnapshotInfo(info SnapshotInfo) []byte {
+	buf := make([]byte, 0, snapshotInfoSize)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(info.ID))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(info.CreatedAt.UnixNano()))
+	return buf
+}
+
+func decodeSnapshotInfo(payload []byte) (SnapshotInfo, error) {
+	if len(payload) != snapshotInfoSize {
+		return SnapshotInfo{}, errors.Errorf("snapshot info section has %d bytes", len(payload))
+	}
+	return SnapshotInfo{
+		ID:        SnapshotID(binary.LittleEndian.Uint64(payload)),
+		CreatedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(payload[8:]))),
+	}, nil
+}
+
+// encodeSnapshotSeq serializes the payload of sectionSnapshotSeq, which is
+// {lastID uint64}.
+func encodeSnapshotSeq(lastID SnapshotID) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(lastID))
+}
+
+// decodeSnapshotSeq returns the largest snapshot ID recorded in trailer, or 0
+// if it's not recorded.
+func decodeSnapshotSeq(trailer *imageTrailer) (SnapshotID, error) {
+	payload, ok := trailer.sections[sectionSnapshotSeq]
+	if !ok {
+		return 0, nil
+	}
+	if len(payload) != 8 {
+		return 0, errors.Errorf("snapshot sequence section has %d bytes", len(payload))
+	}
+	return SnapshotID(binary.LittleEndian.Uint64(payload)), nil
+}
+
+// takeSnapshot writes bitmap and trailer as a new snapshot of the image file.
+// Its ID is larger than lastID, the largest ID ever assigned by the manager, and
+// the existing snapshots, so a deleted ID is not reused. The snapshot files are
+// also considered because lastID is persisted only by Close. trailer is
+// changed.
+func takeSnapshot(imageFilePath string, bitmap []byte, trailer *imageTrailer, lastID SnapshotID) (SnapshotID, error) {
+	ids, err := snapshotIDs(imageFilePath)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 {
+		lastID = max(lastID, ids[len(ids)-1])
+	}
+	id := lastID + 1
+	info := SnapshotInfo{ID: id, CreatedAt: time.Now()}
+	trailer.sections[sectionSnapshotInfo] = encodeSnapshotInfo(info)
+	trailer.sections[sectionSnapshotSeq] = encodeSnapshotSeq(id)
+	if err = writeFileAtomically(snapshotPath(imageFilePath, id), bitmap, trailer.encode()); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// listSnapshots returns the snapshots of the image file in the ascending order
+// of ID. Only the trailers of the snapshot files are read.
+func listSnapshots(imageFilePath string) ([]SnapshotInfo, error) {
+	ids, err := snapshotIDs(imageFilePath)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SnapshotInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := readSnapshotInfo(snapshotPath(imageFilePath, id))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "snapshot %d is broken", id)
+		}
+		if info.ID != id {
+			return nil, errors.Errorf("snapshot %d is broken: it records ID %d", id, info.ID)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// readSnapshotInfo reads the snapshot info in the trailer of the snapshot file,
+// skipping the bitmap.
+func readSnapshotInfo(path string) (SnapshotInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return SnapshotInfo{}, errors.WithStack(err)
+	}
+	defer f.Close()
+	if _, err = f.Seek(bitmapSize, io.SeekStart); err != nil {
+		return SnapshotInfo{}, errors.WithStack(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return SnapshotInfo{}, errors.WithStack(err)
+	}
+	trailer, err := decodeTrailer(data)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if trailer == nil {
+		return SnapshotInfo{}, errors.New("snapshot has no trailer")
+	}
+	return decodeSnapshotInfo(trailer.sections[sectionSnapshotInfo])
+}
+
+// checkSnapshotExists returns the path of the snapshot, or an error if it does
+// not exist.
+func checkSnapshotExists(imageFilePath string, id SnapshotID) (string, error) {
+	path := snapshotPath(imageFilePath, id)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", errors.Errorf("snapshot %d does not exist", id)
+		}
+		return "", errors.WithStack(err)
+	}
+	return path, nil
+}
+
+func deleteSnapshot(imageFilePath string, id SnapshotID) error {
+	path, err := checkSnapshotExists(imageFilePath, id)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(os.Remove(path))
+}
+
+// diffSnapshots compares the bitmaps of two snapshots, see Manager.DiffSnapshots.
+func diffSnapshots(imageFilePath string, from, to SnapshotID) ([]Extent, error) {
+	var bitmaps [2][]byte
+	for i, id := range []SnapshotID{from, to} {
+		path, err := checkSnapshotExists(imageFilePath, id)
+		if err != nil {
+			return nil, err
+		}
+		bitmaps[i] = make([]byte, bitmapSize)
+		if _, err = readImage(path, bitmaps[i]); err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("snapshot %d is broken", id))
+		}
+	}
+	return diffBitmaps(bitmaps[0], bitmaps[1]), nil
+}
+
+// diffBitmaps returns the continuous units whose bits are different in from and
+// to, in the ascending order of offset. The adjacent units are merged when they
+// have the same bit in to, which is reported as Allocated.
+func diffBitmaps(from, to []byte) []Extent {
+	var ret []Extent
+	for i := 0; i < len(from); i += 8 {
+		w := binary.LittleEndian.Uint64(to[i:])
+		changed := binary.LittleEndian.Uint64(from[i:]) ^ w
+		for changed != 0 {
+			bit := bits.TrailingZeros64(changed)
+			changed &= changed - 1
+			offset := unitOffsetToByteOffset(unit(i*8 + bit))
+			allocated := w&(1<<bit) != 0
+			if last := len(ret) - 1; last >= 0 &&
+				ret[last].Offset+ret[last].Size == offset && ret[last].Allocated == allocated {
+				ret[last].Size += unitSize
+				continue
+			}
+			ret = append(ret, Extent{Offset: offset, Size: unitSize, Allocated: allocated})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,35 @@
+package disk_management_demo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBitmaps(t *testing.T) {
+	from := make([]byte, bitmapSize)
+	to := make([]byte, bitmapSize)
+	require.Empty(t, diffBitmaps(from, to))
+
+	allocInBitmap(from, 0, 10)
+	allocInBitmap(to, 0, 4)
+	allocInBitmap(to, 10, 60)
+	allocInBitmap(to, 100, 1)
+	allocInBitmap(from, unitTotalCnt-1, 1)
+	require.Equal(t, []Extent{
+		{Offset: 4 * unitSize, Size: 6 * unitSize},
+		{Offset: 10 * unitSize, Size: 60 * unitSize, Allocated: true},
+		{Offset: 100 * unitSize, Size: unitSize, Allocated: true},
+		{Offset: spaceTotalSize - unitSize, Size: unitSize},
+	}, diffBitmaps(from, to))
+}
+
+func TestSnapshotInfo(t *testing.T) {
+	info := SnapshotInfo{ID: 3, CreatedAt: time.Unix(0, 1234567890)}
+	decoded, err := decodeSnapshotInfo(encodeSnapshotInfo(info))
+	require.NoError(t, err)
+	require.Equal(t, info, decoded)
+	_, err = decodeSnapshotInfo(nil)
+	require.ErrorContains(t, err, "snapshot info section has 0 bytes")
+}
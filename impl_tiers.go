@@ -0,0 +1,173 @@
+package disk_management_demo
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// tiers is the named regions of the storage defined by WithTiers. They are not
+// persisted, so they should be passed every time the image is opened.
+type tiers struct {
+	// ranges maps the name of a tier to its ranges, which are sorted by offset.
+	ranges map[string][]location
+}
+
+func newTiers(defs []Tier) (*tiers, error) {
+	t := &tiers{ranges: make(map[string][]location, len(defs))}
+	all := &unitRanges{name: "tier"}
+	for _, def := range defs {
+		if def.Name == "" {
+			return nil, errors.New("tier name should not be empty")
+		}
+		if _, ok := t.ranges[def.Name]; ok {
+			return nil, errors.Errorf("tier %s is defined twice", def.Name)
+		}
+		if len(def.Ranges) == 0 {
+			return nil, errors.Errorf("tier %s has no range", def.Name)
+		}
+		ranges := make([]location, 0, len(def.Ranges))
+		for _, r := range def.Ranges {
+			if err := checkRange(r.Offset, r.Size); err != nil {
+				return nil, err
+			}
+			if r.Offset%unitSize != 0 || r.Size%unitSize != 0 {
+				return nil, errors.Errorf("tier range should be aligned to 4KiB, got: %d, %d", r.Offset, r.Size)
+			}
+			l := location{offset: byteOffsetToUnitOffset(r.Offset), length: byteSizeToUnitCnt(r.Size)}
+			if all.overlaps(l.offset, l.length) {
+				return nil, errors.Errorf("range at %d with size %d of tier %s overlaps other tiers", r.Offset, r.Size, def.Name)
+			}
+			all.add(l.offset, l.length)
+			ranges = append(ranges, l)
+		}
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].offset < ranges[j].offset })
+		t.ranges[def.Name] = ranges
+	}
+	return t, nil
+}
+
+func (t *tiers) get(name string) ([]location, error) {
+	ranges, ok := t.ranges[name]
+	if !ok {
+		return nil, errors.Errorf("tier %s does not exist", name)
+	}
+	return ranges, nil
+}
+
+// contains returns true if [offset, offset+length) is inside one of ranges.
+func contains(ranges []location, offset, length unit) bool {
+	for _, r := range ranges {
+		if r.offset <= offset && offset+length <= r.offset+r.length {
+			return true
+		}
+	}
+	return false
+}
+
+// firstFitIn returns the lowest offset of cnt continuous free units inside
+// ranges.
+func (d *diskManagerImpl) firstFitIn(ranges []location, cnt unit) (unit, bool) {
+	for _, r := range ranges {
+		offset, end := r.offset, r.offset+r.length
+		for offset+cnt <= end {
+			offset += d.summary.findLeadingBitsCnt(d.bitmap[:], offset, true)
+			if offset+cnt > end {
+				break
+			}
+			n := d.summary.findLeadingBitsCnt(d.bitmap[:], offset, false)
+			if n >= cnt {
+				return offset, true
+			}
+			offset += n
+		}
+	}
+	return 0, false
+}
+
+// AllocInTier implements TierAllocator.AllocInTier.
+func (d *diskManagerImpl) AllocInTier(size int64, tier string, fallback bool) (int64, error) {
+	ranges, err := d.tiers.get(tier)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkAllocSize(size, d.largeAlloc); err != nil {
+		return 0, err
+	}
+	if err = d.namespaces.admit(DefaultNamespace, size, d.freeSize()); err != nil {
+		return 0, err
+	}
+
+	cnt := byteSizeToUnitCnt(size)
+	unitOffset, ok := d.firstFitIn(ranges, cnt)
+	if !ok {
+		if fallback {
+			return d.alloc(size)
+		}
+		return 0, ErrNoEnoughSpace
+	}
+	d.takeUnits(unitOffset, cnt)
+	if size < unitSize {
+		// like AllocAligned, the sectors are allocated from the start of a new
+		// slab in the tier
+		d.slabs.add(unitOffset, int(size/sectorSize))
+	}
+	return unitOffsetToByteOffset(unitOffset), nil
+}
+
+// TierStats implements TierAllocator.TierStats.
+func (d *diskManagerImpl) TierStats(tier string) (TierStats, error) {
+	ranges, err := d.tiers.get(tier)
+	if err != nil {
+		return TierStats{}, err
+	}
+	var s TierStats
+	for _, r := range ranges {
+		s.TotalSize += unitOffsetToByteOffset(r.length)
+		freeRunsIn(d.bitmap[:], d.summary, r.offset, r.length, func(l location) {
+			size := unitOffsetToByteOffset(l.length)
+			s.FreeSize += size
+			s.LargestFreeSize = max(s.LargestFreeSize, size)
+			s.FreeExtentCnt++
+		})
+	}
+	s.UsedSize = s.TotalSize - s.FreeSize
+	return s, nil
+}
+
+// MigrateToTier implements TierAllocator.MigrateToTier.
+func (d *diskManagerImpl) MigrateToTier(offset, size int64, tier string, relocate RelocateFunc) (int64, error) {
+	ranges, err := d.tiers.get(tier)
+	if err != nil {
+		return 0, err
+	}
+	if err = checkRange(offset, size); err != nil {
+		return 0, err
+	}
+	if offset%unitSize != 0 || size%unitSize != 0 {
+		return 0, errors.Errorf("migrated range should be aligned to 4KiB, got: %d, %d", offset, size)
+	}
+	l := location{offset: byteOffsetToUnitOffset(offset), length: byteSizeToUnitCnt(size)}
+	if d.summary.findLeadingBitsCnt(d.bitmap[:], l.offset, true) < l.length {
+		return 0, errors.Errorf("range at %d with size %d is not allocated", offset, size)
+	}
+	if !d.movable(l) {
+		return 0, errors.Errorf("range at %d with size %d can't be moved", offset, size)
+	}
+	if contains(ranges, l.offset, l.length) {
+		return offset, nil
+	}
+
+	dest, ok := d.firstFitIn(ranges, l.length)
+	if !ok {
+		return 0, ErrNoEnoughSpace
+	}
+	d.takeUnits(dest, l.length)
+	newOffset := unitOffsetToByteOffset(dest)
+	if err = relocate(offset, newOffset, size); err != nil {
+		d.freeUnits(dest, l.length)
+		return 0, err
+	}
+	d.freeUnits(l.offset, l.length)
+	return newOffset, nil
+}
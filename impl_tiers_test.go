@@ -0,0 +1,98 @@
+package disk_management_demo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTiers(t *testing.T) {
+	_, err := newTiers([]Tier{{Name: ""}})
+	require.ErrorContains(t, err, "tier name should not be empty")
+	_, err = newTiers([]Tier{{Name: "fast"}})
+	require.ErrorContains(t, err, "tier fast has no range")
+	_, err = newTiers([]Tier{{Name: "fast", Ranges: []Range{{Offset: 100, Size: unitSize}}}})
+	require.ErrorContains(t, err, "tier range should be aligned to 4KiB, got: 100, 4096")
+	_, err = newTiers([]Tier{
+		{Name: "fast", Ranges: []Range{{Offset: 0, Size: 2 * unitSize}}},
+		{Name: "fast", Ranges: []Range{{Offset: 2 * unitSize, Size: unitSize}}},
+	})
+	require.ErrorContains(t, err, "tier fast is defined twice")
+	_, err = newTiers([]Tier{
+		{Name: "fast", Ranges: []Range{{Offset: 0, Size: 2 * unitSize}}},
+		{Name: "slow", Ranges: []Range{{Offset: unitSize, Size: unitSize}}},
+	})
+	require.ErrorContains(t, err, "range at 4096 with size 4096 of tier slow overlaps other tiers")
+}
+
+func TestTiers(t *testing.T) {
+	tempFile := createFileWithContent(t, nil)
+	fast := Tier{Name: "fast", Ranges: []Range{
+		{Offset: 100 * unitSize, Size: 2 * unitSize},
+		{Offset: 10 * unitSize, Size: 4 * unitSize},
+	}}
+	slow := Tier{Name: "slow", Ranges: []Range{{Offset: 1000 * unitSize, Size: spaceTotalSize - 1000*unitSize}}}
+	m, err := newDiskManagerWithMutexImpl(tempFile, WithTiers(fast, slow))
+	require.NoError(t, err)
+	var tm TierAllocator = m
+
+	_, err = tm.AllocInTier(unitSize, "unknown", false)
+	require.ErrorContains(t, err, "tier unknown does not exist")
+	offset, err := tm.AllocInTier(3*unitSize, "fast", false)
+	require.NoError(t, err)
+	require.EqualValues(t, 10*unitSize, offset)
+	offset, err = tm.AllocInTier(2*unitSize, "fast", false)
+	require.NoError(t, err)
+	require.EqualValues(t, 100*unitSize, offset)
+	_, err = tm.AllocInTier(2*unitSize, "fast", false)
+	require.ErrorIs(t, err, ErrNoEnoughSpace)
+	// the fallback allocation is outside the tier, which is shown by its stats
+	_, err = tm.AllocInTier(2*unitSize, "fast", true)
+	require.NoError(t, err)
+
+	stats, err := tm.TierStats("fast")
+	require.NoError(t, err)
+	require.Equal(t, TierStats{
+		TotalSize:       6 * unitSize,
+		UsedSize:        5 * unitSize,
+		FreeSize:        unitSize,
+		LargestFreeSize: unitSize,
+		FreeExtentCnt:   1,
+	}, stats)
+
+	// move the hot data from the slow tier to the fast one
+	offset, err = tm.AllocInTier(unitSize, "slow", false)
+	require.NoError(t, err)
+	require.EqualValues(t, 1000*unitSize, offset)
+	_, err = tm.MigrateToTier(offset, 2*unitSize, "fast", nil)
+	require.ErrorContains(t, err, "range at 4096000 with size 8192 is not allocated")
+	_, err = tm.MigrateToTier(offset, unitSize, "fast", func(_, _, _ int64) error {
+		return errors.New("mock error")
+	})
+	require.ErrorContains(t, err, "mock error")
+	var moves []Relocation
+	relocate := func(oldOffset, newOffset, size int64) error {
+		moves = append(moves, Relocation{OldOffset: oldOffset, NewOffset: newOffset, Size: size})
+		return nil
+	}
+	newOffset, err := tm.MigrateToTier(offset, unitSize, "fast", relocate)
+	require.NoError(t, err)
+	require.EqualValues(t, 13*unitSize, newOffset)
+	require.Equal(t, []Relocation{{OldOffset: offset, NewOffset: newOffset, Size: unitSize}}, moves)
+	allocated, err := m.IsAllocated(offset, unitSize)
+	require.NoError(t, err)
+	require.False(t, allocated)
+	// the space already in the tier is not moved
+	got, err := tm.MigrateToTier(newOffset, unitSize, "fast", relocate)
+	require.NoError(t, err)
+	require.Equal(t, newOffset, got)
+	require.Len(t, moves, 1)
+
+	stats, err = tm.TierStats("fast")
+	require.NoError(t, err)
+	require.Zero(t, stats.FreeSize)
+	require.EqualValues(t, 8*unitSize, m.Stats().UsedSize)
+	require.NoError(t, verifyFreeSpaces(m.m.freeSpaces, m.m.bitmap[:], m.m.summary))
+	require.NoError(t, m.Close())
+}
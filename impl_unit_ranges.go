@@ -0,0 +1,235 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// unitRanges is a set of units that are allocated in the bitmap but don't
+// belong to the user data, like the units excluded by ReserveRange or retired by
+// MarkBad. The allocators never see them because they are allocated, and the
+// ranges are recorded as a section in the trailer to tell them from the user
+// data.
+type unitRanges struct {
+	// name is used in the messages, like "reserved".
+	name string
+	kind sectionKind
+	// ranges is sorted by offset. The overlapping and adjacent ranges are
+	// merged.
+	ranges []location
+	// total is the number of units in ranges.
+	total unit
+}
+
+func newReservedRanges() *unitRanges {
+	return &unitRanges{name: "reserved", kind: sectionReserved}
+}
+
+func newBadRanges() *unitRanges {
+	return &unitRanges{name: "bad", kind: sectionBad}
+}
+
+// search returns the index of the first range that ends after offset.
+func (rs *unitRanges) search(offset unit) int {
+	return sort.Search(len(rs.ranges), func(i int) bool {
+		return rs.ranges[i].offset+rs.ranges[i].length > offset
+	})
+}
+
+// next returns the first range that ends after offset.
+func (rs *unitRanges) next(offset unit) (location, bool) {
+	i := rs.search(offset)
+	if i == len(rs.ranges) {
+		return location{}, false
+	}
+	return rs.ranges[i], true
+}
+
+// overlaps returns true if any unit in [offset, offset+length) is in the ranges.
+func (rs *unitRanges) overlaps(offset, length unit) bool {
+	i := rs.search(offset)
+	return i < len(rs.ranges) && rs.ranges[i].offset < offset+length
+}
+
+// overlapsBytes is like overlaps, but it checks the units touched by the bytes
+// of [offset, offset+size).
+func (rs *unitRanges) overlapsBytes(offset int64, size int64) bool {
+	unitOffset := byteOffsetToUnitOffset(offset)
+	return rs.overlaps(unitOffset, byteSizeToUnitCnt(offset+size)-unitOffset)
+}
+
+// add adds [offset, offset+length) to the ranges, and merges it with the
+// overlapping and adjacent ones.
+func (rs *unitRanges) add(offset, length unit) {
+	start, end := offset, offset+length
+	// i is the first range that ends at or after start
+	i := sort.Search(len(rs.ranges), func(i int) bool {
+		return rs.ranges[i].offset+rs.ranges[i].length >= start
+	})
+	j := i
+	for ; j < len(rs.ranges) && rs.ranges[j].offset <= end; j++ {
+		start = min(start, rs.ranges[j].offset)
+		end = max(end, rs.ranges[j].offset+rs.ranges[j].length)
+		rs.total -= rs.ranges[j].length
+	}
+	rs.ranges = append(rs.ranges[:i], append([]location{{offset: start, length: end - start}}, rs.ranges[j:]...)...)
+	rs.total += end - start
+}
+
+// remove removes [offset, offset+length) from the ranges. All the units should
+// be in the ranges.
+func (rs *unitRanges) remove(offset, length unit) error {
+	i := rs.search(offset)
+	if i == len(rs.ranges) || rs.ranges[i].offset > offset ||
+		rs.ranges[i].offset+rs.ranges[i].length < offset+length {
+		return errors.Errorf("range at %d with size %d is not %s",
+			unitOffsetToByteOffset(offset), unitOffsetToByteOffset(length), rs.name)
+	}
+	r := rs.ranges[i]
+	var rest []location
+	if r.offset < offset {
+		rest = append(rest, location{offset: r.offset, length: offset - r.offset})
+	}
+	if end := offset + length; end < r.offset+r.length {
+		rest = append(rest, location{offset: end, length: r.offset + r.length - end})
+	}
+	rs.ranges = append(rs.ranges[:i], append(rest, rs.ranges[i+1:]...)...)
+	rs.total -= length
+	return nil
+}
+
+// cut removes the units in [offset, offset+length) from the ranges. Unlike
+// remove, the units don't need to be in the ranges.
+func (rs *unitRanges) cut(offset, length unit) {
+	end := offset + length
+	i := rs.search(offset)
+	j := i
+	var rest []location
+	for ; j < len(rs.ranges) && rs.ranges[j].offset < end; j++ {
+		r := rs.ranges[j]
+		if r.offset < offset {
+			rest = append(rest, location{offset: r.offset, length: offset - r.offset})
+		}
+		if rEnd := r.offset + r.length; rEnd > end {
+			rest = append(rest, location{offset: end, length: rEnd - end})
+		}
+		rs.total -= r.length
+	}
+	if i == j {
+		return
+	}
+	for _, r := range rest {
+		rs.total += r.length
+	}
+	rs.ranges = append(rs.ranges[:i], append(rest, rs.ranges[j:]...)...)
+}
+
+// gaps calls fn for every continuous units in [offset, offset+length) that are
+// not in the ranges, in the ascending order of offset.
+func (rs *unitRanges) gaps(offset, length unit, fn func(offset, length unit)) {
+	end := offset + length
+	for i := rs.search(offset); offset < end; i++ {
+		gapEnd := end
+		if i < len(rs.ranges) {
+			gapEnd = min(end, rs.ranges[i].offset)
+		}
+		if gapEnd > offset {
+			fn(offset, gapEnd-offset)
+		}
+		if i >= len(rs.ranges) {
+			return
+		}
+		offset = rs.ranges[i].offset + rs.ranges[i].length
+	}
+}
+
+// unallocated returns the ranges that are not all allocated in bitmap.
+func (rs *unitRanges) unallocated(bitmap []byte, summary *bitmapSummary) []location {
+	var ret []location
+	for _, r := range rs.ranges {
+		if summary.findLeadingBitsCnt(bitmap, r.offset, true) < r.length {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// freeRunsIn calls fn for every continuous free units in [offset,
+// offset+length) of bitmap. The runs are clipped to the range.
+func freeRunsIn(bitmap []byte, summary *bitmapSummary, offset, length unit, fn func(l location)) {
+	end := offset + length
+	for offset < end {
+		offset += summary.findLeadingBitsCnt(bitmap, offset, true)
+		if offset >= end {
+			return
+		}
+		n := min(summary.findLeadingBitsCnt(bitmap, offset, false), end-offset)
+		fn(location{offset: offset, length: n})
+		offset += n
+	}
+}
+
+// encode serializes the ranges as the payload of the section, which is a
+// sequence of {offset uint32, length uint32} in the ascending order of offset.
+func (rs *unitRanges) encode() []byte {
+	buf := make([]byte, 0, len(rs.ranges)*8)
+	for _, r := range rs.ranges {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(r.offset))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(r.length))
+	}
+	return buf
+}
+
+// decode adds the ranges in the payload of the section to rs. The ranges that
+// are malformed are skipped and reported in problems.
+func (rs *unitRanges) decode(payload []byte) (problems []string) {
+	if len(payload)%8 != 0 {
+		return []string{fmt.Sprintf("%s section is truncated", rs.name)}
+	}
+	for i := 0; i < len(payload); i += 8 {
+		offset := unit(binary.LittleEndian.Uint32(payload[i:]))
+		length := unit(binary.LittleEndian.Uint32(payload[i+4:]))
+		var problem string
+		switch {
+		case length == 0:
+			problem = "is empty"
+		case uint64(offset)+uint64(length) > unitTotalCnt:
+			problem = "is out of range"
+		case rs.overlaps(offset, length):
+			problem = "overlaps other ranges"
+		default:
+			rs.add(offset, length)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s range at unit %d with length %d %s", rs.name, offset, length, problem))
+	}
+	return problems
+}
+
+// decodeSection decodes the section of rs in trailer. The ranges should be
+// well-formed and all allocated in bitmap.
+func (rs *unitRanges) decodeSection(trailer *imageTrailer, bitmap []byte, summary *bitmapSummary) error {
+	problems := rs.decode(trailer.sections[rs.kind])
+	for _, r := range rs.unallocated(bitmap, summary) {
+		problems = append(problems, fmt.Sprintf("%s range at unit %d with length %d is free in bitmap", rs.name, r.offset, r.length))
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("invalid %s ranges in image trailer: %s", rs.name, problems[0])
+	}
+	return nil
+}
+
+// checkReservedRange checks the range of ReserveRange and UnreserveRange, which
+// should be aligned to units.
+func checkReservedRange(offset int64, size int64) error {
+	if err := checkRange(offset, size); err != nil {
+		return err
+	}
+	if offset%unitSize != 0 || size%unitSize != 0 {
+		return errors.Errorf("reserved range should be aligned to 4KiB, got: %d, %d", offset, size)
+	}
+	return nil
+}
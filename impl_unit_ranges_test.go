@@ -0,0 +1,102 @@
+package disk_management_demo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservedRanges(t *testing.T) {
+	rs := newReservedRanges()
+	require.False(t, rs.overlaps(0, unitTotalCnt))
+
+	rs.add(10, 5)
+	rs.add(20, 5)
+	rs.add(0, 2)
+	require.Equal(t, []location{{0, 2}, {10, 5}, {20, 5}}, rs.ranges)
+	// adjacent ranges are merged
+	rs.add(15, 5)
+	require.Equal(t, []location{{0, 2}, {10, 15}}, rs.ranges)
+	require.EqualValues(t, 17, rs.total)
+
+	require.True(t, rs.overlaps(1, 1))
+	require.False(t, rs.overlaps(2, 8))
+	require.True(t, rs.overlaps(2, 9))
+	require.True(t, rs.overlaps(24, 100))
+	require.False(t, rs.overlaps(25, 100))
+
+	require.ErrorContains(t, rs.remove(1, 2), "range at 4096 with size 8192 is not reserved")
+	require.ErrorContains(t, rs.remove(5, 1), "range at 20480 with size 4096 is not reserved")
+	require.NoError(t, rs.remove(12, 3))
+	require.Equal(t, []location{{0, 2}, {10, 2}, {15, 10}}, rs.ranges)
+	require.NoError(t, rs.remove(0, 2))
+	require.Equal(t, []location{{10, 2}, {15, 10}}, rs.ranges)
+	require.EqualValues(t, 12, rs.total)
+
+	decoded := newReservedRanges()
+	problems := decoded.decode(rs.encode())
+	require.Empty(t, problems)
+	require.Equal(t, rs, decoded)
+
+	bitmap := make([]byte, bitmapSize)
+	allocInBitmap(bitmap, 10, 2)
+	require.Equal(t, []location{{15, 10}}, decoded.unallocated(bitmap, newBitmapSummary(bitmap)))
+
+	payload := rs.encode()
+	payload = append(payload, payload[8:]...)
+	payload = append(payload, 0, 0, 0, 0, 0, 0, 0, 0)
+	decoded = newReservedRanges()
+	problems = decoded.decode(payload)
+	require.Equal(t, []string{
+		"reserved range at unit 15 with length 10 overlaps other ranges",
+		"reserved range at unit 0 with length 0 is empty",
+	}, problems)
+	require.Equal(t, rs, decoded)
+	problems = newReservedRanges().decode(payload[:3])
+	require.Equal(t, []string{"reserved section is truncated"}, problems)
+}
+
+func TestUnitRangesGaps(t *testing.T) {
+	rs := newBadRanges()
+	rs.add(10, 5)
+	rs.add(20, 5)
+
+	var got []location
+	collect := func(offset, length unit) {
+		got = append(got, location{offset: offset, length: length})
+	}
+	rs.gaps(0, 30, collect)
+	require.Equal(t, []location{{0, 10}, {15, 5}, {25, 5}}, got)
+	got = nil
+	rs.gaps(12, 10, collect)
+	require.Equal(t, []location{{15, 5}}, got)
+	got = nil
+	rs.gaps(11, 3, collect)
+	require.Empty(t, got)
+
+	bitmap := make([]byte, bitmapSize)
+	allocInBitmap(bitmap, 3, 2)
+	got = nil
+	freeRunsIn(bitmap, newBitmapSummary(bitmap), 1, 8, func(l location) {
+		got = append(got, l)
+	})
+	require.Equal(t, []location{{1, 2}, {5, 4}}, got)
+}
+
+func TestUnitRangesCut(t *testing.T) {
+	rs := newBadRanges()
+	rs.add(10, 5)
+	rs.add(20, 5)
+	rs.add(30, 5)
+
+	rs.cut(0, 10)
+	require.Equal(t, []location{{10, 5}, {20, 5}, {30, 5}}, rs.ranges)
+	rs.cut(12, 10)
+	require.Equal(t, []location{{10, 2}, {22, 3}, {30, 5}}, rs.ranges)
+	rs.cut(31, 2)
+	require.Equal(t, []location{{10, 2}, {22, 3}, {30, 1}, {33, 2}}, rs.ranges)
+	require.EqualValues(t, 8, rs.total)
+	rs.cut(0, 100)
+	require.Empty(t, rs.ranges)
+	require.Zero(t, rs.total)
+}
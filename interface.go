@@ -1,27 +1,290 @@
 package disk_management_demo
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 var (
 	ErrNoEnoughSpace = errors.New("no enough space")
 	ErrOverflow      = errors.New("offset overflow")
+	// ErrQuotaExceeded is returned when an allocation exceeds the quota of its
+	// namespace, while there may still be enough space in the storage.
+	ErrQuotaExceeded = errors.New("quota exceeded")
 )
 
+// NamespaceID identifies a namespace, which is a tenant sharing the storage.
+type NamespaceID uint32
+
+// DefaultNamespace is the namespace of Alloc, AllocAligned and Free. It has no
+// quota or reservation, and its usage is not tracked.
+const DefaultNamespace NamespaceID = 0
+
 // Manager uses a local file to provide a simple disk space allocation management
 // interface. All data are persisted in the file.
 type Manager interface {
 	// Alloc reserves a space of given size and returns the start offset of it.
+	// The size should not exceed 4MiB unless the Manager is created with
+	// WithLargeAlloc. A size smaller than a unit is packed with other such
+	// allocations into a shared unit at 512B granularity.
 	//
 	// If the storage is full, it returns ErrNoEnoughSpace.
 	Alloc(size int64) (startOffset int64, err error)
-	// Free releases the space of [startOffset, startOffset+size).
+	// AllocAligned is like Alloc, but the returned startOffset is a multiple of
+	// alignment, which should be a positive multiple of a unit. A size smaller
+	// than a unit is not packed with the existing allocations. Alloc doesn't
+	// avoid the aligned space, so mixing it with Alloc may break up the aligned
+	// regions, and AllocAligned may fail when the free space is enough.
+	AllocAligned(size int64, alignment int64) (startOffset int64, err error)
+	// Free releases the space of [startOffset, startOffset+size). The space
+	// inside a shared unit is freed at 512B granularity, and the shared unit is
+	// released when all its space is freed.
 	//
 	// If startOffset+size is larger than the size of the storage, it returns
 	// ErrOverflow.
 	Free(startOffset int64, size int64) error
+	// IsAllocated reports whether all the space of [startOffset,
+	// startOffset+size) is allocated.
+	IsAllocated(startOffset int64, size int64) (bool, error)
+	// ReserveRange excludes the space of [startOffset, startOffset+size) from
+	// allocation until UnreserveRange is called, like the superblock or a
+	// metadata area. The range should be aligned to units and all free. Free
+	// refuses to release the reserved space.
+	ReserveRange(startOffset int64, size int64) error
+	// UnreserveRange makes the reserved space of [startOffset, startOffset+size)
+	// free again.
+	UnreserveRange(startOffset int64, size int64) error
+	// MarkBad retires the units touched by [startOffset, startOffset+size)
+	// forever, like the ones reporting media errors. The free units are taken
+	// out of allocation at once, and the allocated ones are kept allocated when
+	// they are freed. It can't be used on the reserved space.
+	MarkBad(startOffset int64, size int64) error
+	// IncRef adds a reference to the allocated space of [startOffset,
+	// startOffset+size), so it can be shared, like by the files of a snapshot.
+	// The range should be aligned to units. It can't be used on the reserved
+	// space, the sub-unit allocations or the allocations of namespaces.
+	IncRef(startOffset int64, size int64) error
+	// DecRef drops a reference to the space of [startOffset, startOffset+size),
+	// which has the same requirements as IncRef. A unit is released only when
+	// its last reference is dropped. Free also drops one reference of the
+	// shared units rather than releasing them.
+	DecRef(startOffset int64, size int64) error
+	// SetNamespace creates the namespace or updates its quota and reservation.
+	// The allocations of a namespace can't exceed its quota, where 0 means no
+	// limit. The reservation is the size guaranteed to the namespace, so the
+	// allocations of others can't take the space it hasn't used. If the free
+	// space can't guarantee all reservations, it returns ErrNoEnoughSpace.
+	SetNamespace(ns NamespaceID, quota int64, reservation int64) error
+	// AllocIn is like Alloc, but the allocation belongs to the namespace. If it
+	// exceeds the quota of the namespace, it returns ErrQuotaExceeded.
+	AllocIn(ns NamespaceID, size int64) (startOffset int64, err error)
+	// FreeIn releases an allocation returned by AllocIn of the namespace. Unlike
+	// Free, the allocation can only be freed as a whole.
+	FreeIn(ns NamespaceID, startOffset int64, size int64) error
+	// NamespaceStats returns the quota, reservation and usage of the namespace.
+	NamespaceStats(ns NamespaceID) (NamespaceStats, error)
+	// Snapshot persists a point-in-time copy of the allocation state as a file
+	// next to the image file, and returns its ID. The IDs always increase, and
+	// the ID of a deleted snapshot is not reused. It doesn't change the
+	// generation of the image. The snapshot is not changed by the later
+	// operations.
+	Snapshot() (SnapshotID, error)
+	// ListSnapshots returns the snapshots in the ascending order of ID.
+	ListSnapshots() ([]SnapshotInfo, error)
+	// DeleteSnapshot removes the snapshot.
+	DeleteSnapshot(id SnapshotID) error
+	// RestoreSnapshot rolls back the allocation state to the snapshot, which is
+	// kept. The restored state is persisted by Close like other changes.
+	RestoreSnapshot(id SnapshotID) error
+	// DiffSnapshots returns the continuous units whose allocation status is
+	// changed from snapshot from to snapshot to, in the ascending order of
+	// offset. Allocated is the status in snapshot to. The sub-unit allocations
+	// are compared by their units.
+	DiffSnapshots(from, to SnapshotID) ([]Extent, error)
+	// Stats returns the current usage of the storage. A unit shared by the
+	// allocations smaller than a unit is counted as used as a whole.
+	Stats() Stats
+	// Extents calls fn for every continuous space that has the same allocation
+	// status, in the ascending order of offset. It stops when fn returns false.
+	Extents(fn func(e Extent) bool)
 	Close() error
 }
 
+// Defragmenter is implemented by the Managers that can compact the free space
+// by moving the allocations, like the one created by NewDiskManager.
+type Defragmenter interface {
+	// Defragment moves the allocated extents whose both neighbours are free to
+	// other free spaces, so the neighbours are merged into larger continuous
+	// free spaces. The smallest extents are moved first, until the total moved
+	// size would exceed budget or ctx is done.
+	//
+	// For every move, the new space is allocated first, then relocate is called
+	// to copy the data, and the old space is freed only if relocate succeeds.
+	// relocate is called with the Manager locked, so it should not call the
+	// Manager. If relocate fails, the move is undone and the error is returned.
+	// The extents containing the reserved, bad, shared or sub-unit allocations,
+	// or the allocations of namespaces, are not moved.
+	//
+	// It returns the finished moves. With DefragDryRun, the moves are planned in
+	// the same way on a copy of the free spaces without calling relocate, so
+	// the Manager is not changed.
+	Defragment(ctx context.Context, budget int64, relocate RelocateFunc, opts ...DefragOption) ([]Relocation, error)
+}
+
+// TierAllocator is implemented by the Managers that can place the allocations
+// in the tiers defined by WithTiers, like the one created by
+// NewDiskManagerWithOptions. Alloc and AllocAligned still use any free space.
+type TierAllocator interface {
+	// AllocInTier is like Alloc, but the space is inside a range of the tier.
+	// If the tier has no enough continuous free space, it returns
+	// ErrNoEnoughSpace, or allocates like Alloc when fallback is true. A size
+	// smaller than a unit is not packed with the existing allocations.
+	AllocInTier(size int64, tier string, fallback bool) (startOffset int64, err error)
+	// TierStats returns the usage of the tier.
+	TierStats(tier string) (TierStats, error)
+	// MigrateToTier moves the allocated space of [startOffset,
+	// startOffset+size) into the tier and returns the new start offset. It
+	// returns startOffset if the space is already inside a range of the tier.
+	// Like Defragment, the new space is allocated first, then relocate is
+	// called with the Manager locked to copy the data, and the old space is
+	// freed only if relocate succeeds. The range should be aligned to units and
+	// have the same requirements as the extents moved by Defragment.
+	MigrateToTier(startOffset, size int64, tier string, relocate RelocateFunc) (int64, error)
+}
+
+// RangeAllocator is implemented by the Managers that can allocate the given
+// space, like the one created by NewDiskManager. It's used to restore the
+// allocations that are recorded by the user of a Manager but lost by a crash,
+// because a Manager is only persisted when it's closed.
+type RangeAllocator interface {
+	// AllocRange allocates exactly the space of [startOffset,
+	// startOffset+size), which should be aligned to units and all free. Like
+	// ReserveRange, the space is not charged to any namespace.
+	AllocRange(startOffset int64, size int64) error
+}
+
+// Tier is a named region of the storage, like the fast region of a device. The
+// ranges should be aligned to units and not overlap other tiers.
+type Tier struct {
+	Name   string
+	Ranges []Range
+}
+
+// TierStats is the usage of a tier. All sizes are in bytes. The reserved and
+// bad space in the tier is counted as used.
+type TierStats struct {
+	TotalSize       int64
+	UsedSize        int64
+	FreeSize        int64
+	LargestFreeSize int64
+	FreeExtentCnt   int64
+}
+
+// Discarder is notified of the space released by the Manager, like to TRIM the
+// SSD or punch holes in a backing file, see WithDiscarder. The ranges are
+// aligned to units, sorted by offset and not adjacent to each other. The space
+// may be allocated again after Discard returns.
+type Discarder interface {
+	Discard(ranges []Range) error
+}
+
+// RelocateFunc copies size bytes of data from oldOffset to newOffset.
+type RelocateFunc func(oldOffset, newOffset, size int64) error
+
+// Relocation is a move of an allocated extent made by Defragment.
+type Relocation struct {
+	OldOffset int64
+	NewOffset int64
+	Size      int64
+}
+
+// DefragProgress is reported by Defragment after every move.
+type DefragProgress struct {
+	MovedCnt  int
+	MovedSize int64
+	// FreeExtentCnt and LargestFreeSize are the free space status after the
+	// moves.
+	FreeExtentCnt   int64
+	LargestFreeSize int64
+}
+
+// SnapshotID identifies a snapshot of a Manager, starting from 1.
+type SnapshotID uint64
+
+// SnapshotInfo describes a snapshot taken by Manager.Snapshot.
+type SnapshotInfo struct {
+	ID        SnapshotID
+	CreatedAt time.Time
+}
+
+// Stats is the usage of the storage. All sizes are in bytes.
+type Stats struct {
+	TotalSize int64
+	UnitSize  int64
+	// UsedSize is the size of the allocated space, excluding the reserved and
+	// bad ones.
+	UsedSize int64
+	FreeSize int64
+	// ReservedSize is the size of the space reserved by ReserveRange.
+	ReservedSize int64
+	// BadSize is the size of the space retired by MarkBad, which is excluded
+	// from the usable capacity.
+	BadSize int64
+	// LargestFreeSize is the size of the largest continuous free space.
+	LargestFreeSize int64
+	// FreeExtentCnt is the number of continuous free spaces.
+	FreeExtentCnt int64
+	// FreeHistogram is the distribution of the sizes of continuous free spaces.
+	// Only the non-empty ranges are included, in the ascending order of size.
+	FreeHistogram []HistogramBucket
+}
+
+// NamespaceStats is the usage of a namespace. All sizes are in bytes.
+type NamespaceStats struct {
+	Quota       int64
+	Reservation int64
+	// UsedSize is the total size of the allocations of the namespace, as they
+	// are requested.
+	UsedSize int64
+}
+
+// HistogramBucket counts the continuous free spaces whose size is in [MinSize,
+// MaxSize].
+type HistogramBucket struct {
+	MinSize int64
+	MaxSize int64
+	Count   int64
+}
+
+// Extent is a continuous space of the storage.
+type Extent struct {
+	Offset    int64
+	Size      int64
+	Allocated bool
+	// Reserved is true for the space reserved by ReserveRange, which is also
+	// Allocated.
+	Reserved bool
+	// Bad is true for the space retired by MarkBad, which is also Allocated.
+	Bad bool
+	// Packed is true for an allocated unit shared by the allocations smaller
+	// than a unit.
+	Packed bool
+	// Shared is true for the allocated space whose reference count is
+	// increased by IncRef.
+	Shared bool
+	// Namespace is the namespace of the allocated space, which is
+	// DefaultNamespace for the space of Alloc. It's not reported for a Packed
+	// unit, whose allocations may belong to different namespaces.
+	Namespace NamespaceID
+}
+
+// Range is a space of the storage starting at Offset.
+type Range struct {
+	Offset int64
+	Size   int64
+}
+
 // ManagerConstructor is a function type that creates a Manager. The content of
 // Manager is stored in a file specified by imageFilePath.
 type ManagerConstructor func(imageFilePath string) (Manager, error)
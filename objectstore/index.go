@@ -0,0 +1,212 @@
+package objectstore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// The index file is a header followed by the records of the updates, all
+// integers are little-endian:
+//
+//	magic   [4]byte, "DMOS"
+//	version uint32
+//	records {length uint32, crc uint32, payload [length]byte}
+//
+// where crc is the CRC-32C of payload, and payload is
+//
+//	op       uint8, opPut or opDelete
+//	keyLen   uint32
+//	key      [keyLen]byte
+//	chunkCnt uint32, only for opPut
+//	chunks   chunkCnt * {offset int64, size int64}
+//
+// A record is appended and synced for every update, so an update is persisted
+// as a whole or not at all. A torn record at the end left by a crash is
+// dropped when the index is loaded. The index is compacted into one opPut
+// record per key by rewriting the file atomically.
+const (
+	indexMagic            = "DMOS"
+	indexVersion          = 1
+	indexHeaderSize       = 8
+	recordHeaderSize      = 8
+	opPut            byte = 1
+	opDelete         byte = 2
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// chunk is a continuous space of the block store holding a part of a value.
+type chunk struct {
+	offset int64
+	size   int64
+}
+
+type record struct {
+	op     byte
+	key    string
+	chunks []chunk
+}
+
+func (r record) encode() []byte {
+	payload := make([]byte, 0, 1+4+len(r.key)+4+16*len(r.chunks))
+	payload = append(payload, r.op)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(r.key)))
+	payload = append(payload, r.key...)
+	if r.op == opPut {
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(r.chunks)))
+		for _, c := range r.chunks {
+			payload = binary.LittleEndian.AppendUint64(payload, uint64(c.offset))
+			payload = binary.LittleEndian.AppendUint64(payload, uint64(c.size))
+		}
+	}
+	buf := make([]byte, 0, recordHeaderSize+len(payload))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(payload, castagnoli))
+	return append(buf, payload...)
+}
+
+func decodeRecord(payload []byte) (record, error) {
+	var r record
+	if len(payload) < 5 {
+		return r, errors.Errorf("record has %d bytes", len(payload))
+	}
+	r.op = payload[0]
+	keyLen := int(binary.LittleEndian.Uint32(payload[1:]))
+	payload = payload[5:]
+	if len(payload) < keyLen {
+		return r, errors.Errorf("key of %d bytes is truncated", keyLen)
+	}
+	r.key = string(payload[:keyLen])
+	payload = payload[keyLen:]
+	switch r.op {
+	case opDelete:
+		if len(payload) != 0 {
+			return r, errors.Errorf("delete record has %d extra bytes", len(payload))
+		}
+	case opPut:
+		if len(payload) < 4 {
+			return r, errors.New("chunk count is truncated")
+		}
+		cnt := int(binary.LittleEndian.Uint32(payload))
+		payload = payload[4:]
+		if len(payload) != 16*cnt {
+			return r, errors.Errorf("%d chunks should have %d bytes, got: %d", cnt, 16*cnt, len(payload))
+		}
+		r.chunks = make([]chunk, cnt)
+		for i := range r.chunks {
+			r.chunks[i] = chunk{
+				offset: int64(binary.LittleEndian.Uint64(payload[16*i:])),
+				size:   int64(binary.LittleEndian.Uint64(payload[16*i+8:])),
+			}
+		}
+	default:
+		return r, errors.Errorf("unknown op %d", r.op)
+	}
+	return r, nil
+}
+
+func indexHeader() []byte {
+	buf := make([]byte, 0, indexHeaderSize)
+	buf = append(buf, indexMagic...)
+	return binary.LittleEndian.AppendUint32(buf, indexVersion)
+}
+
+// loadIndex replays the records of the index file into a map from key to
+// chunks, and returns the number of replayed records and the size of the valid
+// prefix of the file. A missing file is an empty index.
+func loadIndex(path string) (map[string][]chunk, int, int64, error) {
+	index := map[string][]chunk{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, errors.WithStack(err)
+	}
+	if len(data) < indexHeaderSize || string(data[:4]) != indexMagic {
+		return nil, 0, 0, errors.New("invalid index file: bad magic")
+	}
+	if v := binary.LittleEndian.Uint32(data[4:]); v != indexVersion {
+		return nil, 0, 0, errors.Errorf("invalid index file: unsupported version %d", v)
+	}
+
+	pos, cnt := indexHeaderSize, 0
+	for len(data)-pos >= recordHeaderSize {
+		length := int(binary.LittleEndian.Uint32(data[pos:]))
+		crc := binary.LittleEndian.Uint32(data[pos+4:])
+		if len(data)-pos-recordHeaderSize < length {
+			break
+		}
+		payload := data[pos+recordHeaderSize : pos+recordHeaderSize+length]
+		if crc32.Checksum(payload, castagnoli) != crc {
+			break
+		}
+		r, err := decodeRecord(payload)
+		if err != nil {
+			return nil, 0, 0, errors.WithMessagef(err, "invalid index file: record at %d", pos)
+		}
+		if r.op == opPut {
+			index[r.key] = r.chunks
+		} else {
+			delete(index, r.key)
+		}
+		pos += recordHeaderSize + length
+		cnt++
+	}
+	return index, cnt, int64(pos), nil
+}
+
+// openIndexLog opens the index file for appending records after the valid
+// prefix of size bytes, dropping the torn record after it.
+func openIndexLog(path string, size int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if size == 0 {
+		if _, err = f.Write(indexHeader()); err != nil {
+			_ = f.Close()
+			return nil, errors.WithStack(err)
+		}
+		size = indexHeaderSize
+	}
+	if err = f.Truncate(size); err != nil {
+		_ = f.Close()
+		return nil, errors.WithStack(err)
+	}
+	if _, err = f.Seek(size, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, errors.WithStack(err)
+	}
+	return f, errors.WithStack(f.Sync())
+}
+
+// writeIndex writes one opPut record per key as the new index file atomically.
+func writeIndex(path string, index map[string][]chunk) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "index")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	buf := indexHeader()
+	for key, chunks := range index {
+		buf = append(buf, record{op: opPut, key: key, chunks: chunks}.encode()...)
+	}
+	if _, err = f.Write(buf); err != nil {
+		_ = f.Close()
+		return errors.WithStack(err)
+	}
+	// the content should be durable before it replaces the old index
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.WithStack(err)
+	}
+	if err = f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(f.Name(), path))
+}
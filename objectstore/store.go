@@ -0,0 +1,273 @@
+// Package objectstore stores keyed blobs in the space allocated by a
+// disk-management-demo Manager.
+package objectstore
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	dm "github.com/lance6716/disk-management-demo"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+const (
+	// chunkSize is the largest space of a value allocated at once, which is the
+	// allocation limit of a Manager. A larger value is scattered over multiple
+	// chunks.
+	chunkSize = 4 * 1024 * 1024
+	// compactThreshold is the number of the records in the index file that
+	// don't describe the current keys, above which the file is compacted.
+	compactThreshold = 1024
+)
+
+// Store maps keys to values stored in a dm.BlockStore. The key index is
+// persisted in a log file, and every update is synced before it takes effect,
+// so it survives crashes. A value is written to newly allocated space before
+// its record is appended, and the space of the overwritten or deleted value is
+// freed after it, so a key never points to freed space. Like other users of a
+// Manager, the Manager should be closed after the Store to persist the
+// allocations. If it's not, like after a crash, the allocations are reconciled
+// with the index when the Store is opened again. It's thread-safe.
+type Store struct {
+	mu sync.RWMutex
+
+	blocks    *dm.BlockStore
+	indexPath string
+	log       *os.File
+	logSize   int64
+	// recordCnt is the number of the records in the index file.
+	recordCnt int
+	index     map[string][]chunk
+}
+
+// Open opens the store whose values are in the data file or block device at
+// dataPath and whose index is at indexPath. Both files are created if they do
+// not exist. The Store owns all the space allocated by Alloc of m: the chunks
+// in the index that are free in m are allocated again, which needs m to
+// implement dm.RangeAllocator, and the other space allocated by Alloc is freed,
+// see dm.BlockStore.Reconcile.
+func Open(m dm.Manager, dataPath, indexPath string) (*Store, error) {
+	index, recordCnt, size, err := loadIndex(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := dm.OpenBlockStore(m, dataPath)
+	if err != nil {
+		return nil, err
+	}
+	var used []dm.Range
+	for _, chunks := range index {
+		for _, c := range chunks {
+			used = append(used, dm.Range{Offset: c.offset, Size: c.size})
+		}
+	}
+	if err = blocks.Reconcile(used); err != nil {
+		_ = blocks.Close()
+		return nil, errors.WithMessage(err, "failed to reconcile the index with the manager")
+	}
+	log, err := openIndexLog(indexPath, size)
+	if err != nil {
+		_ = blocks.Close()
+		return nil, err
+	}
+	return &Store{
+		blocks:    blocks,
+		indexPath: indexPath,
+		log:       log,
+		logSize:   max(size, indexHeaderSize),
+		recordCnt: recordCnt,
+		index:     index,
+	}, nil
+}
+
+// Put stores value as the value of key, replacing the existing one.
+func (s *Store) Put(key string, value []byte) error {
+	if key == "" {
+		return errors.New("key should not be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chunks := make([]chunk, 0, (len(value)+chunkSize-1)/chunkSize)
+	for start := 0; start < len(value); start += chunkSize {
+		data := value[start:min(start+chunkSize, len(value))]
+		offset, err := s.blocks.Put(data)
+		if err != nil {
+			return s.withFreed(err, chunks)
+		}
+		chunks = append(chunks, chunk{offset: offset, size: int64(len(data))})
+	}
+	if err := s.blocks.Sync(); err != nil {
+		return s.withFreed(err, chunks)
+	}
+	if err := s.appendRecord(record{op: opPut, key: key, chunks: chunks}); err != nil {
+		return s.withFreed(err, chunks)
+	}
+	old := s.index[key]
+	s.index[key] = chunks
+	if err := s.free(old); err != nil {
+		return err
+	}
+	return s.maybeCompact()
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (s *Store) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chunks, ok := s.index[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	value := make([]byte, 0, totalSize(chunks))
+	for _, c := range chunks {
+		data, err := s.blocks.Get(c.offset, c.size)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read key %q", key)
+		}
+		value = append(value, data...)
+	}
+	return value, nil
+}
+
+// Delete removes key and frees the space of its value, or returns ErrNotFound.
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chunks, ok := s.index[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := s.appendRecord(record{op: opDelete, key: key}); err != nil {
+		return err
+	}
+	delete(s.index, key)
+	if err := s.free(chunks); err != nil {
+		return err
+	}
+	return s.maybeCompact()
+}
+
+// List returns the keys with the prefix in the ascending order.
+func (s *Store) List(prefix string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []string
+	for key := range s.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close compacts the index and closes the files. It does not close the
+// Manager.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.compact()
+	if err2 := s.log.Close(); err == nil {
+		err = errors.WithStack(err2)
+	}
+	if err2 := s.blocks.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// appendRecord appends r to the index file and syncs it. A partially written
+// record is truncated.
+func (s *Store) appendRecord(r record) error {
+	buf := r.encode()
+	if _, err := s.log.Write(buf); err != nil {
+		return errors.WithStack(s.rollbackLog(err))
+	}
+	if err := s.log.Sync(); err != nil {
+		return errors.WithStack(s.rollbackLog(err))
+	}
+	s.logSize += int64(len(buf))
+	s.recordCnt++
+	return nil
+}
+
+func (s *Store) rollbackLog(err error) error {
+	if err2 := s.log.Truncate(s.logSize); err2 != nil {
+		return withCleanupError(err, err2)
+	}
+	if _, err2 := s.log.Seek(s.logSize, 0); err2 != nil {
+		return withCleanupError(err, err2)
+	}
+	return err
+}
+
+// withCleanupError returns err with the failure of its cleanup attached after
+// it, so err is still the first thing to read.
+func withCleanupError(err, cleanup error) error {
+	return fmt.Errorf("%w (cleanup also failed: %v)", err, cleanup)
+}
+
+func (s *Store) maybeCompact() error {
+	if s.recordCnt-len(s.index) <= compactThreshold {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact rewrites the index file with only the current keys.
+func (s *Store) compact() error {
+	if err := writeIndex(s.indexPath, s.index); err != nil {
+		return err
+	}
+	info, err := os.Stat(s.indexPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	log, err := openIndexLog(s.indexPath, info.Size())
+	if err != nil {
+		return err
+	}
+	// the old file is already replaced, so its error doesn't matter
+	_ = s.log.Close()
+	s.log = log
+	s.logSize = info.Size()
+	s.recordCnt = len(s.index)
+	return nil
+}
+
+func (s *Store) free(chunks []chunk) error {
+	for _, c := range chunks {
+		if err := s.blocks.Delete(c.offset, c.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withFreed frees the chunks written by a failed Put and returns err.
+func (s *Store) withFreed(err error, chunks []chunk) error {
+	if err2 := s.free(chunks); err2 != nil {
+		return withCleanupError(err, err2)
+	}
+	return err
+}
+
+func totalSize(chunks []chunk) int64 {
+	var size int64
+	for _, c := range chunks {
+		size += c.size
+	}
+	return size
+}
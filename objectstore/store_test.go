@@ -0,0 +1,158 @@
+package objectstore
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	dm "github.com/lance6716/disk-management-demo"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStore(t *testing.T, dir string) (dm.Manager, *Store) {
+	imagePath := path.Join(dir, "image")
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		require.NoError(t, dm.FormatImage(imagePath))
+	}
+	m, err := dm.NewDiskManager(imagePath)
+	require.NoError(t, err)
+	s, err := Open(m, path.Join(dir, "data"), path.Join(dir, "index"))
+	require.NoError(t, err)
+	return m, s
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	m, s := openTestStore(t, dir)
+
+	require.ErrorContains(t, s.Put("", []byte("v")), "key should not be empty")
+	_, err := s.Get("a")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, s.Delete("a"), ErrNotFound)
+
+	large := bytes.Repeat([]byte("0123456789"), chunkSize/10*2+100)
+	require.NoError(t, s.Put("a/1", []byte("hello")))
+	require.NoError(t, s.Put("a/2", large))
+	require.NoError(t, s.Put("b", nil))
+	// the large value is scattered over 3 chunks
+	require.Len(t, s.index["a/2"], 3)
+	require.EqualValues(t, 4096+int64(len(large)+4095)/4096*4096, m.Stats().UsedSize)
+
+	got, err := s.Get("a/2")
+	require.NoError(t, err)
+	require.Equal(t, large, got)
+	got, err = s.Get("b")
+	require.NoError(t, err)
+	require.Empty(t, got)
+	require.Equal(t, []string{"a/1", "a/2", "b"}, s.List(""))
+	require.Equal(t, []string{"a/1", "a/2"}, s.List("a/"))
+
+	// overwriting and deleting reclaim the space
+	require.NoError(t, s.Put("a/2", []byte("world")))
+	require.NoError(t, s.Delete("a/1"))
+	require.EqualValues(t, 4096, m.Stats().UsedSize)
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+
+	m, s = openTestStore(t, dir)
+	require.Equal(t, []string{"a/2", "b"}, s.List(""))
+	got, err = s.Get("a/2")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), got)
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+}
+
+func TestStoreCrash(t *testing.T) {
+	dir := t.TempDir()
+	m, s := openTestStore(t, dir)
+	require.NoError(t, s.Put("a", []byte("1")))
+	require.NoError(t, s.Put("b", []byte("2")))
+	require.NoError(t, s.Delete("a"))
+	// crash without closing the store, leaving a torn record
+	f, err := os.OpenFile(path.Join(dir, "index"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	torn := record{op: opPut, key: "c", chunks: []chunk{{offset: 0, size: 1}}}.encode()
+	_, err = f.Write(torn[:len(torn)-1])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, m.Close())
+
+	m, s = openTestStore(t, dir)
+	require.Equal(t, []string{"b"}, s.List(""))
+	require.NoError(t, s.Put("c", []byte("3")))
+	got, err := s.Get("c")
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), got)
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+
+	// the index is rejected if its chunks are not allocated and the manager
+	// can't allocate them again
+	buddyImagePath := path.Join(t.TempDir(), "image")
+	require.NoError(t, dm.FormatImage(buddyImagePath))
+	b, err := dm.NewBuddyManager(buddyImagePath)
+	require.NoError(t, err)
+	_, err = Open(b, path.Join(dir, "data"), path.Join(dir, "index"))
+	require.ErrorContains(t, err, "failed to reconcile the index with the manager: range at 0 with size 4096 is not allocated in the manager")
+}
+
+func TestStoreCrashWithoutClosingManager(t *testing.T) {
+	dir := t.TempDir()
+	m, s := openTestStore(t, dir)
+	require.NoError(t, s.Put("a", []byte("1")))
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+
+	// crash without closing the store and the manager, so the allocations of
+	// "b" and "c" are lost, and the one of "a" is kept after it's deleted
+	m, s = openTestStore(t, dir)
+	large := bytes.Repeat([]byte{1}, chunkSize+1)
+	require.NoError(t, s.Put("b", large))
+	require.NoError(t, s.Put("c", []byte("3")))
+	require.NoError(t, s.Delete("a"))
+	require.NoError(t, s.blocks.Close())
+	require.NoError(t, s.log.Close())
+
+	m, s = openTestStore(t, dir)
+	require.Equal(t, []string{"b", "c"}, s.List(""))
+	require.EqualValues(t, chunkSize+2*4096, m.Stats().UsedSize)
+	got, err := s.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, large, got)
+	// the new values don't overwrite the restored ones
+	require.NoError(t, s.Put("d", []byte("4")))
+	got, err = s.Get("c")
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), got)
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+
+	// the space allocated but never indexed is freed, like when the manager is
+	// closed but the store is not
+	m, s = openTestStore(t, dir)
+	_, err = s.blocks.Put([]byte("5"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+	m, s = openTestStore(t, dir)
+	require.EqualValues(t, chunkSize+3*4096, m.Stats().UsedSize)
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+}
+
+func TestStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	m, s := openTestStore(t, dir)
+	for i := 0; i <= compactThreshold+1; i++ {
+		require.NoError(t, s.Put("k", []byte{byte(i)}))
+	}
+	require.Equal(t, 1, s.recordCnt)
+	info, err := os.Stat(path.Join(dir, "index"))
+	require.NoError(t, err)
+	require.EqualValues(t, s.logSize, info.Size())
+	require.EqualValues(t, 4096, m.Stats().UsedSize)
+	require.NoError(t, s.Close())
+	require.NoError(t, m.Close())
+}
@@ -0,0 +1,96 @@
+package disk_management_demo
+
+import "time"
+
+// Option configures the Manager created by NewDiskManagerWithOptions.
+type Option func(*options)
+
+type options struct {
+	lazyRecovery bool
+	largeAlloc   bool
+	discarder    Discarder
+	discardDelay time.Duration
+	mirror       string
+	tiers        []Tier
+}
+
+// WithLazyRecovery makes the Manager return before all continuous free spaces
+// are loaded from the image. The loading continues in the background, and
+// meanwhile Alloc is served from the loaded part and Free waits for the part it
+// touches to be loaded. The free space related fields of Stats only reflect the
+// loaded part until the loading is finished.
+func WithLazyRecovery() Option {
+	return func(o *options) {
+		o.lazyRecovery = true
+	}
+}
+
+// WithLargeAlloc allows Alloc and AllocAligned to allocate more than 4MiB, up to
+// the size of the storage. Such allocations are served from the smallest
+// continuous free space that can hold them, while the smaller ones are not
+// affected.
+func WithLargeAlloc() Option {
+	return func(o *options) {
+		o.largeAlloc = true
+	}
+}
+
+// WithDiscarder makes the Manager pass the released units to discarder. The
+// units released by an operation are discarded before it returns when delay is
+// zero. Otherwise, they are collected and discarded in a batch every delay, and
+// the ones allocated again in between are not discarded, so a unit is discarded
+// after being free for delay to 2*delay. The rest are discarded by Close, which
+// also returns the first error of discarder. The image is only written by
+// Close, so a crash may leave the discarded units allocated in the image.
+func WithDiscarder(discarder Discarder, delay time.Duration) Option {
+	return func(o *options) {
+		o.discarder = discarder
+		o.discardDelay = delay
+	}
+}
+
+// WithMirror makes the Manager write every checkpoint of the image file to
+// mirrorFilePath as well, which should be on another device. When opening, the
+// copy of the newest valid generation is used, and a missing, corrupt or stale
+// copy is rewritten from it. If both copies are valid in the same generation but
+// diverge, the image file wins. Only the image file is mirrored: the snapshot
+// files of Manager.Snapshot are written next to the image file only, so they're
+// lost with its device. There's no journal to mirror, because all metadata is
+// in the image file.
+func WithMirror(mirrorFilePath string) Option {
+	return func(o *options) {
+		o.mirror = mirrorFilePath
+	}
+}
+
+// WithTiers defines the tiers of the storage for TierAllocator. The tiers are
+// not persisted in the image, so they should be given every time it's opened.
+func WithTiers(tiers ...Tier) Option {
+	return func(o *options) {
+		o.tiers = tiers
+	}
+}
+
+// DefragOption configures Defragmenter.Defragment.
+type DefragOption func(*defragOptions)
+
+// defragOptions configures Defragment.
+type defragOptions struct {
+	dryRun   bool
+	progress func(DefragProgress)
+}
+
+// DefragDryRun makes Defragment plan the relocations without calling relocate
+// or changing the allocations.
+func DefragDryRun() DefragOption {
+	return func(o *defragOptions) {
+		o.dryRun = true
+	}
+}
+
+// DefragProgressFunc makes Defragment call fn after every relocation.
+func DefragProgressFunc(fn func(DefragProgress)) DefragOption {
+	return func(o *defragOptions) {
+		o.progress = fn
+	}
+}
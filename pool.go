@@ -0,0 +1,617 @@
+package disk_management_demo
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DeviceID identifies a device of a Pool, which is the index of its image file
+// passed to OpenPool.
+type DeviceID uint32
+
+// poolOffsetBits is the number of the low bits of a Pool offset that hold the
+// offset in the device. The high bits hold the DeviceID.
+const poolOffsetBits = 40
+
+// PoolOffset returns the offset used by Pool for the offset in the device.
+func PoolOffset(dev DeviceID, offset int64) int64 {
+	return int64(dev)<<poolOffsetBits | offset
+}
+
+// SplitPoolOffset returns the device and the offset in the device of a Pool
+// offset.
+func SplitPoolOffset(offset int64) (DeviceID, int64) {
+	return DeviceID(offset >> poolOffsetBits), offset & (spaceTotalSize - 1)
+}
+
+// ErrDeviceUnavailable is returned when the space of a Pool is on a device
+// whose image can't be opened.
+var ErrDeviceUnavailable = errors.New("device unavailable")
+
+// PlacementStrategy decides which device of a Pool serves an allocation.
+type PlacementStrategy int
+
+const (
+	// PlaceFillFirst uses the devices in the order of DeviceID, so a device is
+	// used only after the previous ones are full.
+	PlaceFillFirst PlacementStrategy = iota
+	// PlaceRoundRobin uses the devices in turn.
+	PlaceRoundRobin
+	// PlaceMostFree uses the device with the most free space.
+	PlaceMostFree
+)
+
+// PoolExtent is a continuous space of a device of a Pool. Offset is the offset
+// in the device.
+type PoolExtent struct {
+	Device DeviceID
+	Offset int64
+	Size   int64
+}
+
+// StripedAlloc is an allocation of Pool.AllocStriped. Its space is divided into
+// stripes of StripeSize, and the stripes are placed on the devices of Extents in
+// turn. The space on a device is its extents in order, which are adjacent in
+// Extents, and the stripes on it are continuous in that space.
+type StripedAlloc struct {
+	StripeSize int64
+	Extents    []PoolExtent
+}
+
+// parts returns the extents of every device in the order of the stripes.
+func (s StripedAlloc) parts() [][]PoolExtent {
+	var ret [][]PoolExtent
+	for i, e := range s.Extents {
+		if i == 0 || e.Device != s.Extents[i-1].Device {
+			ret = append(ret, nil)
+		}
+		ret[len(ret)-1] = append(ret[len(ret)-1], e)
+	}
+	return ret
+}
+
+// Locate returns the device and the offset in the device of the byte at offset
+// of the allocation.
+func (s StripedAlloc) Locate(offset int64) (DeviceID, int64) {
+	parts := s.parts()
+	stripe := offset / s.StripeSize
+	part := parts[stripe%int64(len(parts))]
+	pos := stripe/int64(len(parts))*s.StripeSize + offset%s.StripeSize
+	for _, e := range part[:len(part)-1] {
+		if pos < e.Size {
+			return e.Device, e.Offset + pos
+		}
+		pos -= e.Size
+	}
+	e := part[len(part)-1]
+	return e.Device, e.Offset + pos
+}
+
+// Pool aggregates the Managers of multiple devices behind the Manager
+// interface. An offset of Pool holds the DeviceID in its high bits, see
+// PoolOffset and SplitPoolOffset, and a range can't cross devices. A device
+// whose image can't be opened is unavailable: the allocations skip it and the
+// operations on its space return ErrDeviceUnavailable.
+//
+// The quota and reservation of a namespace apply to the whole Pool, so they're
+// kept by the Pool in memory rather than by the devices, and SetNamespace should
+// be called again after OpenPool. The allocations of the namespace are still
+// recorded by the devices, from which its usage is rebuilt.
+//
+// Snapshots are taken on the devices separately, see Device. Like the Managers,
+// it's thread-safe.
+type Pool struct {
+	strategy PlacementStrategy
+	devices  []Manager
+	// openErrs holds the errors of the unavailable devices.
+	openErrs map[DeviceID]error
+
+	mu   sync.Mutex
+	next int
+
+	// nsMu serializes the allocations when namespaces are used, so they're
+	// admitted against the latest usage.
+	nsMu       sync.Mutex
+	namespaces *namespaces
+}
+
+var errPoolSnapshot = errors.New("snapshots of Pool should be taken on the devices")
+
+// OpenPool opens the devices of imageFilePaths by newManager, or NewDiskManager
+// if it's nil. It fails only when no device can be opened.
+func OpenPool(imageFilePaths []string, strategy PlacementStrategy, newManager ManagerConstructor) (*Pool, error) {
+	if newManager == nil {
+		newManager = NewDiskManager
+	}
+	p := &Pool{
+		strategy:   strategy,
+		devices:    make([]Manager, len(imageFilePaths)),
+		openErrs:   map[DeviceID]error{},
+		namespaces: newNamespaces(),
+	}
+	for i, path := range imageFilePaths {
+		m, err := newManager(path)
+		if err != nil {
+			p.openErrs[DeviceID(i)] = err
+			continue
+		}
+		p.devices[i] = m
+	}
+	if len(p.openErrs) == len(imageFilePaths) {
+		if len(imageFilePaths) == 0 {
+			return nil, errors.New("no device given")
+		}
+		return nil, errors.WithMessage(p.openErrs[0], "no device can be opened")
+	}
+	return p, nil
+}
+
+// Device returns the Manager of the device, or ErrDeviceUnavailable.
+func (p *Pool) Device(dev DeviceID) (Manager, error) {
+	if int(dev) >= len(p.devices) {
+		return nil, errors.Errorf("device %d does not exist", dev)
+	}
+	if p.devices[dev] == nil {
+		return nil, errors.WithMessagef(ErrDeviceUnavailable, "device %d: %v", dev, p.openErrs[dev])
+	}
+	return p.devices[dev], nil
+}
+
+// Unavailable returns the errors of opening the unavailable devices.
+func (p *Pool) Unavailable() map[DeviceID]error {
+	ret := make(map[DeviceID]error, len(p.openErrs))
+	for dev, err := range p.openErrs {
+		ret[dev] = err
+	}
+	return ret
+}
+
+// candidates returns the available devices in the order that the strategy
+// tries them.
+func (p *Pool) candidates() []DeviceID {
+	ret := make([]DeviceID, 0, len(p.devices))
+	for i, m := range p.devices {
+		if m != nil {
+			ret = append(ret, DeviceID(i))
+		}
+	}
+	switch p.strategy {
+	case PlaceRoundRobin:
+		p.mu.Lock()
+		start := p.next % len(ret)
+		p.next = start + 1
+		p.mu.Unlock()
+		ret = append(ret[start:], ret[:start]...)
+	case PlaceMostFree:
+		free := make(map[DeviceID]int64, len(ret))
+		for _, dev := range ret {
+			free[dev] = deviceFreeSize(p.devices[dev])
+		}
+		sort.SliceStable(ret, func(i, j int) bool { return free[ret[i]] > free[ret[j]] })
+	}
+	return ret
+}
+
+// place calls alloc on the devices in the order of the strategy until it
+// doesn't return ErrNoEnoughSpace, and returns the Pool offset.
+func (p *Pool) place(alloc func(m Manager) (int64, error)) (int64, error) {
+	for _, dev := range p.candidates() {
+		offset, err := alloc(p.devices[dev])
+		if errors.Is(err, ErrNoEnoughSpace) {
+			continue
+		}
+		if err != nil {
+			return 0, errors.WithMessagef(err, "device %d", dev)
+		}
+		return PoolOffset(dev, offset), nil
+	}
+	return 0, ErrNoEnoughSpace
+}
+
+// locate returns the Manager and the offset in the device of the range.
+func (p *Pool) locate(startOffset, size int64) (Manager, int64, error) {
+	if startOffset < 0 || size < 0 {
+		return nil, 0, errors.Errorf("invalid range at %d with size %d", startOffset, size)
+	}
+	dev, offset := SplitPoolOffset(startOffset)
+	if offset+size > spaceTotalSize {
+		return nil, 0, errors.Errorf("range at %d with size %d crosses devices", startOffset, size)
+	}
+	m, err := p.Device(dev)
+	return m, offset, err
+}
+
+// freeSizer is implemented by the Managers of this package, which count the
+// free units and need not collect the free extents like Stats.
+type freeSizer interface {
+	currentFreeSize() int64
+}
+
+// deviceFreeSize returns the free size of the device.
+func deviceFreeSize(m Manager) int64 {
+	if f, ok := m.(freeSizer); ok {
+		return f.currentFreeSize()
+	}
+	return m.Stats().FreeSize
+}
+
+// freeSize returns the total free size of the available devices.
+func (p *Pool) freeSize() int64 {
+	var ret int64
+	for _, m := range p.devices {
+		if m != nil {
+			ret += deviceFreeSize(m)
+		}
+	}
+	return ret
+}
+
+// admit checks whether the namespace can allocate size bytes in the Pool, see
+// namespaces.admit. It should be called with nsMu held.
+func (p *Pool) admit(ns NamespaceID, size int64) error {
+	if len(p.namespaces.defs) == 0 && ns == DefaultNamespace {
+		return nil
+	}
+	return p.namespaces.admit(ns, size, p.freeSize())
+}
+
+// Alloc implements Manager.Alloc.
+func (p *Pool) Alloc(size int64) (int64, error) {
+	p.nsMu.Lock()
+	defer p.nsMu.Unlock()
+	if err := p.admit(DefaultNamespace, size); err != nil {
+		return 0, err
+	}
+	return p.place(func(m Manager) (int64, error) { return m.Alloc(size) })
+}
+
+// AllocAligned implements Manager.AllocAligned. The alignment applies to the
+// offset in the device.
+func (p *Pool) AllocAligned(size int64, alignment int64) (int64, error) {
+	p.nsMu.Lock()
+	defer p.nsMu.Unlock()
+	if err := p.admit(DefaultNamespace, size); err != nil {
+		return 0, err
+	}
+	return p.place(func(m Manager) (int64, error) { return m.AllocAligned(size, alignment) })
+}
+
+// AllocStriped allocates size bytes striped across all available devices in
+// stripes of stripeSize, which should be a positive multiple of a unit. The
+// space on every device is allocated in extents of at most 4MiB, the allocation
+// limit of a Manager, and the last stripe is allocated fully even if size is not
+// a multiple of stripeSize. A small allocation only uses the devices of its
+// stripes.
+func (p *Pool) AllocStriped(size, stripeSize int64) (StripedAlloc, error) {
+	if stripeSize <= 0 || stripeSize%unitSize != 0 {
+		return StripedAlloc{}, errors.Errorf("stripe size should be a positive multiple of 4KiB, got: %d", stripeSize)
+	}
+	if size <= 0 {
+		return StripedAlloc{}, errors.Errorf("size should be positive, got: %d", size)
+	}
+	p.nsMu.Lock()
+	defer p.nsMu.Unlock()
+	if err := p.admit(DefaultNamespace, size); err != nil {
+		return StripedAlloc{}, err
+	}
+	devs := p.candidates()
+	stripeCnt := (size + stripeSize - 1) / stripeSize
+	devs = devs[:min(int64(len(devs)), stripeCnt)]
+	ret := StripedAlloc{StripeSize: stripeSize}
+	for i, dev := range devs {
+		// the stripes i, i+n, i+2n... are on the device
+		cnt := (stripeCnt - int64(i) + int64(len(devs)) - 1) / int64(len(devs))
+		for remain := cnt * stripeSize; remain > 0; {
+			extentSize := min(remain, allocLimit)
+			offset, err := p.devices[dev].Alloc(extentSize)
+			if err != nil {
+				err = errors.WithMessagef(err, "device %d", dev)
+				if err2 := p.FreeStriped(ret); err2 != nil {
+					return StripedAlloc{}, withCleanupError(err, err2)
+				}
+				return StripedAlloc{}, err
+			}
+			ret.Extents = append(ret.Extents, PoolExtent{Device: dev, Offset: offset, Size: extentSize})
+			remain -= extentSize
+		}
+	}
+	return ret, nil
+}
+
+// FreeStriped releases an allocation of AllocStriped.
+func (p *Pool) FreeStriped(s StripedAlloc) error {
+	for _, e := range s.Extents {
+		m, err := p.Device(e.Device)
+		if err != nil {
+			return err
+		}
+		if err = m.Free(e.Offset, e.Size); err != nil {
+			return errors.WithMessagef(err, "device %d", e.Device)
+		}
+	}
+	return nil
+}
+
+// Free implements Manager.Free.
+func (p *Pool) Free(startOffset int64, size int64) error {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return err
+	}
+	return m.Free(offset, size)
+}
+
+// IsAllocated implements Manager.IsAllocated.
+func (p *Pool) IsAllocated(startOffset int64, size int64) (bool, error) {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return false, err
+	}
+	return m.IsAllocated(offset, size)
+}
+
+// ReserveRange implements Manager.ReserveRange.
+func (p *Pool) ReserveRange(startOffset int64, size int64) error {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return err
+	}
+	return m.ReserveRange(offset, size)
+}
+
+// UnreserveRange implements Manager.UnreserveRange.
+func (p *Pool) UnreserveRange(startOffset int64, size int64) error {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return err
+	}
+	return m.UnreserveRange(offset, size)
+}
+
+// MarkBad implements Manager.MarkBad.
+func (p *Pool) MarkBad(startOffset int64, size int64) error {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return err
+	}
+	return m.MarkBad(offset, size)
+}
+
+// IncRef implements Manager.IncRef.
+func (p *Pool) IncRef(startOffset int64, size int64) error {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return err
+	}
+	return m.IncRef(offset, size)
+}
+
+// DecRef implements Manager.DecRef.
+func (p *Pool) DecRef(startOffset int64, size int64) error {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return err
+	}
+	return m.DecRef(offset, size)
+}
+
+// AllocRange implements RangeAllocator.AllocRange. The device of the space
+// should implement RangeAllocator.
+func (p *Pool) AllocRange(startOffset int64, size int64) error {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return err
+	}
+	ra, ok := m.(RangeAllocator)
+	if !ok {
+		dev, _ := SplitPoolOffset(startOffset)
+		return errors.Errorf("device %d can't allocate the given space", dev)
+	}
+	return ra.AllocRange(offset, size)
+}
+
+// SetNamespace implements Manager.SetNamespace. The quota and the reservation
+// apply to the whole Pool, see Pool. The namespace is created on every available
+// device without limit to record its allocations, and the devices are restored
+// if any of them fails.
+func (p *Pool) SetNamespace(ns NamespaceID, quota int64, reservation int64) error {
+	p.nsMu.Lock()
+	defer p.nsMu.Unlock()
+
+	old, existed := p.namespaces.defs[ns]
+	if !existed && ns != DefaultNamespace {
+		// the usage is rebuilt from the devices before it's checked against the
+		// quota
+		p.namespaces.defs[ns] = &namespace{used: p.usedOnDevices(ns)}
+	}
+	if err := p.namespaces.set(ns, quota, reservation, p.freeSize()); err != nil {
+		p.restoreNamespace(ns, old, existed)
+		return err
+	}
+
+	type prevConfig struct {
+		dev   DeviceID
+		stats NamespaceStats
+		// existed is false if the namespace is created on the device, which
+		// can't be removed but has no limit.
+		existed bool
+	}
+	var changed []prevConfig
+	for i, m := range p.devices {
+		if m == nil {
+			continue
+		}
+		s, err := m.NamespaceStats(ns)
+		prev := prevConfig{dev: DeviceID(i), stats: s, existed: err == nil}
+		if err = m.SetNamespace(ns, 0, 0); err != nil {
+			for _, c := range changed {
+				if c.existed {
+					// the device accepted the config before, so it accepts it
+					// again
+					_ = p.devices[c.dev].SetNamespace(ns, c.stats.Quota, c.stats.Reservation)
+				}
+			}
+			p.restoreNamespace(ns, old, existed)
+			return errors.WithMessagef(err, "device %d", i)
+		}
+		changed = append(changed, prev)
+	}
+	return nil
+}
+
+// usedOnDevices returns the total used size of the namespace on the available
+// devices, which charge the allocations by the space they take.
+func (p *Pool) usedOnDevices(ns NamespaceID) int64 {
+	var ret int64
+	for _, m := range p.devices {
+		if m == nil {
+			continue
+		}
+		// a device without the namespace has no allocation of it
+		if s, err := m.NamespaceStats(ns); err == nil {
+			ret += s.UsedSize
+		}
+	}
+	return ret
+}
+
+// restoreNamespace restores the namespace of the Pool after SetNamespace fails.
+func (p *Pool) restoreNamespace(ns NamespaceID, old *namespace, existed bool) {
+	if existed {
+		p.namespaces.defs[ns] = old
+	} else {
+		delete(p.namespaces.defs, ns)
+	}
+}
+
+// AllocIn implements Manager.AllocIn. The quota and the reservations are
+// checked for the whole Pool.
+func (p *Pool) AllocIn(ns NamespaceID, size int64) (int64, error) {
+	p.nsMu.Lock()
+	defer p.nsMu.Unlock()
+	if err := p.admit(ns, size); err != nil {
+		return 0, err
+	}
+	offset, err := p.place(func(m Manager) (int64, error) { return m.AllocIn(ns, size) })
+	if err != nil {
+		return 0, err
+	}
+	if ns != DefaultNamespace {
+		p.namespaces.defs[ns].used = p.usedOnDevices(ns)
+	}
+	return offset, nil
+}
+
+// FreeIn implements Manager.FreeIn.
+func (p *Pool) FreeIn(ns NamespaceID, startOffset int64, size int64) error {
+	m, offset, err := p.locate(startOffset, size)
+	if err != nil {
+		return err
+	}
+
+	p.nsMu.Lock()
+	defer p.nsMu.Unlock()
+	if err = m.FreeIn(ns, offset, size); err != nil {
+		return err
+	}
+	if n, ok := p.namespaces.defs[ns]; ok {
+		n.used = p.usedOnDevices(ns)
+	}
+	return nil
+}
+
+// NamespaceStats implements Manager.NamespaceStats. It returns the quota,
+// reservation and usage of the whole Pool.
+func (p *Pool) NamespaceStats(ns NamespaceID) (NamespaceStats, error) {
+	p.nsMu.Lock()
+	defer p.nsMu.Unlock()
+	return p.namespaces.stats(ns)
+}
+
+// Snapshot implements Manager.Snapshot. It's not supported, see Pool.
+func (p *Pool) Snapshot() (SnapshotID, error) {
+	return 0, errPoolSnapshot
+}
+
+// ListSnapshots implements Manager.ListSnapshots. It's not supported, see Pool.
+func (p *Pool) ListSnapshots() ([]SnapshotInfo, error) {
+	return nil, errPoolSnapshot
+}
+
+// DeleteSnapshot implements Manager.DeleteSnapshot. It's not supported, see
+// Pool.
+func (p *Pool) DeleteSnapshot(SnapshotID) error {
+	return errPoolSnapshot
+}
+
+// RestoreSnapshot implements Manager.RestoreSnapshot. It's not supported, see
+// Pool.
+func (p *Pool) RestoreSnapshot(SnapshotID) error {
+	return errPoolSnapshot
+}
+
+// DiffSnapshots implements Manager.DiffSnapshots. It's not supported, see Pool.
+func (p *Pool) DiffSnapshots(_, _ SnapshotID) ([]Extent, error) {
+	return nil, errPoolSnapshot
+}
+
+// Stats implements Manager.Stats. The stats of the available devices are
+// summed up, and LargestFreeSize is the largest one of a single device.
+func (p *Pool) Stats() Stats {
+	ret := Stats{UnitSize: unitSize}
+	var counts [totalBucketCnt]int64
+	for _, m := range p.devices {
+		if m == nil {
+			continue
+		}
+		s := m.Stats()
+		ret.TotalSize += s.TotalSize
+		ret.UsedSize += s.UsedSize
+		ret.FreeSize += s.FreeSize
+		ret.ReservedSize += s.ReservedSize
+		ret.BadSize += s.BadSize
+		ret.LargestFreeSize = max(ret.LargestFreeSize, s.LargestFreeSize)
+		ret.FreeExtentCnt += s.FreeExtentCnt
+		for _, b := range s.FreeHistogram {
+			counts[getBucketIdx(byteSizeToUnitCnt(b.MinSize))] += b.Count
+		}
+	}
+	ret.FreeHistogram = histogramOf(&counts)
+	return ret
+}
+
+// Extents implements Manager.Extents. The extents of the available devices are
+// reported in the order of DeviceID with Pool offsets.
+func (p *Pool) Extents(fn func(e Extent) bool) {
+	for i, m := range p.devices {
+		if m == nil {
+			continue
+		}
+		stopped := false
+		m.Extents(func(e Extent) bool {
+			e.Offset = PoolOffset(DeviceID(i), e.Offset)
+			stopped = !fn(e)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// Close implements Manager.Close. All available devices are closed, and the
+// first error is returned.
+func (p *Pool) Close() error {
+	var firstErr error
+	for i, m := range p.devices {
+		if m == nil {
+			continue
+		}
+		if err := m.Close(); err != nil && firstErr == nil {
+			firstErr = errors.WithMessagef(err, "device %d", i)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,238 @@
+package disk_management_demo
+
+import (
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestPool(t *testing.T, strategy PlacementStrategy) *Pool {
+	paths := []string{
+		createFileWithContent(t, nil),
+		path.Join(t.TempDir(), "not_exist"),
+		createFileWithContent(t, nil),
+	}
+	p, err := OpenPool(paths, strategy, nil)
+	require.NoError(t, err)
+	return p
+}
+
+func TestPoolOffset(t *testing.T) {
+	offset := PoolOffset(3, spaceTotalSize-unitSize)
+	dev, devOffset := SplitPoolOffset(offset)
+	require.EqualValues(t, 3, dev)
+	require.EqualValues(t, spaceTotalSize-unitSize, devOffset)
+}
+
+func TestPoolPlacement(t *testing.T) {
+	_, err := OpenPool([]string{"not_exist"}, PlaceFillFirst, nil)
+	require.ErrorContains(t, err, "no device can be opened")
+
+	// the unavailable device 1 is skipped
+	var m Manager = openTestPool(t, PlaceRoundRobin)
+	var devs []DeviceID
+	for i := 0; i < 4; i++ {
+		offset, err := m.Alloc(unitSize)
+		require.NoError(t, err)
+		dev, _ := SplitPoolOffset(offset)
+		devs = append(devs, dev)
+	}
+	require.Equal(t, []DeviceID{0, 2, 0, 2}, devs)
+	require.EqualValues(t, 4*unitSize, m.Stats().UsedSize)
+	require.EqualValues(t, 2*spaceTotalSize, m.Stats().TotalSize)
+	_, err = m.IsAllocated(PoolOffset(1, 0), unitSize)
+	require.ErrorIs(t, err, ErrDeviceUnavailable)
+	require.ErrorContains(t, m.Free(PoolOffset(2, spaceTotalSize-unitSize), 2*unitSize), "crosses devices")
+	require.NoError(t, m.Free(PoolOffset(2, 0), unitSize))
+	require.EqualValues(t, 3*unitSize, m.Stats().UsedSize)
+	require.NoError(t, m.Close())
+
+	p := openTestPool(t, PlaceFillFirst)
+	require.Contains(t, p.Unavailable(), DeviceID(1))
+	offset, err := p.Alloc(unitSize)
+	require.NoError(t, err)
+	require.EqualValues(t, PoolOffset(0, 0), offset)
+	offset, err = p.Alloc(unitSize)
+	require.NoError(t, err)
+	require.EqualValues(t, PoolOffset(0, unitSize), offset)
+	// the full device is skipped
+	dev0, err := p.Device(0)
+	require.NoError(t, err)
+	require.NoError(t, dev0.ReserveRange(2*unitSize, spaceTotalSize-2*unitSize))
+	offset, err = p.Alloc(unitSize)
+	require.NoError(t, err)
+	require.EqualValues(t, PoolOffset(2, 0), offset)
+	cnt := 0
+	p.Extents(func(e Extent) bool {
+		cnt++
+		return e.Offset < PoolOffset(2, 0)
+	})
+	require.Equal(t, 3, cnt)
+	require.NoError(t, p.Close())
+
+	p = openTestPool(t, PlaceMostFree)
+	for i := 0; i < 3; i++ {
+		_, err = p.Alloc(int64(i+1) * unitSize)
+		require.NoError(t, err)
+	}
+	dev0, err = p.Device(0)
+	require.NoError(t, err)
+	dev2, err := p.Device(2)
+	require.NoError(t, err)
+	require.EqualValues(t, 4*unitSize, dev0.Stats().UsedSize)
+	require.EqualValues(t, 2*unitSize, dev2.Stats().UsedSize)
+	_, err = p.Snapshot()
+	require.ErrorContains(t, err, "snapshots of Pool should be taken on the devices")
+	require.NoError(t, p.Close())
+}
+
+func TestPoolStriping(t *testing.T) {
+	p := openTestPool(t, PlaceFillFirst)
+	_, err := p.AllocStriped(unitSize, 100)
+	require.ErrorContains(t, err, "stripe size should be a positive multiple of 4KiB, got: 100")
+
+	s, err := p.AllocStriped(5*unitSize+100, 2*unitSize)
+	require.NoError(t, err)
+	require.Equal(t, StripedAlloc{StripeSize: 2 * unitSize, Extents: []PoolExtent{
+		{Device: 0, Offset: 0, Size: 4 * unitSize},
+		{Device: 2, Offset: 0, Size: 2 * unitSize},
+	}}, s)
+	dev, offset := s.Locate(5*unitSize + 50)
+	require.EqualValues(t, 0, dev)
+	require.EqualValues(t, 3*unitSize+50, offset)
+	dev, offset = s.Locate(2*unitSize + 1)
+	require.EqualValues(t, 2, dev)
+	require.EqualValues(t, 1, offset)
+
+	// a small allocation only uses one device
+	s2, err := p.AllocStriped(unitSize, 2*unitSize)
+	require.NoError(t, err)
+	require.Equal(t, []PoolExtent{{Device: 0, Offset: 4 * unitSize, Size: 2 * unitSize}}, s2.Extents)
+
+	require.NoError(t, p.FreeStriped(s))
+	require.NoError(t, p.FreeStriped(s2))
+	require.Zero(t, p.Stats().UsedSize)
+
+	// the space on a device larger than the allocation limit is split, and the
+	// extents may be discontinuous
+	const mib = 1024 * 1024
+	dev0, err := p.Device(0)
+	require.NoError(t, err)
+	require.NoError(t, dev0.ReserveRange(4*mib, unitSize))
+	s, err = p.AllocStriped(10*mib, mib)
+	require.NoError(t, err)
+	require.Len(t, s.Extents, 4)
+	for i, size := range []int64{4 * mib, mib, 4 * mib, mib} {
+		require.EqualValues(t, []DeviceID{0, 0, 2, 2}[i], s.Extents[i].Device)
+		require.EqualValues(t, size, s.Extents[i].Size)
+	}
+	require.EqualValues(t, 10*mib, p.Stats().UsedSize)
+	dev, offset = s.Locate(8*mib + 5)
+	require.EqualValues(t, 0, dev)
+	require.EqualValues(t, s.Extents[1].Offset+5, offset)
+	dev, offset = s.Locate(7*mib + 5)
+	require.EqualValues(t, 2, dev)
+	require.EqualValues(t, s.Extents[2].Offset+3*mib+5, offset)
+	dev, offset = s.Locate(9*mib + 5)
+	require.EqualValues(t, 2, dev)
+	require.EqualValues(t, s.Extents[3].Offset+5, offset)
+	require.NoError(t, p.FreeStriped(s))
+	require.Zero(t, p.Stats().UsedSize)
+	require.NoError(t, p.Close())
+}
+
+// failingNamespaceManager is a Manager whose SetNamespace always fails.
+type failingNamespaceManager struct {
+	Manager
+}
+
+func (m failingNamespaceManager) SetNamespace(NamespaceID, int64, int64) error {
+	return errors.New("mock error")
+}
+
+func TestPoolNamespaces(t *testing.T) {
+	paths := []string{createFileWithContent(t, nil), createFileWithContent(t, nil)}
+	p, err := OpenPool(paths, PlaceRoundRobin, nil)
+	require.NoError(t, err)
+	_, err = p.AllocIn(1, unitSize)
+	require.ErrorContains(t, err, "namespace 1 does not exist")
+
+	// the quota applies to the whole pool rather than every device
+	require.NoError(t, p.SetNamespace(1, 3*unitSize, 0))
+	offset, err := p.AllocIn(1, 2*unitSize)
+	require.NoError(t, err)
+	_, err = p.AllocIn(1, 2*unitSize)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	offset2, err := p.AllocIn(1, unitSize)
+	require.NoError(t, err)
+	dev, _ := SplitPoolOffset(offset)
+	dev2, _ := SplitPoolOffset(offset2)
+	require.NotEqual(t, dev, dev2)
+	stats, err := p.NamespaceStats(1)
+	require.NoError(t, err)
+	require.Equal(t, NamespaceStats{Quota: 3 * unitSize, UsedSize: 3 * unitSize}, stats)
+	require.NoError(t, p.FreeIn(1, offset2, unitSize))
+	stats, err = p.NamespaceStats(1)
+	require.NoError(t, err)
+	require.EqualValues(t, 2*unitSize, stats.UsedSize)
+
+	// the reservation is kept in the free space of all devices
+	reservation := int64(2*spaceTotalSize - 3*unitSize)
+	require.NoError(t, p.SetNamespace(2, 0, reservation))
+	_, err = p.Alloc(2 * unitSize)
+	require.ErrorIs(t, err, ErrNoEnoughSpace)
+	_, err = p.AllocStriped(2*unitSize, unitSize)
+	require.ErrorIs(t, err, ErrNoEnoughSpace)
+	_, err = p.Alloc(unitSize)
+	require.NoError(t, err)
+	require.ErrorIs(t, p.SetNamespace(3, 0, unitSize), ErrNoEnoughSpace)
+	_, err = p.NamespaceStats(3)
+	require.ErrorContains(t, err, "namespace 3 does not exist")
+	require.NoError(t, p.SetNamespace(2, 0, 0))
+	require.NoError(t, p.Close())
+
+	// the usage is rebuilt from the devices
+	p, err = OpenPool(paths, PlaceRoundRobin, nil)
+	require.NoError(t, err)
+	_, err = p.NamespaceStats(1)
+	require.ErrorContains(t, err, "namespace 1 does not exist")
+	require.ErrorContains(t, p.SetNamespace(1, unitSize, 0), "quota 4096 is less than the used size 8192 of namespace 1")
+	require.NoError(t, p.SetNamespace(1, 3*unitSize, 0))
+	stats, err = p.NamespaceStats(1)
+	require.NoError(t, err)
+	require.EqualValues(t, 2*unitSize, stats.UsedSize)
+	// a partial unit is charged as a whole unit
+	require.NoError(t, p.SetNamespace(1, 5*unitSize, 0))
+	_, err = p.AllocIn(1, unitSize+sectorSize)
+	require.NoError(t, err)
+	_, err = p.AllocIn(1, unitSize)
+	require.NoError(t, err)
+	stats, err = p.NamespaceStats(1)
+	require.NoError(t, err)
+	require.EqualValues(t, 5*unitSize, stats.UsedSize)
+	_, err = p.AllocIn(1, sectorSize)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.NoError(t, p.Close())
+
+	// the devices are restored if any of them fails
+	p, err = OpenPool(paths, PlaceRoundRobin, func(imageFilePath string) (Manager, error) {
+		m, err := NewDiskManager(imageFilePath)
+		if err != nil || imageFilePath == paths[0] {
+			return m, err
+		}
+		return failingNamespaceManager{m}, nil
+	})
+	require.NoError(t, err)
+	dev0, err := p.Device(0)
+	require.NoError(t, err)
+	require.NoError(t, dev0.SetNamespace(4, 5*unitSize, unitSize))
+	require.ErrorContains(t, p.SetNamespace(4, 0, 0), "device 1: mock error")
+	stats, err = dev0.NamespaceStats(4)
+	require.NoError(t, err)
+	require.Equal(t, NamespaceStats{Quota: 5 * unitSize, Reservation: unitSize}, stats)
+	_, err = p.NamespaceStats(4)
+	require.ErrorContains(t, err, "namespace 4 does not exist")
+	require.NoError(t, p.Close())
+}
@@ -0,0 +1,400 @@
+package disk_management_demo
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// VolumeID identifies a logical volume of a ThinPool.
+type VolumeID uint32
+
+// ThinExtent is a continuous virtual space of a volume and the physical space
+// that stores it. PhysicalOffset is -1 when the virtual space is not mapped,
+// which reads as zeros.
+type ThinExtent struct {
+	VirtualOffset  int64
+	PhysicalOffset int64
+	Size           int64
+}
+
+// ThinStats is the usage of a ThinPool. All sizes are in bytes.
+type ThinStats struct {
+	// VirtualSize is the total size of the volumes.
+	VirtualSize int64
+	// MappedSize is the size of the physical space mapped by the volumes.
+	MappedSize int64
+	// OvercommitRatio is VirtualSize divided by the usable capacity of the
+	// Manager, which excludes the reserved and bad space. A ratio larger than 1
+	// means the volumes can't be fully written.
+	OvercommitRatio float64
+	// Manager is the usage of the underlying Manager.
+	Manager Stats
+}
+
+// thinVolume is the virtual size and the mapped blocks of a volume.
+type thinVolume struct {
+	size int64
+	// blocks maps the index of a virtual block to the physical offset.
+	blocks map[int64]int64
+}
+
+// ThinPool exposes logical volumes whose total size can be larger than the
+// physical capacity of a Manager. A volume is divided into virtual blocks of the
+// same size, and a block is allocated from the Manager only when it's written
+// for the first time. The mapping is persisted in a separate file by Close,
+// after which the Manager should be closed to persist the allocations. If
+// they're not persisted together, like after a crash, the allocations are
+// reconciled with the mapping when the pool is opened again. It's thread-safe.
+type ThinPool struct {
+	mu sync.Mutex
+
+	m               Manager
+	mappingFilePath string
+	blockSize       int64
+	volumes         map[VolumeID]*thinVolume
+}
+
+// OpenThinPool opens the thin pool on m whose mapping is stored in
+// mappingFilePath. The file is created by Close if it does not exist, otherwise
+// blockSize should be the same as the one it's created with. blockSize should be
+// a multiple of 4KiB and not larger than 4MiB. The pool owns all the space
+// allocated by Alloc of m: the mapped blocks that are free in m are allocated
+// again, which needs m to implement RangeAllocator, and the other space
+// allocated by Alloc is freed. The space of the other users of m is kept if
+// it's allocated in other ways, like AllocIn of their namespaces.
+func OpenThinPool(m Manager, mappingFilePath string, blockSize int64) (*ThinPool, error) {
+	if blockSize <= 0 || blockSize%unitSize != 0 || blockSize > allocLimit {
+		return nil, errors.Errorf("block size should be a positive multiple of 4KiB and not larger than 4MiB, got: %d", blockSize)
+	}
+	p := &ThinPool{
+		m:               m,
+		mappingFilePath: mappingFilePath,
+		blockSize:       blockSize,
+		volumes:         map[VolumeID]*thinVolume{},
+	}
+	data, err := os.ReadFile(mappingFilePath)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = p.decode(data); err != nil {
+		return nil, errors.WithMessage(err, "invalid thin pool mapping")
+	}
+	var used []Range
+	for _, v := range p.volumes {
+		for _, physical := range v.blocks {
+			used = append(used, Range{Offset: physical, Size: blockSize})
+		}
+	}
+	if err = reconcileAllocations(m, used); err != nil {
+		return nil, errors.WithMessage(err, "failed to reconcile the mapping with the manager")
+	}
+	return p, nil
+}
+
+// CreateVolume creates a volume of the virtual size, which should be a positive
+// multiple of the block size. No physical space is allocated.
+func (p *ThinPool) CreateVolume(id VolumeID, size int64) error {
+	if size <= 0 || size%p.blockSize != 0 {
+		return errors.Errorf("volume size should be a positive multiple of the block size %d, got: %d", p.blockSize, size)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.volumes[id]; ok {
+		return errors.Errorf("volume %d already exists", id)
+	}
+	p.volumes[id] = &thinVolume{size: size, blocks: map[int64]int64{}}
+	return nil
+}
+
+// DeleteVolume deletes the volume and frees all its mapped blocks.
+func (p *ThinPool) DeleteVolume(id VolumeID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v, err := p.volume(id)
+	if err != nil {
+		return err
+	}
+	if err = p.unmap(v, 0, v.size/p.blockSize); err != nil {
+		return err
+	}
+	delete(p.volumes, id)
+	return nil
+}
+
+// volume returns the volume, or an error if it does not exist.
+func (p *ThinPool) volume(id VolumeID) (*thinVolume, error) {
+	v, ok := p.volumes[id]
+	if !ok {
+		return nil, errors.Errorf("volume %d does not exist", id)
+	}
+	return v, nil
+}
+
+// checkVolumeRange checks [offset, offset+size) is inside the volume.
+func checkVolumeRange(v *thinVolume, id VolumeID, offset, size int64) error {
+	if offset < 0 || size <= 0 || offset+size > v.size {
+		return errors.Errorf("range at %d with size %d is out of volume %d of size %d", offset, size, id, v.size)
+	}
+	return nil
+}
+
+// MapWrite returns the physical space to write [offset, offset+size) of the
+// volume. The blocks touched by the range that are not mapped are allocated
+// from the Manager. If the Manager runs out of space, it returns
+// ErrNoEnoughSpace, and the blocks allocated before are kept mapped.
+func (p *ThinPool) MapWrite(id VolumeID, offset, size int64) ([]ThinExtent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v, err := p.volume(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkVolumeRange(v, id, offset, size); err != nil {
+		return nil, err
+	}
+	for index := offset / p.blockSize; index*p.blockSize < offset+size; index++ {
+		if _, ok := v.blocks[index]; ok {
+			continue
+		}
+		physical, err := p.m.Alloc(p.blockSize)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to map block %d of volume %d", index, id)
+		}
+		v.blocks[index] = physical
+	}
+	return p.lookup(v, offset, size), nil
+}
+
+// Lookup returns the physical space to read [offset, offset+size) of the
+// volume, without allocating the unmapped blocks.
+func (p *ThinPool) Lookup(id VolumeID, offset, size int64) ([]ThinExtent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v, err := p.volume(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkVolumeRange(v, id, offset, size); err != nil {
+		return nil, err
+	}
+	return p.lookup(v, offset, size), nil
+}
+
+// lookup returns the extents of [offset, offset+size) in the ascending order of
+// virtual offset. The adjacent blocks are merged when they are both unmapped or
+// physically continuous.
+func (p *ThinPool) lookup(v *thinVolume, offset, size int64) []ThinExtent {
+	var ret []ThinExtent
+	for start, end := offset, offset+size; start < end; {
+		index := start / p.blockSize
+		inBlock := start % p.blockSize
+		n := min(p.blockSize-inBlock, end-start)
+		physical := int64(-1)
+		if b, ok := v.blocks[index]; ok {
+			physical = b + inBlock
+		}
+		if last := len(ret) - 1; last >= 0 {
+			prev := &ret[last]
+			switch {
+			case physical < 0 && prev.PhysicalOffset < 0,
+				physical >= 0 && prev.PhysicalOffset >= 0 && prev.PhysicalOffset+prev.Size == physical:
+				prev.Size += n
+				start += n
+				continue
+			}
+		}
+		ret = append(ret, ThinExtent{VirtualOffset: start, PhysicalOffset: physical, Size: n})
+		start += n
+	}
+	return ret
+}
+
+// Discard unmaps the blocks fully covered by [offset, offset+size) of the
+// volume and frees their physical space. The partially covered blocks are kept.
+func (p *ThinPool) Discard(id VolumeID, offset, size int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	v, err := p.volume(id)
+	if err != nil {
+		return err
+	}
+	if err = checkVolumeRange(v, id, offset, size); err != nil {
+		return err
+	}
+	first := (offset + p.blockSize - 1) / p.blockSize
+	return p.unmap(v, first, (offset+size)/p.blockSize)
+}
+
+// unmap frees the mapped blocks whose index is in [first, end).
+func (p *ThinPool) unmap(v *thinVolume, first, end int64) error {
+	if end-first > int64(len(v.blocks)) {
+		// the range is sparse, so visit the mapped blocks rather than the range
+		for index, physical := range v.blocks {
+			if index < first || index >= end {
+				continue
+			}
+			if err := p.m.Free(physical, p.blockSize); err != nil {
+				return err
+			}
+			delete(v.blocks, index)
+		}
+		return nil
+	}
+	for index := first; index < end; index++ {
+		physical, ok := v.blocks[index]
+		if !ok {
+			continue
+		}
+		if err := p.m.Free(physical, p.blockSize); err != nil {
+			return err
+		}
+		delete(v.blocks, index)
+	}
+	return nil
+}
+
+// Stats returns the usage of the pool and the Manager.
+func (p *ThinPool) Stats() ThinStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := ThinStats{Manager: p.m.Stats()}
+	for _, v := range p.volumes {
+		s.VirtualSize += v.size
+		s.MappedSize += int64(len(v.blocks)) * p.blockSize
+	}
+	if capacity := s.Manager.TotalSize - s.Manager.ReservedSize - s.Manager.BadSize; capacity > 0 {
+		s.OvercommitRatio = float64(s.VirtualSize) / float64(capacity)
+	}
+	return s
+}
+
+// Close writes the mapping to the mapping file. The Manager is not closed.
+func (p *ThinPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return writeFileAtomically(p.mappingFilePath, p.encode())
+}
+
+// The layout of the mapping file is, all integers are little-endian:
+//
+//	magic     [4]byte, "DMTP"
+//	version   uint32
+//	blockSize int64
+//	volumeCnt uint32
+//	volumes   volumeCnt * {id uint32, size int64, blockCnt uint32, blocks}
+//	crc       uint32, CRC-32C of all the bytes before
+//
+// where blocks is blockCnt * {index int64, physicalOffset int64}. The volumes
+// and the blocks are in the ascending order of ID and index.
+const (
+	thinMagic           = "DMTP"
+	thinVersion         = 1
+	thinHeaderSize      = 4 + 4 + 8 + 4
+	thinVolumeHeadSize  = 4 + 8 + 4
+	thinBlockRecordSize = 8 + 8
+)
+
+func (p *ThinPool) encode() []byte {
+	ids := make([]VolumeID, 0, len(p.volumes))
+	for id := range p.volumes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	buf := make([]byte, 0, thinHeaderSize)
+	buf = append(buf, thinMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, thinVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(p.blockSize))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(ids)))
+	for _, id := range ids {
+		v := p.volumes[id]
+		indexes := make([]int64, 0, len(v.blocks))
+		for index := range v.blocks {
+			indexes = append(indexes, index)
+		}
+		sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(id))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(v.size))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(indexes)))
+		for _, index := range indexes {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(index))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(v.blocks[index]))
+		}
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoli))
+}
+
+func (p *ThinPool) decode(data []byte) error {
+	if len(data) < thinHeaderSize+4 || string(data[:4]) != thinMagic {
+		return errors.New("not a thin pool mapping file")
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return errors.New("checksum mismatches")
+	}
+	if v := binary.LittleEndian.Uint32(body[4:]); v != thinVersion {
+		return errors.Errorf("unsupported version: %d", v)
+	}
+	if bs := int64(binary.LittleEndian.Uint64(body[8:])); bs != p.blockSize {
+		return errors.Errorf("block size is %d, but %d is given", bs, p.blockSize)
+	}
+	volumeCnt := binary.LittleEndian.Uint32(body[16:])
+	body = body[thinHeaderSize:]
+	for i := uint32(0); i < volumeCnt; i++ {
+		if len(body) < thinVolumeHeadSize {
+			return errors.Errorf("volume %d is truncated", i)
+		}
+		id := VolumeID(binary.LittleEndian.Uint32(body))
+		v := &thinVolume{size: int64(binary.LittleEndian.Uint64(body[4:])), blocks: map[int64]int64{}}
+		blockCnt := int(binary.LittleEndian.Uint32(body[12:]))
+		body = body[thinVolumeHeadSize:]
+		if _, ok := p.volumes[id]; ok {
+			return errors.Errorf("volume %d is duplicated", id)
+		}
+		if v.size <= 0 || v.size%p.blockSize != 0 {
+			return errors.Errorf("volume %d has invalid size %d", id, v.size)
+		}
+		if len(body) < blockCnt*thinBlockRecordSize {
+			return errors.Errorf("blocks of volume %d are truncated", id)
+		}
+		for j := 0; j < blockCnt; j++ {
+			index := int64(binary.LittleEndian.Uint64(body))
+			physical := int64(binary.LittleEndian.Uint64(body[8:]))
+			body = body[thinBlockRecordSize:]
+			if index < 0 || index >= v.size/p.blockSize {
+				return errors.Errorf("block %d of volume %d is out of range", index, id)
+			}
+			if _, ok := v.blocks[index]; ok {
+				return errors.Errorf("block %d of volume %d is duplicated", index, id)
+			}
+			// the space is checked by the Manager in reconcileAllocations, since
+			// the offsets of some Managers like Pool are not limited to 1TiB
+			if err := checkBlockRange(physical, p.blockSize); err != nil {
+				return errors.WithMessagef(err, "block %d of volume %d", index, id)
+			}
+			v.blocks[index] = physical
+		}
+		p.volumes[id] = v
+	}
+	if len(body) > 0 {
+		return errors.Errorf("%d unexpected bytes at the end", len(body))
+	}
+	return nil
+}
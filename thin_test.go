@@ -0,0 +1,253 @@
+package disk_management_demo
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThinPool(t *testing.T) {
+	const blockSize = 64 * 1024
+	imageFile := createFileWithContent(t, nil)
+	mappingFile := path.Join(t.TempDir(), "mapping")
+	m, err := NewDiskManager(imageFile)
+	require.NoError(t, err)
+
+	_, err = OpenThinPool(m, mappingFile, 1000)
+	require.ErrorContains(t, err, "block size should be a positive multiple of 4KiB and not larger than 4MiB, got: 1000")
+	p, err := OpenThinPool(m, mappingFile, blockSize)
+	require.NoError(t, err)
+
+	require.NoError(t, p.CreateVolume(1, spaceTotalSize))
+	require.NoError(t, p.CreateVolume(2, spaceTotalSize))
+	require.ErrorContains(t, p.CreateVolume(1, blockSize), "volume 1 already exists")
+	require.ErrorContains(t, p.CreateVolume(3, 100), "volume size should be a positive multiple of the block size 65536, got: 100")
+
+	got, err := p.Lookup(1, 100, 2*blockSize)
+	require.NoError(t, err)
+	require.Equal(t, []ThinExtent{{VirtualOffset: 100, PhysicalOffset: -1, Size: 2 * blockSize}}, got)
+
+	// the blocks are allocated on the first write
+	got, err = p.MapWrite(1, blockSize+100, blockSize)
+	require.NoError(t, err)
+	require.Equal(t, []ThinExtent{{VirtualOffset: blockSize + 100, PhysicalOffset: 100, Size: blockSize}}, got)
+	got, err = p.MapWrite(2, 0, blockSize)
+	require.NoError(t, err)
+	require.Equal(t, []ThinExtent{{VirtualOffset: 0, PhysicalOffset: 2 * blockSize, Size: blockSize}}, got)
+	got, err = p.Lookup(1, 0, 4*blockSize)
+	require.NoError(t, err)
+	require.Equal(t, []ThinExtent{
+		{VirtualOffset: 0, PhysicalOffset: -1, Size: blockSize},
+		{VirtualOffset: blockSize, PhysicalOffset: 0, Size: 2 * blockSize},
+		{VirtualOffset: 3 * blockSize, PhysicalOffset: -1, Size: blockSize},
+	}, got)
+	_, err = p.Lookup(1, spaceTotalSize-1, 2)
+	require.ErrorContains(t, err, "is out of volume 1")
+	_, err = p.MapWrite(3, 0, 1)
+	require.ErrorContains(t, err, "volume 3 does not exist")
+
+	stats := p.Stats()
+	require.EqualValues(t, 2*spaceTotalSize, stats.VirtualSize)
+	require.EqualValues(t, 3*blockSize, stats.MappedSize)
+	require.EqualValues(t, 3*blockSize, stats.Manager.UsedSize)
+	require.InDelta(t, 2.0, stats.OvercommitRatio, 1e-9)
+
+	// only the fully covered blocks are discarded
+	require.NoError(t, p.Discard(1, blockSize+1, 2*blockSize))
+	got, err = p.Lookup(1, blockSize, 2*blockSize)
+	require.NoError(t, err)
+	require.Equal(t, []ThinExtent{
+		{VirtualOffset: blockSize, PhysicalOffset: 0, Size: blockSize},
+		{VirtualOffset: 2 * blockSize, PhysicalOffset: -1, Size: blockSize},
+	}, got)
+	require.EqualValues(t, 2*blockSize, m.Stats().UsedSize)
+	require.NoError(t, p.Close())
+	require.NoError(t, m.Close())
+
+	m, err = NewDiskManager(imageFile)
+	require.NoError(t, err)
+	_, err = OpenThinPool(m, mappingFile, 2*blockSize)
+	require.ErrorContains(t, err, "invalid thin pool mapping: block size is 65536, but 131072 is given")
+	p, err = OpenThinPool(m, mappingFile, blockSize)
+	require.NoError(t, err)
+	got, err = p.Lookup(2, 0, blockSize)
+	require.NoError(t, err)
+	require.Equal(t, []ThinExtent{{VirtualOffset: 0, PhysicalOffset: 2 * blockSize, Size: blockSize}}, got)
+	require.NoError(t, p.DeleteVolume(1))
+	require.NoError(t, p.DeleteVolume(2))
+	require.Zero(t, p.Stats().Manager.UsedSize)
+
+	// the mapped blocks should be allocated in the manager
+	_, err = p.MapWrite(2, 0, 1)
+	require.ErrorContains(t, err, "volume 2 does not exist")
+	require.NoError(t, p.CreateVolume(2, blockSize))
+	_, err = p.MapWrite(2, 0, 1)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.NoError(t, m.Close())
+	buddyImageFile := createFileWithContent(t, nil)
+	b, err := NewBuddyManager(buddyImageFile)
+	require.NoError(t, err)
+	_, err = OpenThinPool(b, mappingFile, blockSize)
+	require.ErrorContains(t, err, "failed to reconcile the mapping with the manager: range at 0 with size 65536 is not allocated in the manager")
+
+	data, err := os.ReadFile(mappingFile)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 1
+	require.NoError(t, os.WriteFile(mappingFile, data, 0600))
+	_, err = OpenThinPool(m, mappingFile, blockSize)
+	require.ErrorContains(t, err, "invalid thin pool mapping: checksum mismatches")
+}
+
+func TestThinPoolCrash(t *testing.T) {
+	imageFile := createFileWithContent(t, nil)
+	mappingFile := path.Join(t.TempDir(), "mapping")
+	blockSize := int64(16 * unitSize)
+	m, err := NewDiskManager(imageFile)
+	require.NoError(t, err)
+	p, err := OpenThinPool(m, mappingFile, blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.CreateVolume(1, 4*blockSize))
+	_, err = p.MapWrite(1, 0, 2*blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.NoError(t, m.Close())
+
+	// crash after the mapping is written but before the manager is closed, so
+	// the allocation of block 2 is lost, and block 1 is kept after it's
+	// unmapped
+	m, err = NewDiskManager(imageFile)
+	require.NoError(t, err)
+	p, err = OpenThinPool(m, mappingFile, blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.Discard(1, blockSize, blockSize))
+	_, err = p.MapWrite(1, 2*blockSize, 1)
+	require.NoError(t, err)
+	expected, err := p.Lookup(1, 0, 4*blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	m, err = NewDiskManager(imageFile)
+	require.NoError(t, err)
+	p, err = OpenThinPool(m, mappingFile, blockSize)
+	require.NoError(t, err)
+	got, err := p.Lookup(1, 0, 4*blockSize)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+	require.EqualValues(t, 2*blockSize, m.Stats().UsedSize)
+	// the new blocks don't reuse the mapped ones
+	extents, err := p.MapWrite(1, 3*blockSize, 1)
+	require.NoError(t, err)
+	require.NotContains(t, []int64{got[0].PhysicalOffset, got[2].PhysicalOffset}, extents[0].PhysicalOffset)
+
+	// crash after the manager is closed but before the mapping is written, so
+	// block 3 is leaked
+	require.NoError(t, m.Close())
+	m, err = NewDiskManager(imageFile)
+	require.NoError(t, err)
+	p, err = OpenThinPool(m, mappingFile, blockSize)
+	require.NoError(t, err)
+	require.EqualValues(t, 2*blockSize, m.Stats().UsedSize)
+	got, err = p.Lookup(1, 3*blockSize, blockSize)
+	require.NoError(t, err)
+	require.EqualValues(t, -1, got[0].PhysicalOffset)
+	require.NoError(t, p.Close())
+	require.NoError(t, m.Close())
+}
+
+func TestThinPoolSharedManager(t *testing.T) {
+	imageFile := createFileWithContent(t, nil)
+	mappingFile := path.Join(t.TempDir(), "mapping")
+	blockSize := int64(4 * unitSize)
+	m, err := NewDiskManager(imageFile)
+	require.NoError(t, err)
+	p, err := OpenThinPool(m, mappingFile, blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.CreateVolume(1, 2*blockSize))
+	_, err = p.MapWrite(1, 0, blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	// other users allocate small and namespace space from the same manager
+	small, err := m.Alloc(512)
+	require.NoError(t, err)
+	require.NoError(t, m.SetNamespace(3, 0, 0))
+	owned, err := m.AllocIn(3, unitSize)
+	require.NoError(t, err)
+
+	p, err = OpenThinPool(m, mappingFile, blockSize)
+	require.NoError(t, err)
+	for _, r := range []Range{{Offset: small, Size: 512}, {Offset: owned, Size: unitSize}} {
+		allocated, err := m.IsAllocated(r.Offset, r.Size)
+		require.NoError(t, err)
+		require.True(t, allocated)
+	}
+	require.EqualValues(t, blockSize+2*unitSize, m.Stats().UsedSize)
+	require.NoError(t, p.Close())
+	require.NoError(t, m.Close())
+}
+
+func TestThinPoolOnPool(t *testing.T) {
+	paths := []string{createFileWithContent(t, nil), createFileWithContent(t, nil)}
+	mappingFile := path.Join(t.TempDir(), "mapping")
+	blockSize := int64(4 * unitSize)
+	pool, err := OpenPool(paths, PlaceRoundRobin, nil)
+	require.NoError(t, err)
+	p, err := OpenThinPool(pool, mappingFile, blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.CreateVolume(1, 4*blockSize))
+	extents, err := p.MapWrite(1, 0, 2*blockSize)
+	require.NoError(t, err)
+	var devs []DeviceID
+	for _, e := range extents {
+		dev, _ := SplitPoolOffset(e.PhysicalOffset)
+		devs = append(devs, dev)
+	}
+	require.Contains(t, devs, DeviceID(1))
+	expected, err := p.Lookup(1, 0, 4*blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.NoError(t, pool.Close())
+
+	// the blocks on device 1 are kept after reopening
+	pool, err = OpenPool(paths, PlaceRoundRobin, nil)
+	require.NoError(t, err)
+	p, err = OpenThinPool(pool, mappingFile, blockSize)
+	require.NoError(t, err)
+	got, err := p.Lookup(1, 0, 4*blockSize)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+	require.EqualValues(t, 2*blockSize, pool.Stats().UsedSize)
+	require.NoError(t, p.Close())
+	require.NoError(t, pool.Close())
+
+	// crash before the pool is closed, so the allocations of the new blocks are
+	// lost and allocated again by Pool.AllocRange
+	pool, err = OpenPool(paths, PlaceRoundRobin, nil)
+	require.NoError(t, err)
+	p, err = OpenThinPool(pool, mappingFile, blockSize)
+	require.NoError(t, err)
+	extents, err = p.MapWrite(1, 2*blockSize, 2*blockSize)
+	require.NoError(t, err)
+	expected, err = p.Lookup(1, 0, 4*blockSize)
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	pool, err = OpenPool(paths, PlaceRoundRobin, nil)
+	require.NoError(t, err)
+	for _, e := range extents {
+		allocated, err := pool.IsAllocated(e.PhysicalOffset, blockSize)
+		require.NoError(t, err)
+		require.False(t, allocated)
+	}
+	p, err = OpenThinPool(pool, mappingFile, blockSize)
+	require.NoError(t, err)
+	got, err = p.Lookup(1, 0, 4*blockSize)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+	require.EqualValues(t, 4*blockSize, pool.Stats().UsedSize)
+	require.NoError(t, p.Close())
+	require.NoError(t, pool.Close())
+}
@@ -1,6 +1,10 @@
 package disk_management_demo
 
-import "math/bits"
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
 
 func getHighestOneIdx(n unit) int {
 	return bits.Len32(uint32(n)) - 1
@@ -92,84 +96,51 @@ func freeInBitmap(bitmap []byte, offset, length unit) {
 	bitmap[offset/8] &= b
 }
 
+// findLeadingZerosCnt returns the number of continuous zero bits starting from
+// startOffset. It searches the bitmap word by word, use bitmapSummary to skip
+// the uniform regions.
 func findLeadingZerosCnt(bitmap []byte, startOffset unit) unit {
-	if startOffset == unitTotalCnt {
-		return 0
-	}
-	if startOffset > unitTotalCnt {
-		panic("unexpected startOffset")
-	}
+	return (*bitmapSummary)(nil).findLeadingBitsCnt(bitmap, startOffset, false)
+}
 
-	byteIdx := startOffset / 8
-	bitIdx := startOffset % 8
+// findLeadingOnesCnt is like findLeadingZerosCnt, but counts the one bits.
+func findLeadingOnesCnt(bitmap []byte, startOffset unit) unit {
+	return (*bitmapSummary)(nil).findLeadingBitsCnt(bitmap, startOffset, true)
+}
 
-	ret := unit(0)
-	b := bitmap[byteIdx]
-	for ; bitIdx < 8; bitIdx++ {
-		if b&(1<<bitIdx) != 0 {
-			return ret
-		}
-		ret++
-	}
+// findTrailingZerosCnt returns the number of continuous zero bits ending at
+// endOffset (exclusive). It searches the bitmap word by word, use bitmapSummary
+// to skip the uniform regions.
+func findTrailingZerosCnt(bitmap []byte, endOffset unit) unit {
+	return (*bitmapSummary)(nil).findTrailingBitsCnt(bitmap, endOffset, false)
+}
 
-	for byteIdx++; byteIdx < bitmapSize; byteIdx++ {
-		if bitmap[byteIdx] != 0 {
-			break
-		}
-		ret += 8
+// countOnes returns the number of set bits in bitmap, whose length should be a
+// multiple of 8.
+func countOnes(bitmap []byte) unit {
+	var ret unit
+	for i := 0; i < len(bitmap); i += 8 {
+		ret += unit(bits.OnesCount64(binary.LittleEndian.Uint64(bitmap[i:])))
 	}
-	if byteIdx == bitmapSize {
-		return ret
-	}
-	bitIdx = 0
-	b = bitmap[byteIdx]
-	for ; bitIdx < 8; bitIdx++ {
-		if b&(1<<bitIdx) != 0 {
-			return ret
-		}
-		ret++
-	}
-
 	return ret
 }
 
-func findTrailingZerosCnt(bitmap []byte, endOffset unit) unit {
-	if endOffset == 0 {
-		return 0
-	}
-	if endOffset > unitTotalCnt {
-		panic("unexpected endOffset")
-	}
+// cleanupError is an error after which the cleanup also fails. The failure of
+// the cleanup is attached after the original error, which is still the cause.
+type cleanupError struct {
+	err     error
+	cleanup error
+}
 
-	byteIdx := int((endOffset - 1) / 8)
-	bitIdx := int((endOffset - 1) % 8)
+// withCleanupError returns err with the failure of its cleanup attached.
+func withCleanupError(err, cleanup error) error {
+	return &cleanupError{err: err, cleanup: cleanup}
+}
 
-	ret := unit(0)
-	b := bitmap[byteIdx]
-	for ; bitIdx >= 0; bitIdx-- {
-		if b&(1<<bitIdx) != 0 {
-			return ret
-		}
-		ret++
-	}
+func (e *cleanupError) Error() string {
+	return fmt.Sprintf("%v (cleanup also failed: %v)", e.err, e.cleanup)
+}
 
-	for byteIdx--; byteIdx >= 0; byteIdx-- {
-		if bitmap[byteIdx] != 0 {
-			break
-		}
-		ret += 8
-	}
-	if byteIdx == -1 {
-		return ret
-	}
-	bitIdx = 7
-	b = bitmap[byteIdx]
-	for ; bitIdx >= 0; bitIdx-- {
-		if b&(1<<bitIdx) != 0 {
-			return ret
-		}
-		ret++
-	}
+func (e *cleanupError) Cause() error { return e.err }
 
-	return ret
-}
+func (e *cleanupError) Unwrap() error { return e.err }
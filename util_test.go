@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -65,6 +66,21 @@ func TestFindLeadingZerosCnt(t *testing.T) {
 	require.EqualValues(t, 8, findLeadingZerosCnt(bitmap, unit((len(bitmap)-1)*8)))
 }
 
+func TestFindLeadingOnesCnt(t *testing.T) {
+	bitmap := make([]byte, bitmapSize)
+	bitmap[0] = 0b1110_1101
+	bitmap[1] = 0b1111_1111
+	bitmap[2] = 0b0000_0001
+	bitmap[len(bitmap)-1] = 0xFF
+
+	require.EqualValues(t, 1, findLeadingOnesCnt(bitmap, 0))
+	require.EqualValues(t, 0, findLeadingOnesCnt(bitmap, 1))
+	require.EqualValues(t, 2, findLeadingOnesCnt(bitmap, 2))
+	require.EqualValues(t, 12, findLeadingOnesCnt(bitmap, 5))
+	require.EqualValues(t, 0, findLeadingOnesCnt(bitmap, 17))
+	require.EqualValues(t, 8, findLeadingOnesCnt(bitmap, unit((len(bitmap)-1)*8)))
+}
+
 func TestFindTrailingZerosCnt(t *testing.T) {
 	bitmap := slices.Clone(ones[:])
 	bitmap[0] = 0b0001_0010
@@ -91,6 +107,13 @@ func (g geometricDistribution) random() int {
 	return int(math.Floor(math.Log(g.r.Float64()) / math.Log(1-g.p)))
 }
 
+func TestWithCleanupError(t *testing.T) {
+	err := withCleanupError(ErrNoEnoughSpace, errors.New("device 1: device unavailable"))
+	require.EqualError(t, err, "no enough space (cleanup also failed: device 1: device unavailable)")
+	require.ErrorIs(t, err, ErrNoEnoughSpace)
+	require.Equal(t, ErrNoEnoughSpace, errors.Cause(err))
+}
+
 func TestGeometricDistribution(t *testing.T) {
 	seed := time.Now().UnixNano()
 	t.Logf("seed: %d", seed)